@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Erspan is a structure to describe ERSPAN settings of gre endpoint in
+// erspan or ip6erspan mode. The session ID of ERSPAN is the GRE key.
+type Erspan struct {
+	Version int    `yaml:"version"` // (optional) ERSPAN version 1 (type II) or 2 (type III) (default: 1)
+	Index   uint32 `yaml:"index"`   // (optional) port index of version 1
+	Dir     string `yaml:"dir"`     // (optional) ingress or egress of version 2 (default: direction of the mirror)
+	HwID    uint16 `yaml:"hwid"`    // (optional) hardware ID of version 2
+}
+
+// IFLA_GRE_* attributes of ERSPAN (linux/if_tunnel.h), which netlink
+// package does not have.
+const (
+	iflaGreErspanIndex = 21
+	iflaGreErspanVer   = 22
+	iflaGreErspanDir   = 23
+	iflaGreErspanHwID  = 24
+)
+
+// erspanMaxSession is the maximum ERSPAN session ID (10 bits).
+const erspanMaxSession = 0x3ff
+
+// erspanDirs is the map from ERSPAN direction to the value of attribute.
+var erspanDirs = map[string]uint8{
+	"ingress": 0,
+	"egress":  1,
+}
+
+// isErspanMode returns true if given gre mode is ERSPAN.
+func isErspanMode(mode string) bool {
+	return mode == "erspan" || mode == "ip6erspan"
+}
+
+// Validate checks ERSPAN settings.
+func (erspan *Erspan) Validate() error {
+	switch erspan.Version {
+	case 0, 1:
+		if erspan.Dir != "" || erspan.HwID != 0 {
+			return fmt.Errorf("erspan dir/hwid need version 2")
+		}
+		if erspan.Index >= 1<<20 {
+			return fmt.Errorf("invalid erspan index %d (should be < 2^20)",
+				erspan.Index)
+		}
+	case 2:
+		if erspan.Index != 0 {
+			return fmt.Errorf("erspan index needs version 1")
+		}
+		if _, ok := erspanDirs[erspan.Dir]; !ok && erspan.Dir != "" {
+			return fmt.Errorf("unknown erspan dir %q", erspan.Dir)
+		}
+		if erspan.HwID >= 1<<6 {
+			return fmt.Errorf("invalid erspan hwid %d (should be < 64)",
+				erspan.HwID)
+		}
+	default:
+		return fmt.Errorf("unknown erspan version %d", erspan.Version)
+	}
+	return nil
+}
+
+// erspan returns ERSPAN settings of gre, with default version.
+func (gre *Gre) erspan() Erspan {
+	erspan := Erspan{}
+	if gre.Erspan != nil {
+		erspan = *gre.Erspan
+	}
+	if erspan.Version == 0 {
+		erspan.Version = 1
+	}
+	return erspan
+}
+
+// setErspanDefaults fills default ERSPAN settings of gre in erspan modes.
+// The direction of version 2 follows the mirror sessions of veth which
+// uses the tunnel (egress only if all of them are egress).
+func (gre *Gre) setErspanDefaults(veth VEth) {
+	if !isErspanMode(gre.Mode) {
+		return
+	}
+	erspan := gre.erspan()
+	if erspan.Version == 2 && erspan.Dir == "" {
+		erspan.Dir = "ingress"
+		if len(veth.Mirrors) != 0 &&
+			len(veth.mirrorSources("ingress")) == 0 {
+			erspan.Dir = "egress"
+		}
+	}
+	gre.Erspan = &erspan
+}
+
+// addErspanInterface creates ERSPAN interface of gre object, with local
+// address and parent interface index which AddGreInterface resolved.
+func addErspanInterface(gre Gre, devName string, local net.IP, parentIndex int) error {
+	erspan := gre.erspan()
+	if err := erspan.Validate(); err != nil {
+		return err
+	}
+	if gre.Key > erspanMaxSession {
+		return fmt.Errorf("invalid erspan session %d (should be <= %d)",
+			gre.Key, erspanMaxSession)
+	}
+
+	remote := gre.Remote
+	if gre.Mode == "erspan" {
+		local, remote = local.To4(), remote.To4()
+	}
+	return addRawLink(gre.Mode, devName, gre.MTU, func(data *nl.RtAttr) {
+		data.AddRtAttr(nl.IFLA_GRE_LOCAL, []byte(local))
+		data.AddRtAttr(nl.IFLA_GRE_REMOTE, []byte(remote))
+		// ERSPAN needs both key (session ID) and sequence number
+		flags := make([]byte, 2)
+		binary.BigEndian.PutUint16(flags, nl.GRE_KEY|nl.GRE_SEQ)
+		data.AddRtAttr(nl.IFLA_GRE_IFLAGS, flags)
+		data.AddRtAttr(nl.IFLA_GRE_OFLAGS, flags)
+		key := make([]byte, 4)
+		binary.BigEndian.PutUint32(key, gre.Key)
+		data.AddRtAttr(nl.IFLA_GRE_IKEY, key)
+		data.AddRtAttr(nl.IFLA_GRE_OKEY, key)
+		if parentIndex != 0 {
+			data.AddRtAttr(nl.IFLA_GRE_LINK, nl.Uint32Attr(uint32(parentIndex)))
+		}
+		if gre.TTL != 0 {
+			data.AddRtAttr(nl.IFLA_GRE_TTL, nl.Uint8Attr(uint8(gre.TTL)))
+		}
+		data.AddRtAttr(iflaGreErspanVer, nl.Uint8Attr(uint8(erspan.Version)))
+		if erspan.Version == 1 {
+			data.AddRtAttr(iflaGreErspanIndex, nl.Uint32Attr(erspan.Index))
+		} else {
+			data.AddRtAttr(iflaGreErspanDir, nl.Uint8Attr(erspanDirs[erspan.Dir]))
+			data.AddRtAttr(iflaGreErspanHwID, nl.Uint16Attr(erspan.HwID))
+		}
+	})
+}
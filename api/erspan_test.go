@@ -0,0 +1,63 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestErspanDefaults(t *testing.T) {
+	// test case1: version 1 without settings
+	gre1 := Gre{Mode: "erspan", Key: 10}
+	gre1.setErspanDefaults(VEth{Mirrors: []Mirror{{Source: "eth0", Direction: "ingress"}}})
+	if gre1.Erspan == nil || gre1.Erspan.Version != 1 || gre1.Erspan.Dir != "" {
+		t.Fatalf("defaults error: %+v", gre1.Erspan)
+	}
+
+	// test case2: direction of version 2 follows the mirror
+	gre2 := Gre{Mode: "ip6erspan", Erspan: &Erspan{Version: 2}}
+	gre2.setErspanDefaults(VEth{Mirrors: []Mirror{{Source: "eth0", Direction: "egress"}}})
+	if gre2.Erspan.Dir != "egress" {
+		t.Fatalf("defaults error: %+v", gre2.Erspan)
+	}
+	gre2 = Gre{Mode: "erspan", Erspan: &Erspan{Version: 2}}
+	gre2.setErspanDefaults(VEth{Mirrors: []Mirror{
+		{Source: "eth0", Direction: "egress"},
+		{Source: "eth1", Direction: "ingress"},
+	}})
+	if gre2.Erspan.Dir != "ingress" {
+		t.Fatalf("defaults error: %+v", gre2.Erspan)
+	}
+
+	// test case3: not erspan mode
+	gre3 := Gre{Mode: "gretap"}
+	gre3.setErspanDefaults(VEth{Mirrors: []Mirror{{Source: "eth0", Direction: "ingress"}}})
+	if gre3.Erspan != nil {
+		t.Fatalf("defaults error: %+v", gre3.Erspan)
+	}
+}
+
+func TestErspanValidate(t *testing.T) {
+	valids := []Erspan{
+		{},
+		{Version: 1, Index: 0xfffff},
+		{Version: 2, Dir: "egress", HwID: 63},
+	}
+	for _, erspan := range valids {
+		if err := erspan.Validate(); err != nil {
+			t.Fatalf("Validate error %+v: %v", erspan, err)
+		}
+	}
+
+	invalids := []Erspan{
+		{Version: 3},
+		{Version: 1, Index: 1 << 20},
+		{Version: 1, Dir: "ingress"},
+		{Version: 2, Index: 1},
+		{Version: 2, Dir: "both"},
+		{Version: 2, HwID: 64},
+	}
+	for _, erspan := range invalids {
+		if err := erspan.Validate(); err == nil {
+			t.Fatalf("Validate should fail with %+v", erspan)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// FdbEntry is a structure to describe forwarding database entry of vxlan,
+// i.e. remote VTEP of given MAC address. Entries with all-zero MAC address
+// are used for head-end replication of broadcast/unknown unicast, hence
+// several of them can be added for different remote VTEPs.
+type FdbEntry struct {
+	MAC net.HardwareAddr // destination MAC address
+	Dst net.IP           // remote VTEP IP address
+}
+
+// NeighEntry is a structure to describe neighbor (ARP/ND) entry, i.e.
+// static entry of the interface or the one which vxlan answers for by
+// proxy (see VxLan.Proxy).
+type NeighEntry struct {
+	IP  net.IP           // IPv4/v6 address
+	MAC net.HardwareAddr // MAC address of the IP address
+}
+
+// isZeroMAC returns true if given MAC address is all-zero.
+func isZeroMAC(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// neigh returns netlink neighbor of the fdb entry on given link.
+func (entry FdbEntry) neigh(link netlink.Link) *netlink.Neigh {
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       unix.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+		Flags:        netlink.NTF_SELF,
+		IP:           entry.Dst,
+		HardwareAddr: entry.MAC,
+	}
+}
+
+// neigh returns netlink neighbor of the neighbor entry on given link.
+func (entry NeighEntry) neigh(link netlink.Link) *netlink.Neigh {
+	family := netlink.FAMILY_V4
+	if entry.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       family,
+		State:        netlink.NUD_PERMANENT,
+		IP:           entry.IP,
+		HardwareAddr: entry.MAC,
+	}
+}
+
+// doVxLan runs fn with the vxlan link of veth in its namespace.
+func (veth *VEth) doVxLan(fn func(link netlink.Link) error) error {
+	var vethNs ns.NetNS
+	var err error
+
+	if veth.NsName == "" {
+		vethNs, err = ns.GetCurrentNS()
+	} else {
+		vethNs, err = ns.GetNS(veth.NsName)
+	}
+	if err != nil {
+		return err
+	}
+	defer vethNs.Close()
+
+	return vethNs.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(veth.LinkName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q in %q: %v",
+				veth.LinkName, veth.NsName, err)
+		}
+		if link.Type() != "vxlan" {
+			return fmt.Errorf("%s is not vxlan but %s",
+				veth.LinkName, link.Type())
+		}
+		return fn(link)
+	})
+}
+
+// AddFdbEntries adds given fdb entries to the vxlan of veth.
+// If it fails, entries added so far are removed.
+func (veth *VEth) AddFdbEntries(entries []FdbEntry) error {
+	return veth.doVxLan(func(link netlink.Link) error {
+		return withJournal(func(j *journal) (err error) {
+			for _, entry := range entries {
+				neigh := entry.neigh(link)
+				if isZeroMAC(entry.MAC) {
+					err = netlink.NeighAppend(neigh)
+				} else {
+					err = netlink.NeighAdd(neigh)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to add fdb %s dst %s: %v",
+						entry.MAC, entry.Dst, err)
+				}
+				j.push(fmt.Sprintf("delete fdb %s dst %s",
+					entry.MAC, entry.Dst), func() error {
+					return netlink.NeighDel(neigh)
+				})
+			}
+			return nil
+		})
+	})
+}
+
+// DelFdbEntries removes given fdb entries from the vxlan of veth.
+func (veth *VEth) DelFdbEntries(entries []FdbEntry) error {
+	return veth.doVxLan(func(link netlink.Link) error {
+		for _, entry := range entries {
+			if err := netlink.NeighDel(entry.neigh(link)); err != nil {
+				return fmt.Errorf("failed to delete fdb %s dst %s: %v",
+					entry.MAC, entry.Dst, err)
+			}
+		}
+		return nil
+	})
+}
+
+// AddNeighEntries adds given neighbor entries to the vxlan of veth.
+// If it fails, entries added so far are removed.
+func (veth *VEth) AddNeighEntries(entries []NeighEntry) error {
+	return veth.doVxLan(func(link netlink.Link) error {
+		return withJournal(func(j *journal) error {
+			for _, entry := range entries {
+				neigh := entry.neigh(link)
+				if err := netlink.NeighAdd(neigh); err != nil {
+					return fmt.Errorf("failed to add neighbor %s lladdr %s: %v",
+						entry.IP, entry.MAC, err)
+				}
+				j.push(fmt.Sprintf("delete neighbor %s", entry.IP),
+					func() error {
+						return netlink.NeighDel(neigh)
+					})
+			}
+			return nil
+		})
+	})
+}
+
+// DelNeighEntries removes given neighbor entries from the vxlan of veth.
+func (veth *VEth) DelNeighEntries(entries []NeighEntry) error {
+	return veth.doVxLan(func(link netlink.Link) error {
+		for _, entry := range entries {
+			if err := netlink.NeighDel(entry.neigh(link)); err != nil {
+				return fmt.Errorf("failed to delete neighbor %s: %v",
+					entry.IP, err)
+			}
+		}
+		return nil
+	})
+}
+
+// parseEntryPairs parses pairs of fields, which are separated by
+// whitespaces (one pair per line, '#' starts comment).
+func parseEntryPairs(data []byte) (pairs [][2]string, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 2:
+			pairs = append(pairs, [2]string{fields[0], fields[1]})
+		default:
+			return nil, fmt.Errorf("line %d: should be 2 fields: %q",
+				lineNo, line)
+		}
+	}
+	return pairs, scanner.Err()
+}
+
+// ParseFdbEntries parses fdb entries, '<MAC addr> <remote IP addr>' for
+// each line.
+func ParseFdbEntries(data []byte) (entries []FdbEntry, err error) {
+	pairs, err := parseEntryPairs(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		entry, err := NewFdbEntry(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// NewFdbEntry creates fdb entry from MAC address and remote IP address.
+func NewFdbEntry(mac, dst string) (entry FdbEntry, err error) {
+	if entry.MAC, err = net.ParseMAC(mac); err != nil {
+		return entry, fmt.Errorf("failed to parse MAC addr %s: %v", mac, err)
+	}
+	if entry.Dst = net.ParseIP(dst); entry.Dst == nil {
+		return entry, fmt.Errorf("failed to parse IP addr %s", dst)
+	}
+	return entry, nil
+}
+
+// ParseNeighEntries parses neighbor entries, '<IP addr> <MAC addr>' for
+// each line.
+func ParseNeighEntries(data []byte) (entries []NeighEntry, err error) {
+	pairs, err := parseEntryPairs(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		entry, err := NewNeighEntry(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// NewNeighEntry creates neighbor entry from IP address and MAC address.
+func NewNeighEntry(ip, mac string) (entry NeighEntry, err error) {
+	if entry.IP = net.ParseIP(ip); entry.IP == nil {
+		return entry, fmt.Errorf("failed to parse IP addr %s", ip)
+	}
+	if entry.MAC, err = net.ParseMAC(mac); err != nil {
+		return entry, fmt.Errorf("failed to parse MAC addr %s: %v", mac, err)
+	}
+	return entry, nil
+}
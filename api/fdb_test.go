@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseFdbEntries(t *testing.T) {
+	// test case1: entries with comments and empty lines
+	str1 := `# head-end replication
+00:00:00:00:00:00 10.1.1.2
+00:00:00:00:00:00 10.1.1.3
+
+02:00:00:00:00:01 2001:db8::1 # IPv6 VTEP
+`
+	entries1, err1 := ParseFdbEntries([]byte(str1))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if len(entries1) != 3 {
+		t.Fatalf("Parse error: %d entries, should be 3", len(entries1))
+	}
+	if !isZeroMAC(entries1[1].MAC) || !entries1[1].Dst.Equal(net.ParseIP("10.1.1.3")) {
+		t.Fatalf("Parse error: %v", entries1[1])
+	}
+	if isZeroMAC(entries1[2].MAC) || entries1[2].Dst.To4() != nil {
+		t.Fatalf("Parse error: %v", entries1[2])
+	}
+
+	// test case2: invalid entries
+	invalids := []string{
+		"00:00:00:00:00:00",
+		"00:00:00:00:00:00 10.1.1.2 10.1.1.3",
+		"10.1.1.2 00:00:00:00:00:00",
+	}
+	for _, str := range invalids {
+		if _, err2 := ParseFdbEntries([]byte(str)); err2 == nil {
+			t.Fatalf("Parse should fail with %q", str)
+		}
+	}
+}
+
+func TestParseNeighEntries(t *testing.T) {
+	entries, err := ParseNeighEntries([]byte("192.168.1.2 02:00:00:00:00:02\n"))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].MAC.String() != "02:00:00:00:00:02" {
+		t.Fatalf("Parse error: %v", entries)
+	}
+	if _, err = ParseNeighEntries([]byte("02:00:00:00:00:02 192.168.1.2")); err == nil {
+		t.Fatalf("Parse should fail with reversed entry")
+	}
+}
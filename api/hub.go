@@ -0,0 +1,413 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// Hub is a structure to describe linux bridge which connects several
+// containers to one L2 segment. Each member is connected by veth, whose
+// peer is attached to the bridge.
+type Hub struct {
+	Name   string // bridge name
+	NsName string // (optional) network namespace of the bridge
+}
+
+// MakeHub makes hub bridge (or uses existing one) and connects given
+// containers to it.
+// If it fails, every step done so far is rolled back.
+func MakeHub(hub Hub, members []VEth) error {
+	ports := []VEth{}
+	err := withJournal(func(j *journal) error {
+		if err := hub.setBridge(j); err != nil {
+			return err
+		}
+		for _, veth := range members {
+			port, err := hub.addMember(j, veth)
+			if err != nil {
+				return err
+			}
+			ports = append(ports, port)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, veth := range members {
+		hub.recordMember(veth, ports[i])
+	}
+	return nil
+}
+
+// AddMember connects given container to the hub, which needs to exist.
+// If it fails, every step done so far is rolled back.
+func (hub Hub) AddMember(veth VEth) error {
+	var port VEth
+	err := withJournal(func(j *journal) (err error) {
+		port, err = hub.addMember(j, veth)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	hub.recordMember(veth, port)
+	return nil
+}
+
+// RemoveMember disconnects given container from the hub.
+func (hub Hub) RemoveMember(veth VEth) error {
+	return veth.RemoveVethLink()
+}
+
+// RemoveHub disconnects the members of the hub recorded in StateDir and
+// removes the bridge if koko created it and no other port remains. Ports
+// which koko did not add (e.g. of docker0) are kept.
+func RemoveHub(hub Hub) error {
+	links, err := ListLinks()
+	if err != nil && StateDir != "" {
+		return err
+	}
+	for _, link := range links {
+		if link.Hub != nil && *link.Hub == hub {
+			if err = removeVeths(link.Endpoints); err != nil {
+				return err
+			}
+		}
+	}
+	return hub.removeBridge()
+}
+
+// removeBridge removes the bridge of the hub if koko created it and it has
+// no port, otherwise the bridge is kept.
+func (hub Hub) removeBridge() error {
+	created, err := hub.isCreated()
+	if err != nil {
+		return err
+	}
+	return hub.doBridge(func(br netlink.Link) error {
+		if !created {
+			logger.Infof("koko: keep hub %s, which koko did not create",
+				hub.Name)
+			return nil
+		}
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		ports := 0
+		for _, link := range links {
+			if link.Attrs().MasterIndex == br.Attrs().Index {
+				ports++
+			}
+		}
+		if ports != 0 {
+			logger.Infof("koko: keep hub %s, which has %d port(s)",
+				hub.Name, ports)
+			return nil
+		}
+		logger.Infof("koko: delete hub %s", hub.Name)
+		if err = netlink.LinkDel(br); err != nil {
+			return fmt.Errorf("failed to delete bridge %s: %v",
+				hub.Name, err)
+		}
+		return hub.forgetCreated()
+	})
+}
+
+// key returns the key of the hub in created hubs.
+func (hub Hub) key() string {
+	return fmt.Sprintf("%s:%s", hub.NsName, hub.Name)
+}
+
+// updateHubs loads hubs whose bridge koko created (hub key -> true) from
+// StateDir under file lock and calls fn with them. If fn returns true, the
+// hubs are written back.
+func updateHubs(fn func(created map[string]bool) bool) error {
+	if StateDir == "" {
+		return nil
+	}
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	created := map[string]bool{}
+	if err = readStateFile("hubs.json", &created); err != nil {
+		return err
+	}
+	if !fn(created) {
+		return nil
+	}
+	return writeStateFile("hubs.json", created)
+}
+
+// isCreated returns true if koko created the bridge of the hub, read from
+// StateDir under shared file lock.
+func (hub Hub) isCreated() (bool, error) {
+	if StateDir == "" {
+		return false, nil
+	}
+	unlock, err := rlockState()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	hubs := map[string]bool{}
+	if err = readStateFile("hubs.json", &hubs); err != nil {
+		return false, err
+	}
+	return hubs[hub.key()], nil
+}
+
+// recordCreated records that koko created the bridge of the hub. It is
+// undone by the journal.
+func (hub Hub) recordCreated(j *journal) error {
+	err := updateHubs(func(hubs map[string]bool) bool {
+		hubs[hub.key()] = true
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record hub %s: %v", hub.Name, err)
+	}
+	j.push(fmt.Sprintf("forget hub %s", hub.Name), hub.forgetCreated)
+	return nil
+}
+
+// forgetCreated removes the record that koko created the bridge of the hub.
+func (hub Hub) forgetCreated() error {
+	return updateHubs(func(hubs map[string]bool) bool {
+		if !hubs[hub.key()] {
+			return false
+		}
+		delete(hubs, hub.key())
+		return true
+	})
+}
+
+// doBridge runs fn with the bridge of the hub in its namespace.
+func (hub Hub) doBridge(fn func(br netlink.Link) error) error {
+	var hubNs ns.NetNS
+	var err error
+
+	if hub.NsName == "" {
+		hubNs, err = ns.GetCurrentNS()
+	} else {
+		hubNs, err = ns.GetNS(hub.NsName)
+	}
+	if err != nil {
+		return err
+	}
+	defer hubNs.Close()
+
+	return hubNs.Do(func(_ ns.NetNS) error {
+		br, err := hub.getBridge()
+		if err != nil {
+			return err
+		}
+		return fn(br)
+	})
+}
+
+// getBridge returns the bridge of the hub in current namespace.
+func (hub Hub) getBridge() (netlink.Link, error) {
+	br, err := netlink.LinkByName(hub.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q in %q: %v",
+			hub.Name, hub.NsName, err)
+	}
+	if br.Type() != "bridge" {
+		return nil, fmt.Errorf("%s is not bridge but %s",
+			hub.Name, br.Type())
+	}
+	return br, nil
+}
+
+// setBridge creates the bridge of the hub if it does not exist.
+func (hub Hub) setBridge(j *journal) error {
+	hubNs, err := j.openNS(hub.NsName)
+	if err != nil {
+		return err
+	}
+
+	return hubNs.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(hub.Name); err == nil {
+			_, err = hub.getBridge()
+			return err
+		}
+
+		logger.Infof("koko: create hub %s", hub.Name)
+		br := &netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: hub.Name,
+			},
+		}
+		if err := netlink.LinkAdd(br); err != nil {
+			return fmt.Errorf("failed to create bridge %s: %v",
+				hub.Name, err)
+		}
+		j.push(fmt.Sprintf("delete bridge %s", hub.Name), func() error {
+			return netlink.LinkDel(br)
+		})
+		if err := hub.recordCreated(j); err != nil {
+			return err
+		}
+
+		if err := netlink.LinkSetUp(br); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", hub.Name, err)
+		}
+		return nil
+	})
+}
+
+// addMember connects given container to the hub by veth and returns its
+// peer, attached to the bridge.
+func (hub Hub) addMember(j *journal, veth VEth) (port VEth, err error) {
+	logger.Infof("koko: add %s to hub %s", veth.LinkName, hub.Name)
+	tempLinkName := getRandomIFName()
+	port = VEth{
+		NsName:   hub.NsName,
+		LinkName: getRandomIFName(),
+		MTU:      veth.MTU,
+	}
+	mtu, err := vethPairMTU(veth, port)
+	if err != nil {
+		return port, err
+	}
+
+	link1, link2, err := getVethPair(tempLinkName, port.LinkName, mtu)
+	if err != nil {
+		return port, err
+	}
+	j.push(fmt.Sprintf("delete veth %s", tempLinkName), func() error {
+		return deleteLinkByName(tempLinkName)
+	})
+
+	if err = port.setVethLink(j, link2); err != nil {
+		return port, err
+	}
+	hubNs, err := j.openNS(hub.NsName)
+	if err != nil {
+		return port, err
+	}
+	err = hubNs.Do(func(_ ns.NetNS) error {
+		br, err := hub.getBridge()
+		if err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(port.LinkName)
+		if err != nil {
+			return err
+		}
+		if err = netlink.LinkSetMaster(link, br); err != nil {
+			return fmt.Errorf("failed to attach %s to %s: %v",
+				port.LinkName, hub.Name, err)
+		}
+		j.push(fmt.Sprintf("detach %s from %s", port.LinkName, hub.Name),
+			func() error {
+				return netlink.LinkSetNoMaster(link)
+			})
+		return setPortVlan(j, br, link, veth)
+	})
+	if err != nil {
+		return port, err
+	}
+
+	if err = veth.setVethLink(j, link1); err != nil {
+		return port, err
+	}
+	return port, veth.waitDAD(j)
+}
+
+// checkNoPortVlan returns error if VLANs of hub port are given to the link
+// which is not a hub member, instead of ignoring them.
+func checkNoPortVlan(veths ...VEth) error {
+	for _, veth := range veths {
+		if veth.AccessVlan != 0 || len(veth.TrunkVlans) != 0 {
+			return fmt.Errorf("%s: vlan/trunk is only for hub member",
+				veth.LinkName)
+		}
+	}
+	return nil
+}
+
+// validatePortVlan checks VLAN IDs of access/trunk port. accessVlan 0
+// means no access VLAN.
+func validatePortVlan(accessVlan int, trunkVlans []int) error {
+	if accessVlan < 0 || accessVlan > 4094 {
+		return fmt.Errorf("invalid VLAN ID %d", accessVlan)
+	}
+	for _, vid := range trunkVlans {
+		if vid < 1 || vid > 4094 {
+			return fmt.Errorf("invalid VLAN ID %d", vid)
+		}
+	}
+	return nil
+}
+
+// setPortVlan configures the hub port as access/trunk port of VLANs given
+// in veth, with enabling vlan_filtering of the bridge. Default VLAN (1) of
+// the port is removed unless it is given explicitly. VLAN entries are not
+// registered to journal because they are removed with the port.
+func setPortVlan(j *journal, br, port netlink.Link, veth VEth) error {
+	if veth.AccessVlan == 0 && len(veth.TrunkVlans) == 0 {
+		return nil
+	}
+	if err := validatePortVlan(veth.AccessVlan, veth.TrunkVlans); err != nil {
+		return err
+	}
+
+	if filtering := br.(*netlink.Bridge).VlanFiltering; filtering == nil || !*filtering {
+		logger.Infof("koko: enable vlan_filtering of %s", br.Attrs().Name)
+		if err := netlink.BridgeSetVlanFiltering(br, true); err != nil {
+			return fmt.Errorf("failed to enable vlan_filtering of %s: %v",
+				br.Attrs().Name, err)
+		}
+		j.push(fmt.Sprintf("disable vlan_filtering of %s", br.Attrs().Name),
+			func() error {
+				return netlink.BridgeSetVlanFiltering(br, false)
+			})
+	}
+
+	keepDefault := veth.AccessVlan == 1
+	if veth.AccessVlan != 0 {
+		err := netlink.BridgeVlanAdd(port, uint16(veth.AccessVlan),
+			true, true, false, true)
+		if err != nil {
+			return fmt.Errorf("failed to add VLAN %d to %s: %v",
+				veth.AccessVlan, port.Attrs().Name, err)
+		}
+	}
+	for _, vid := range veth.TrunkVlans {
+		err := netlink.BridgeVlanAdd(port, uint16(vid), false, false,
+			false, true)
+		if err != nil {
+			return fmt.Errorf("failed to add VLAN %d to %s: %v",
+				vid, port.Attrs().Name, err)
+		}
+		keepDefault = keepDefault || vid == 1
+	}
+	if !keepDefault {
+		err := netlink.BridgeVlanDel(port, 1, false, false, false, true)
+		if err != nil {
+			return fmt.Errorf("failed to delete VLAN 1 from %s: %v",
+				port.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// recordMember records the member of the hub with its port.
+func (hub Hub) recordMember(veth, port VEth) {
+	recordLink(LinkRecord{
+		Type:      "hub",
+		Endpoints: []VEth{veth, port},
+		Hub:       &hub,
+	})
+}
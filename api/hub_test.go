@@ -0,0 +1,203 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestHub(t *testing.T) {
+	StateDir = t.TempDir()
+	defer func() { StateDir = "" }()
+
+	hubNs := newTestNS(t)
+	memberNs := newTestNS(t)
+	hub := Hub{Name: "br0", NsName: hubNs.Path()}
+	member := func(name string) VEth {
+		return VEth{NsName: memberNs.Path(), LinkName: name}
+	}
+	// numPorts returns the number of ports of the bridge, or -1 if the
+	// bridge does not exist.
+	numPorts := func() (n int) {
+		err := hubNs.Do(func(_ ns.NetNS) error {
+			br, err := netlink.LinkByName(hub.Name)
+			if err != nil {
+				n = -1
+				return nil
+			}
+			links, err := netlink.LinkList()
+			if err != nil {
+				return err
+			}
+			for _, link := range links {
+				if link.Attrs().MasterIndex == br.Attrs().Index {
+					n++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("netns error: %v", err)
+		}
+		return n
+	}
+	numRecords := func() int {
+		links, err := ListLinks()
+		if err != nil {
+			t.Fatalf("ListLinks error: %v", err)
+		}
+		return len(links)
+	}
+
+	// test case1: hub which does not exist
+	if err := hub.AddMember(member("eth1")); err == nil {
+		t.Fatalf("case1: AddMember should fail")
+	}
+	if n := numRecords(); n != 0 {
+		t.Fatalf("case1: %d records", n)
+	}
+	if err := RemoveHub(hub); err == nil {
+		t.Fatalf("case1: RemoveHub should fail")
+	}
+
+	// test case2: hub with two members
+	if err := MakeHub(hub, []VEth{member("eth1"), member("eth2")}); err != nil {
+		t.Skipf("failed to make hub: %v", err)
+	}
+	if n, m := numPorts(), numRecords(); n != 2 || m != 2 {
+		t.Fatalf("case2: %d ports, %d records", n, m)
+	}
+	record, err := findLink(memberNs.Path(), "eth1")
+	if err != nil || record == nil || record.Type != "hub" ||
+		record.Hub == nil || *record.Hub != hub || len(record.Endpoints) != 2 {
+		t.Fatalf("case2: record %+v, err %v", record, err)
+	}
+
+	// test case3: member which exists is rolled back
+	if err := MakeHub(hub, []VEth{member("eth3"), member("eth1")}); err == nil {
+		t.Fatalf("case3: MakeHub should fail")
+	}
+	if n, m := numPorts(), numRecords(); n != 2 || m != 2 {
+		t.Fatalf("case3: %d ports, %d records", n, m)
+	}
+
+	// test case4: invalid VLAN is rolled back
+	veth := member("eth3")
+	veth.AccessVlan = 4095
+	if err := hub.AddMember(veth); err == nil {
+		t.Fatalf("case4: AddMember should fail")
+	}
+	if n, m := numPorts(), numRecords(); n != 2 || m != 2 {
+		t.Fatalf("case4: %d ports, %d records", n, m)
+	}
+
+	// test case5: removing the last member keeps the bridge
+	for _, name := range []string{"eth1", "eth2"} {
+		veth := member(name)
+		if err := hub.RemoveMember(veth); err != nil {
+			t.Fatalf("case5: RemoveMember error: %v", err)
+		}
+	}
+	if n, m := numPorts(), numRecords(); n != 0 || m != 0 {
+		t.Fatalf("case5: %d ports, %d records", n, m)
+	}
+
+	// test case6: member which is already removed
+	veth = member("eth1")
+	if err := hub.RemoveMember(veth); err == nil {
+		t.Fatalf("case6: RemoveMember should fail")
+	}
+
+	// addForeignPort attaches veth which koko did not add to the bridge.
+	addForeignPort := func(name string) {
+		err := hubNs.Do(func(_ ns.NetNS) error {
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: name},
+				PeerName:  name + "-peer",
+			})
+			if err != nil {
+				return err
+			}
+			br, err := netlink.LinkByName(hub.Name)
+			if err != nil {
+				return err
+			}
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			return netlink.LinkSetMaster(link, br)
+		})
+		if err != nil {
+			t.Fatalf("failed to add foreign port: %v", err)
+		}
+	}
+
+	// test case7: bridge created by koko is kept while others' port remains
+	if err := hub.AddMember(member("eth1")); err != nil {
+		t.Fatalf("case7: AddMember error: %v", err)
+	}
+	addForeignPort("other0")
+	if err := RemoveHub(hub); err != nil {
+		t.Fatalf("case7: RemoveHub error: %v", err)
+	}
+	if n, m := numPorts(), numRecords(); n != 1 || m != 0 {
+		t.Fatalf("case7: %d ports, %d records", n, m)
+	}
+	err = hubNs.Do(func(_ ns.NetNS) error {
+		return deleteLinkByName("other0")
+	})
+	if err != nil {
+		t.Fatalf("case7: failed to delete foreign port: %v", err)
+	}
+
+	// test case8: RemoveHub removes the bridge which koko created
+	if err := RemoveHub(hub); err != nil {
+		t.Fatalf("case8: RemoveHub error: %v", err)
+	}
+	if n := numPorts(); n != -1 {
+		t.Fatalf("case8: %d ports", n)
+	}
+
+	// test case9: bridge which koko did not create (e.g. docker0) and its
+	// ports which koko did not add are kept
+	err = hubNs.Do(func(_ ns.NetNS) error {
+		return netlink.LinkAdd(&netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{Name: hub.Name},
+		})
+	})
+	if err != nil {
+		t.Fatalf("case9: failed to add bridge: %v", err)
+	}
+	addForeignPort("other1")
+	if err := MakeHub(hub, []VEth{member("eth1")}); err != nil {
+		t.Fatalf("case9: MakeHub error: %v", err)
+	}
+	if err := RemoveHub(hub); err != nil {
+		t.Fatalf("case9: RemoveHub error: %v", err)
+	}
+	if n, m := numPorts(), numRecords(); n != 1 || m != 0 {
+		t.Fatalf("case9: %d ports, %d records", n, m)
+	}
+}
+
+func TestCheckNoPortVlan(t *testing.T) {
+	// test case1: VLANs of hub port are not ignored by other links
+	access := VEth{LinkName: "link1", AccessVlan: 10}
+	trunk := VEth{LinkName: "link2", TrunkVlans: []int{10, 20}}
+	if err := MakeVeth(VEth{LinkName: "link0"}, access); err == nil {
+		t.Fatalf("case1: MakeVeth should fail")
+	}
+	if err := MakeVxLan(trunk, VxLan{}); err == nil {
+		t.Fatalf("case1: MakeVxLan should fail")
+	}
+	if _, err := MakeMacVTap(access, MacVTap{}); err == nil {
+		t.Fatalf("case1: MakeMacVTap should fail")
+	}
+
+	// test case2: link without VLANs
+	if err := checkNoPortVlan(VEth{LinkName: "link0"}); err != nil {
+		t.Fatalf("case2: checkNoPortVlan error: %v", err)
+	}
+}
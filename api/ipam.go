@@ -0,0 +1,213 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// IPAMState is a structure to describe pools of IPAM, which allocates
+// point-to-point addresses (/31 for IPv4, /127 for IPv6) to veth pairs,
+// and the allocations. It is kept in StateDir.
+type IPAMState struct {
+	Pools       []string          `json:"pools"`       // pools in CIDR notation
+	Allocations map[string]string `json:"allocations"` // allocated subnet -> owner interface
+}
+
+// ipamOwner returns owner key of IPAM allocations for veth pair.
+func ipamOwner(veth VEth) string {
+	return fmt.Sprintf("%s:%s", veth.NsName, veth.LinkName)
+}
+
+// updateIPAM loads IPAM state from StateDir under file lock and calls fn
+// with it. If fn returns true, the state is written back.
+func updateIPAM(fn func(state *IPAMState) bool) error {
+	if StateDir == "" {
+		return fmt.Errorf("state directory is not set")
+	}
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state := IPAMState{}
+	if err = readStateFile("ipam.json", &state); err != nil {
+		return err
+	}
+	if state.Allocations == nil {
+		state.Allocations = map[string]string{}
+	}
+
+	if !fn(&state) {
+		return nil
+	}
+	return writeStateFile("ipam.json", state)
+}
+
+// GetIPAMState returns IPAM pools and allocations, read from StateDir
+// under shared file lock. Missing StateDir or state file is treated as no
+// pool and no allocation.
+func GetIPAMState() (state IPAMState, err error) {
+	if StateDir == "" {
+		return state, fmt.Errorf("state directory is not set")
+	}
+	unlock, err := rlockState()
+	if err != nil {
+		return state, err
+	}
+	defer unlock()
+
+	if err = readStateFile("ipam.json", &state); err != nil {
+		return state, err
+	}
+	if state.Allocations == nil {
+		state.Allocations = map[string]string{}
+	}
+	return state, nil
+}
+
+// SetIPAMPools replaces IPAM pools with given ones. Existing allocations
+// are kept.
+func SetIPAMPools(pools []string) error {
+	for _, pool := range pools {
+		if _, err := parsePool(pool); err != nil {
+			return err
+		}
+	}
+	return updateIPAM(func(state *IPAMState) bool {
+		state.Pools = pools
+		return true
+	})
+}
+
+// parsePool parses IPAM pool in CIDR notation.
+func parsePool(pool string) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pool %s: %v", pool, err)
+	}
+	ones, bits := ipnet.Mask.Size()
+	if ones > bits-1 {
+		return nil, fmt.Errorf("pool %s is too small", pool)
+	}
+	return ipnet, nil
+}
+
+// nthPair returns n-th point-to-point subnet in given pool, or nil if it
+// is out of the pool.
+func nthPair(pool *net.IPNet, n uint64) *net.IPNet {
+	ip := make(net.IP, len(pool.IP))
+	copy(ip, pool.IP)
+	carry := n * 2
+	for i := len(ip) - 1; i >= 0 && carry != 0; i-- {
+		sum := uint64(ip[i]) + carry&0xff
+		ip[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	if carry != 0 || !pool.Contains(ip) {
+		return nil
+	}
+	bits := len(ip) * 8
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits-1, bits)}
+}
+
+// allocateAddrs allocates a point-to-point subnet from the first pool
+// which has free one, for each address family, and returns them.
+func allocateAddrs(owner string) (subnets []*net.IPNet, err error) {
+	var allocErr error
+	err = updateIPAM(func(state *IPAMState) bool {
+		if len(state.Pools) == 0 {
+			allocErr = fmt.Errorf("no IPAM pool is configured")
+			return false
+		}
+		done := map[int]bool{}
+		for _, p := range state.Pools {
+			pool, err := parsePool(p)
+			if err != nil {
+				continue
+			}
+			if done[len(pool.IP)] {
+				continue
+			}
+			for n := uint64(0); ; n++ {
+				subnet := nthPair(pool, n)
+				if subnet == nil {
+					break
+				}
+				if _, ok := state.Allocations[subnet.String()]; !ok {
+					state.Allocations[subnet.String()] = owner
+					subnets = append(subnets, subnet)
+					done[len(pool.IP)] = true
+					break
+				}
+			}
+		}
+		if len(subnets) == 0 {
+			allocErr = fmt.Errorf("IPAM pools are exhausted")
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subnets, allocErr
+}
+
+// releaseAddrs releases subnets allocated for given owner.
+func releaseAddrs(owner string) error {
+	return updateIPAM(func(state *IPAMState) bool {
+		released := false
+		for subnet, o := range state.Allocations {
+			if o == owner {
+				delete(state.Allocations, subnet)
+				released = true
+			}
+		}
+		return released
+	})
+}
+
+// releaseSubnets releases given subnets.
+func releaseSubnets(subnets []*net.IPNet) error {
+	return updateIPAM(func(state *IPAMState) bool {
+		for _, subnet := range subnets {
+			delete(state.Allocations, subnet.String())
+		}
+		return true
+	})
+}
+
+// setAutoAddrs allocates point-to-point subnets for veth pair and adds
+// their first address to veth1 and second one to veth2.
+func setAutoAddrs(j *journal, veth1, veth2 *VEth) error {
+	owner := ipamOwner(*veth1)
+	subnets, err := allocateAddrs(owner)
+	if err != nil {
+		return fmt.Errorf("failed to allocate addresses: %v", err)
+	}
+	j.push(fmt.Sprintf("release addresses of %s", owner), func() error {
+		return releaseSubnets(subnets)
+	})
+
+	for _, subnet := range subnets {
+		peer := make(net.IP, len(subnet.IP))
+		copy(peer, subnet.IP)
+		peer[len(peer)-1]++
+		veth1.IPAddr = append(veth1.IPAddr, net.IPNet{IP: subnet.IP, Mask: subnet.Mask})
+		veth2.IPAddr = append(veth2.IPAddr, net.IPNet{IP: peer, Mask: subnet.Mask})
+		logger.Infof("koko: allocate %s to %s", subnet, owner)
+	}
+	return nil
+}
+
+// SortedAllocations returns allocated subnets in sorted order.
+func (state *IPAMState) SortedAllocations() []string {
+	subnets := []string{}
+	for subnet := range state.Allocations {
+		subnets = append(subnets, subnet)
+	}
+	sort.Strings(subnets)
+	return subnets
+}
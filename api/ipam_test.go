@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPAM(t *testing.T) {
+	StateDir = t.TempDir()
+	defer func() { StateDir = "" }()
+
+	// test case1: no pool
+	if _, err := allocateAddrs("ns1:link1"); err == nil {
+		t.Fatalf("allocateAddrs should fail without pool")
+	}
+
+	// test case2: allocate from IPv4/v6 pools
+	if err := SetIPAMPools([]string{"10.255.0.0/30", "fd00::/64"}); err != nil {
+		t.Fatalf("SetIPAMPools error: %v", err)
+	}
+	veth1, veth2 := VEth{LinkName: "link1"}, VEth{LinkName: "link2"}
+	if err := withJournal(func(j *journal) error {
+		return setAutoAddrs(j, &veth1, &veth2)
+	}); err != nil {
+		t.Fatalf("setAutoAddrs error: %v", err)
+	}
+	if len(veth1.IPAddr) != 2 || veth1.IPAddr[0].String() != "10.255.0.0/31" ||
+		veth2.IPAddr[0].String() != "10.255.0.1/31" ||
+		veth2.IPAddr[1].String() != "fd00::1/127" {
+		t.Fatalf("setAutoAddrs error: %v %v", veth1.IPAddr, veth2.IPAddr)
+	}
+
+	subnets, err := allocateAddrs("ns1:link3")
+	if err != nil {
+		t.Fatalf("allocateAddrs error: %v", err)
+	}
+	if len(subnets) != 2 || subnets[0].String() != "10.255.0.2/31" ||
+		subnets[1].String() != "fd00::2/127" {
+		t.Fatalf("allocateAddrs error: %v", subnets)
+	}
+
+	// test case3: IPv4 pool is exhausted, then released
+	if subnets, _ = allocateAddrs("ns1:link4"); len(subnets) != 1 {
+		t.Fatalf("allocateAddrs error: %v", subnets)
+	}
+	if err = releaseAddrs(ipamOwner(veth1)); err != nil {
+		t.Fatalf("releaseAddrs error: %v", err)
+	}
+	state, _ := GetIPAMState()
+	if len(state.Allocations) != 3 || state.SortedAllocations()[0] != "10.255.0.2/31" {
+		t.Fatalf("releaseAddrs error: %v", state.Allocations)
+	}
+
+	// test case4: invalid pools
+	for _, pool := range []string{"10.0.0.1/32", "10.0.0.0"} {
+		if err = SetIPAMPools([]string{pool}); err == nil {
+			t.Fatalf("SetIPAMPools should fail with %s", pool)
+		}
+	}
+}
+
+func TestNthPair(t *testing.T) {
+	_, pool, _ := net.ParseCIDR("10.0.0.0/23")
+	if subnet := nthPair(pool, 200); subnet.String() != "10.0.1.144/31" {
+		t.Fatalf("nthPair error: %v", subnet)
+	}
+	if subnet := nthPair(pool, 256); subnet != nil {
+		t.Fatalf("nthPair error: %v should be out of pool", subnet)
+	}
+}
+
+func TestGetIPAMState(t *testing.T) {
+	StateDir = filepath.Join(t.TempDir(), "koko")
+	defer func() { StateDir = "" }()
+
+	// test case1: missing StateDir is no pool, and it is not created
+	state, err := GetIPAMState()
+	if err != nil || len(state.Pools) != 0 || len(state.Allocations) != 0 {
+		t.Fatalf("GetIPAMState error: %+v %v", state, err)
+	}
+	if _, err = os.Stat(StateDir); !os.IsNotExist(err) {
+		t.Fatalf("%s should not be created: %v", StateDir, err)
+	}
+
+	// test case2: reading does not block other readers
+	if err = SetIPAMPools([]string{"10.255.0.0/30"}); err != nil {
+		t.Fatalf("SetIPAMPools error: %v", err)
+	}
+	unlock, err := rlockState()
+	if err != nil {
+		t.Fatalf("rlockState error: %v", err)
+	}
+	defer unlock()
+	if state, err = GetIPAMState(); err != nil || len(state.Pools) != 1 {
+		t.Fatalf("GetIPAMState error: %+v %v", state, err)
+	}
+}
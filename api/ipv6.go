@@ -0,0 +1,175 @@
+package api
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// IPv6Settings is a structure to describe IPv6 settings of veth, which are
+// applied before the interface is up.
+type IPv6Settings struct {
+	AddrGenMode string `yaml:"addr-gen-mode"` // (optional) eui64, none, stable-privacy or random
+	AcceptDAD   *int   `yaml:"accept-dad"`    // (optional) accept_dad sysctl (0: DAD disabled)
+	AcceptRA    *int   `yaml:"accept-ra"`     // (optional) accept_ra sysctl (0: RA ignored)
+	WaitDAD     bool   `yaml:"wait-dad"`      // (optional) wait until DAD of addresses finishes
+
+	StableSecret string `yaml:"-"` // (optional) stable_secret of stable-privacy mode (see GenerateStableSecret)
+}
+
+// addrGenModes is the map from IPv6 address generation mode to the value of
+// addr_gen_mode sysctl.
+var addrGenModes = map[string]string{
+	"eui64":          "0",
+	"none":           "1",
+	"stable-privacy": "2",
+	"random":         "3",
+}
+
+// dadTimeout is the time to wait for DAD.
+const dadTimeout = 10 * time.Second
+
+// Validate checks IPv6 settings.
+func (settings *IPv6Settings) Validate() error {
+	if _, ok := addrGenModes[settings.AddrGenMode]; !ok && settings.AddrGenMode != "" {
+		return fmt.Errorf("unknown addr_gen_mode %q", settings.AddrGenMode)
+	}
+	if settings.AcceptDAD != nil && (*settings.AcceptDAD < 0 || *settings.AcceptDAD > 2) {
+		return fmt.Errorf("invalid accept_dad %d", *settings.AcceptDAD)
+	}
+	if settings.AcceptRA != nil && (*settings.AcceptRA < 0 || *settings.AcceptRA > 2) {
+		return fmt.Errorf("invalid accept_ra %d", *settings.AcceptRA)
+	}
+	if settings.StableSecret != "" {
+		if ip := net.ParseIP(settings.StableSecret); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid stable_secret %q", settings.StableSecret)
+		}
+	}
+	return nil
+}
+
+// GenerateStableSecret derives stable_secret of stable-privacy mode from
+// endpoint key (see EndpointKey) and link name, hence the same interface
+// gets the same IPv6 addresses when it is re-created.
+func GenerateStableSecret(endpointKey, linkName string) string {
+	sum := sha256.Sum256([]byte(endpointKey + "\x00stable_secret\x00" + linkName))
+	return net.IP(sum[:16]).String()
+}
+
+// setStableSecret sets stable_secret sysctl to value unless it is set.
+// Reading stable_secret fails until it is set, and the kernel cannot unset
+// it again, so the journal entry only notes that rollback leaves it, which
+// is unused after addr_gen_mode is restored.
+func setStableSecret(j *journal, name, value string) error {
+	if _, err := sysctl.Sysctl(name); err == nil {
+		return nil
+	}
+	if _, err := sysctl.Sysctl(name, value); err != nil {
+		return err
+	}
+	j.push(fmt.Sprintf("leave %s (kernel cannot unset it)", name), func() error {
+		return nil
+	})
+	return nil
+}
+
+// setIPv6 enables IPv6 of veth and applies its IPv6 settings, in current
+// namespace.
+func (veth *VEth) setIPv6(j *journal) error {
+	if veth.IPv6 == nil {
+		return nil
+	}
+	settings := veth.IPv6
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	if err := veth.enableIPv6(j); err != nil {
+		return err
+	}
+
+	prefix := sysctlName("net.ipv6.conf.{link}.", veth.LinkName)
+	if settings.AddrGenMode == "stable-privacy" {
+		// namespace path is used if endpoint key is not given
+		secret := settings.StableSecret
+		if secret == "" {
+			secret = GenerateStableSecret(veth.NsName, veth.LinkName)
+		}
+		if err := setStableSecret(j, prefix+"stable_secret", secret); err != nil {
+			return fmt.Errorf("failed to set stable_secret at %s: %v",
+				veth.LinkName, err)
+		}
+	}
+	if settings.AddrGenMode != "" {
+		err := setSysctl(j, prefix+"addr_gen_mode", addrGenModes[settings.AddrGenMode])
+		if err != nil {
+			return fmt.Errorf("failed to set addr_gen_mode to %s at %s: %v",
+				settings.AddrGenMode, veth.LinkName, err)
+		}
+	}
+	if settings.AcceptDAD != nil {
+		err := setSysctl(j, prefix+"accept_dad", fmt.Sprint(*settings.AcceptDAD))
+		if err != nil {
+			return fmt.Errorf("failed to set accept_dad at %s: %v",
+				veth.LinkName, err)
+		}
+	}
+	if settings.AcceptRA != nil {
+		err := setSysctl(j, prefix+"accept_ra", fmt.Sprint(*settings.AcceptRA))
+		if err != nil {
+			return fmt.Errorf("failed to set accept_ra at %s: %v",
+				veth.LinkName, err)
+		}
+	}
+	return nil
+}
+
+// waitDAD waits until IPv6 addresses of veth are not tentative if WaitDAD
+// is set. It needs to be called after both ends of the link are up,
+// otherwise DAD does not start.
+func (veth *VEth) waitDAD(j *journal) error {
+	if veth.IPv6 == nil || !veth.IPv6.WaitDAD {
+		return nil
+	}
+	vethNs, err := j.openNS(veth.NsName)
+	if err != nil {
+		return err
+	}
+
+	return vethNs.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(veth.LinkName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q in %q: %v",
+				veth.LinkName, veth.NsName, err)
+		}
+		logger.Infof("koko: wait for DAD of %s", veth.LinkName)
+		for deadline := time.Now().Add(dadTimeout); ; {
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+			if err != nil {
+				return fmt.Errorf("failed to get addresses of %s: %v",
+					veth.LinkName, err)
+			}
+			tentative := false
+			for _, addr := range addrs {
+				if addr.Flags&unix.IFA_F_DADFAILED != 0 {
+					return fmt.Errorf("DAD of %s failed at %s",
+						addr.IPNet, veth.LinkName)
+				}
+				tentative = tentative || addr.Flags&unix.IFA_F_TENTATIVE != 0
+			}
+			if !tentative {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("DAD of %s did not finish in %v",
+					veth.LinkName, dadTimeout)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// journal is an undo-journal for multi-step link configuration. Each step
+// registers its compensating action and if a later step fails, rollback
+// runs them in reverse order to restore the state before the operation.
+type journal struct {
+	actions []undoAction
+	netns   []ns.NetNS // namespace handles kept open until release
+}
+
+// undoAction is a compensating action of a step. It runs in the network
+// namespace where the step was done.
+type undoAction struct {
+	desc  string
+	netns ns.NetNS
+	undo  func() error
+}
+
+// newJournal creates empty journal.
+func newJournal() *journal {
+	return &journal{}
+}
+
+// openNS opens given network namespace (current one if nsName is empty)
+// and keeps it open until the journal is released.
+func (j *journal) openNS(nsName string) (netns ns.NetNS, err error) {
+	if nsName == "" {
+		netns, err = ns.GetCurrentNS()
+	} else {
+		netns, err = ns.GetNS(nsName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	j.netns = append(j.netns, netns)
+	return netns, nil
+}
+
+// push registers compensating action of the step just done in current
+// network namespace.
+func (j *journal) push(desc string, undo func() error) {
+	netns, err := j.openNS("")
+	if err != nil {
+		logger.Warnf("koko: failed to get current netns for %q: %v",
+			desc, err)
+	}
+	j.pushNS(netns, desc, undo)
+}
+
+// pushNS registers compensating action which runs in given network
+// namespace, opened by openNS.
+func (j *journal) pushNS(netns ns.NetNS, desc string, undo func() error) {
+	j.actions = append(j.actions, undoAction{
+		desc:  desc,
+		netns: netns,
+		undo:  undo,
+	})
+}
+
+// rollback runs all compensating actions in reverse order and releases
+// the journal. It continues even if some of them fail.
+func (j *journal) rollback() {
+	for i := len(j.actions) - 1; i >= 0; i-- {
+		action := j.actions[i]
+		logger.Infof("koko: rollback: %s", action.desc)
+
+		var err error
+		if action.netns != nil {
+			err = action.netns.Do(func(_ ns.NetNS) error {
+				return action.undo()
+			})
+		} else {
+			err = action.undo()
+		}
+		if err != nil {
+			logger.Errorf("koko: failed to rollback %q: %v",
+				action.desc, err)
+		}
+	}
+	j.release()
+}
+
+// release releases the journal without rollback, i.e. the operation is
+// completed.
+func (j *journal) release() {
+	for _, netns := range j.netns {
+		netns.Close()
+	}
+	j.actions = nil
+	j.netns = nil
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	// test case1: rollback runs undo actions in reverse order
+	done := []int{}
+	err := withJournal(func(j *journal) error {
+		for i := 0; i < 3; i++ {
+			step := i
+			j.pushNS(nil, fmt.Sprintf("step %d", step), func() error {
+				done = append(done, step)
+				return nil
+			})
+		}
+		return fmt.Errorf("step 3 failed")
+	})
+	if err == nil {
+		t.Fatalf("withJournal should return error")
+	}
+	if len(done) != 3 || done[0] != 2 || done[2] != 0 {
+		t.Fatalf("rollback order %v should be [2 1 0]", done)
+	}
+
+	// test case2: rollback continues even if undo action fails
+	done = []int{}
+	withJournal(func(j *journal) error {
+		j.pushNS(nil, "step 0", func() error {
+			done = append(done, 0)
+			return nil
+		})
+		j.pushNS(nil, "step 1", func() error {
+			return fmt.Errorf("undo failed")
+		})
+		return fmt.Errorf("step 2 failed")
+	})
+	if len(done) != 1 {
+		t.Fatalf("rollback should continue after failure: %v", done)
+	}
+
+	// test case3: no rollback if operation succeeds
+	done = []int{}
+	err = withJournal(func(j *journal) error {
+		j.pushNS(nil, "step 0", func() error {
+			done = append(done, 0)
+			return nil
+		})
+		return nil
+	})
+	if err != nil || len(done) != 0 {
+		t.Fatalf("withJournal should not rollback: %v %v", err, done)
+	}
+}
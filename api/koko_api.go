@@ -4,11 +4,12 @@ Package api provides koko's connector funcitionlity as API.
 package api
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
-	"syscall"
+	"strings"
 	"time"
 
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -36,20 +37,72 @@ func SetLogLevel(level string) error {
 
 // VEth is a structure to descrive veth interfaces.
 type VEth struct {
-	NsName        string      // What's the network namespace?
-	LinkName      string      // And what will we call the link.
-	IPAddr        []net.IPNet // (optional) Slice of IPv4/v6 address.
-	MirrorEgress  string      // (optional) source interface for egress mirror
-	MirrorIngress string      // (optional) source interface for ingress mirror
+	NsName        string            // What's the network namespace?
+	LinkName      string            // And what will we call the link.
+	IPAddr        []net.IPNet       // (optional) Slice of IPv4/v6 address.
+	AutoAddr      bool              // (optional) allocate point-to-point addresses by IPAM (veth only)
+	HardwareAddr  net.HardwareAddr  // (optional) MAC address
+	MTU           int               // (optional) MTU (0: 1500 for veth, derived from parent otherwise)
+	Routes        []Route           // (optional) static routes via the interface
+	VRF           *VRF              // (optional) VRF which the interface is enslaved to
+	Rules         []Rule            // (optional) policy routing rules in the namespace
+	Neighbors     []NeighEntry      // (optional) static neighbor (ARP/ND) entries
+	IPv6          *IPv6Settings     // (optional) IPv6 settings of the interface
+	Sysctls       map[string]string // (optional) sysctl settings (see SysctlLinkName)
+	Netem         *Netem            // (optional) impairment by netem qdisc at egress
+	Shaping       *Shaping          // (optional) bandwidth shaping (egress) and policing (ingress)
+	PeerNeighbors bool              // (optional) add neighbor entries of the peer (veth only)
+	AccessVlan    int               // (optional) VLAN ID of access port (hub member only)
+	TrunkVlans    []int             // (optional) VLAN IDs of trunk port (hub member only)
+	Mirrors       []Mirror          // (optional) mirror sessions to the interface
 }
 
 // VxLan is a structure to descrive vxlan endpoint.
 type VxLan struct {
-	ParentIF string // parent interface name
+	ParentIF string // parent interface name (required for multicast group)
 	ID       int    // VxLan ID
-	IPAddr   net.IP // VxLan destination address
+	IPAddr   net.IP // VxLan destination address (unicast remote)
 	MTU      int    // VxLan Interface MTU (with VxLan encap), used mirroring
-	UDPPort  int    // VxLan UDP port (src/dest, no range, single value)
+	UDPPort  int    // VxLan UDP destination port
+	Local    net.IP // (optional) source address of outer IP header
+	Group    net.IP // (optional) multicast group, instead of IPAddr
+	TTL      int    // (optional) TTL of outer IP header
+	TOS      int    // (optional) TOS of outer IP header
+	PortLow  int    // (optional) lower bound of UDP source port range
+	PortHigh int    // (optional) upper bound of UDP source port range
+
+	UDPCsum        bool  // (optional) UDP checksum over IPv4
+	UDP6ZeroCsumTx bool  // (optional) skip UDP checksum over IPv6 in tx
+	UDP6ZeroCsumRx bool  // (optional) accept zero UDP checksum over IPv6 in rx
+	Learning       *bool // (optional) FDB learning (default: on)
+	L2miss         *bool // (optional) L2 miss notification (default: on)
+	L3miss         *bool // (optional) L3 miss notification (default: on)
+	Proxy          bool  // (optional) ARP/ND proxy by neighbor entries
+}
+
+// Geneve is a structure to descrive geneve endpoint.
+type Geneve struct {
+	ID             int    // Geneve VNI
+	IPAddr         net.IP // Geneve destination address (IPv4 or IPv6)
+	MTU            int    // Geneve Interface MTU (with Geneve encap), used mirroring
+	UDPPort        int    // (optional) Geneve UDP destination port
+	TTL            int    // (optional) TTL of outer IP header
+	TOS            int    // (optional) TOS of outer IP header
+	UDPCsum        bool   // (optional) UDP checksum over IPv4
+	UDP6ZeroCsumTx bool   // (optional) skip UDP checksum over IPv6 in tx
+	UDP6ZeroCsumRx bool   // (optional) accept zero UDP checksum over IPv6 in rx
+}
+
+// Gre is a structure to descrive gre endpoint.
+type Gre struct {
+	Mode     string  // gre, gretap, ip6gre, ip6gretap, erspan or ip6erspan (default: gretap)
+	Local    net.IP  // (optional) local address of the tunnel
+	Remote   net.IP  // remote address of the tunnel
+	Key      uint32  // (optional) GRE key, used for both directions (ERSPAN session ID)
+	TTL      int     // (optional) TTL of outer IP header
+	ParentIF string  // (optional) parent interface name
+	MTU      int     // Gre Interface MTU (with Gre encap), used mirroring
+	Erspan   *Erspan // (optional) ERSPAN settings (erspan and ip6erspan mode)
 }
 
 // VLan is a structure to descrive vlan endpoint.
@@ -64,6 +117,38 @@ type MacVLan struct {
 	Mode     netlink.MacvlanMode // MacVlan mode
 }
 
+// MacVTap is a structure to descrive macvtap endpoint.
+type MacVTap struct {
+	ParentIF string              // parent interface name
+	Mode     netlink.MacvlanMode // MacVTap mode
+}
+
+// TapDevice is a structure to describe character device of macvtap.
+// Callers need to create it (e.g. mknod /dev/tap<Index> c <Major> <Minor>)
+// in container's mount namespace to use the macvtap.
+type TapDevice struct {
+	Index int    // interface index of the macvtap in container namespace
+	Major uint32 // major number of the character device
+	Minor uint32 // minor number of the character device
+}
+
+// IPVLan is a structure to descrive ipvlan endpoint.
+type IPVLan struct {
+	ParentIF string             // parent interface name
+	Mode     netlink.IPVlanMode // IPVlan mode (l2, l3 or l3s)
+	Flag     netlink.IPVlanFlag // IPVlan flag (bridge, private or vepa)
+}
+
+// GenerateHardwareAddr derives locally administered unicast MAC address
+// from endpoint key (see EndpointKey) and link name, hence the same
+// interface gets the same MAC address when it is re-created.
+func GenerateHardwareAddr(endpointKey, linkName string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(endpointKey + "\x00" + linkName))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] | 0x02) & 0xfe
+	return mac
+}
+
 // getRandomIFName generates random string for unique interface name
 func getRandomIFName() string {
 	rand.Seed(time.Now().UnixNano())
@@ -88,10 +173,16 @@ func makeVethPair(name, peer string, mtu int) (netlink.Link, error) {
 }
 
 // GetVethPair takes two link names and create a veth pair and return
-//both links.
+// both links.
 func GetVethPair(name1 string, name2 string) (link1 netlink.Link,
 	link2 netlink.Link, err error) {
-	link1, err = makeVethPair(name1, name2, 1500)
+	return getVethPair(name1, name2, 1500)
+}
+
+// getVethPair is GetVethPair with given MTU.
+func getVethPair(name1, name2 string, mtu int) (link1 netlink.Link,
+	link2 netlink.Link, err error) {
+	link1, err = makeVethPair(name1, name2, mtu)
 	if err != nil {
 		switch {
 		case os.IsExist(err):
@@ -112,14 +203,87 @@ func GetVethPair(name1 string, name2 string) (link1 netlink.Link,
 	return
 }
 
-// AddVxLanInterface creates VxLan interface by given vxlan object
+// vethPairMTU returns MTU of veth pair, which both ends need to agree on.
+// It is 1500 if neither end gives it.
+func vethPairMTU(veth1, veth2 VEth) (int, error) {
+	switch {
+	case veth1.MTU < 0 || veth2.MTU < 0:
+		return 0, fmt.Errorf("invalid MTU %d/%d", veth1.MTU, veth2.MTU)
+	case veth1.MTU != 0 && veth2.MTU != 0 && veth1.MTU != veth2.MTU:
+		return 0, fmt.Errorf("MTU of %s (%d) and %s (%d) differ",
+			veth1.LinkName, veth1.MTU, veth2.LinkName, veth2.MTU)
+	case veth1.MTU != 0:
+		return veth1.MTU, nil
+	case veth2.MTU != 0:
+		return veth2.MTU, nil
+	}
+	return 1500, nil
+}
+
+// vxlanOverhead is the size of outer headers of vxlan (Ethernet, IP, UDP
+// and vxlan header), which is subtracted from parent MTU.
+func vxlanOverhead(ipv6 bool) int {
+	if ipv6 {
+		return 14 + 40 + 8 + 8
+	}
+	return 14 + 20 + 8 + 8
+}
+
+// greOverhead is the size of outer headers of gre (IP, GRE header with key
+// and sequence number, ERSPAN header and Ethernet of tap/erspan modes),
+// which is subtracted from parent MTU.
+func greOverhead(mode string) int {
+	overhead := 20 + 12
+	if strings.HasPrefix(mode, "ip6") {
+		overhead = 40 + 12
+	}
+	switch {
+	case isErspanMode(mode):
+		overhead += 12 + 14
+	case strings.HasSuffix(mode, "tap"):
+		overhead += 14
+	}
+	return overhead
+}
+
+// AddVxLanInterface creates VxLan interface by given vxlan object.
+// If MTU is not given, it is derived from the parent interface.
 func AddVxLanInterface(vxlan VxLan, devName string) (err error) {
-	var parentIF netlink.Link
+	var parentIndex int
+	var parentMTU int
 	logger.Infof("koko: create vxlan link %s under %s", devName, vxlan.ParentIF)
 	UDPPort := 4789
 
-	if parentIF, err = netlink.LinkByName(vxlan.ParentIF); err != nil {
-		return fmt.Errorf("failed to get %s: %v", vxlan.ParentIF, err)
+	remote := vxlan.IPAddr
+	switch {
+	case remote != nil && vxlan.Group != nil:
+		return fmt.Errorf("both remote %s and group %s are given",
+			remote, vxlan.Group)
+	case remote != nil && remote.IsMulticast():
+		return fmt.Errorf("remote %s is multicast address", remote)
+	case vxlan.Group != nil:
+		if !vxlan.Group.IsMulticast() {
+			return fmt.Errorf("group %s is not multicast address",
+				vxlan.Group)
+		}
+		if vxlan.ParentIF == "" {
+			return fmt.Errorf("multicast group needs parent interface")
+		}
+		remote = vxlan.Group
+	}
+	if remote != nil && vxlan.Local != nil &&
+		(remote.To4() == nil) != (vxlan.Local.To4() == nil) {
+		return fmt.Errorf("address family of local %s and remote %s differ",
+			vxlan.Local, remote)
+	}
+
+	if vxlan.ParentIF != "" {
+		parentIF, err := netlink.LinkByName(vxlan.ParentIF)
+		if err != nil {
+			return fmt.Errorf("failed to get %s: %v", vxlan.ParentIF, err)
+		}
+		parentIndex = parentIF.Attrs().Index
+		parentMTU = parentIF.Attrs().MTU
 	}
 
 	if vxlan.UDPPort != 0 {
@@ -131,16 +295,29 @@ func AddVxLanInterface(vxlan VxLan, devName string) (err error) {
 			Name:   devName,
 			TxQLen: 1000,
 		},
-		VxlanId:      vxlan.ID,
-		VtepDevIndex: parentIF.Attrs().Index,
-		Group:        vxlan.IPAddr,
-		Port:         UDPPort,
-		Learning:     true,
-		L2miss:       true,
-		L3miss:       true,
+		VxlanId:        vxlan.ID,
+		VtepDevIndex:   parentIndex,
+		SrcAddr:        vxlan.Local,
+		Group:          remote,
+		TTL:            vxlan.TTL,
+		TOS:            vxlan.TOS,
+		Port:           UDPPort,
+		PortLow:        vxlan.PortLow,
+		PortHigh:       vxlan.PortHigh,
+		UDPCSum:        vxlan.UDPCsum,
+		UDP6ZeroCSumTx: vxlan.UDP6ZeroCsumTx,
+		UDP6ZeroCSumRx: vxlan.UDP6ZeroCsumRx,
+		Learning:       boolOrDefault(vxlan.Learning, true),
+		L2miss:         boolOrDefault(vxlan.L2miss, true),
+		L3miss:         boolOrDefault(vxlan.L3miss, true),
+		Proxy:          vxlan.Proxy,
 	}
 	if vxlan.MTU != 0 {
 		vxlanconf.LinkAttrs.MTU = vxlan.MTU
+	} else if parentMTU != 0 {
+		ipv6 := (remote != nil && remote.To4() == nil) ||
+			(vxlan.Local != nil && vxlan.Local.To4() == nil)
+		vxlanconf.LinkAttrs.MTU = parentMTU - vxlanOverhead(ipv6)
 	}
 	err = netlink.LinkAdd(&vxlanconf)
 
@@ -150,6 +327,142 @@ func AddVxLanInterface(vxlan VxLan, devName string) (err error) {
 	return nil
 }
 
+// boolOrDefault returns the value of b, or def if b is not given.
+func boolOrDefault(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+// AddGeneveInterface creates Geneve interface by given geneve object
+func AddGeneveInterface(geneve Geneve, devName string) (err error) {
+	logger.Infof("koko: create geneve link %s to %s", devName, geneve.IPAddr)
+	UDPPort := 6081
+
+	if geneve.IPAddr == nil {
+		return fmt.Errorf("no geneve destination address")
+	}
+	if geneve.UDPPort != 0 {
+		UDPPort = geneve.UDPPort
+	}
+
+	geneveconf := netlink.Geneve{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:   devName,
+			TxQLen: 1000,
+			MTU:    geneve.MTU,
+		},
+		ID:             uint32(geneve.ID),
+		Remote:         geneve.IPAddr,
+		Dport:          uint16(UDPPort),
+		Ttl:            uint8(geneve.TTL),
+		Tos:            uint8(geneve.TOS),
+		UdpCsum:        boolToUint8(geneve.UDPCsum),
+		UdpZeroCsum6Tx: boolToUint8(geneve.UDP6ZeroCsumTx),
+		UdpZeroCsum6Rx: boolToUint8(geneve.UDP6ZeroCsumRx),
+	}
+	if geneve.UDPCsum || geneve.UDP6ZeroCsumTx || geneve.UDP6ZeroCsumRx {
+		err = addGeneveCsumLink(&geneveconf)
+	} else {
+		err = netlink.LinkAdd(&geneveconf)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to add geneve %s: %v", devName, err)
+	}
+	return nil
+}
+
+// AddGreInterface creates Gre interface by given gre object.
+// If MTU is not given, it is derived from the parent interface.
+func AddGreInterface(gre Gre, devName string) (err error) {
+	var parentIndex int
+	mode := gre.Mode
+	if mode == "" {
+		mode = "gretap"
+	}
+	logger.Infof("koko: create %s link %s to %s", mode, devName, gre.Remote)
+
+	if gre.Remote == nil {
+		return fmt.Errorf("no %s remote address", mode)
+	}
+	local := gre.Local
+	switch mode {
+	case "gre", "gretap", "erspan":
+		if gre.Remote.To4() == nil || (local != nil && local.To4() == nil) {
+			return fmt.Errorf("%s needs IPv4 address", mode)
+		}
+		if local == nil {
+			local = net.IPv4zero
+		}
+	case "ip6gre", "ip6gretap", "ip6erspan":
+		if gre.Remote.To4() != nil || (local != nil && local.To4() != nil) {
+			return fmt.Errorf("%s needs IPv6 address", mode)
+		}
+		if local == nil {
+			local = net.IPv6zero
+		}
+	default:
+		return fmt.Errorf("unknown gre mode %s", mode)
+	}
+
+	if gre.ParentIF != "" {
+		parentIF, err := netlink.LinkByName(gre.ParentIF)
+		if err != nil {
+			return fmt.Errorf("failed to get %s: %v", gre.ParentIF, err)
+		}
+		parentIndex = parentIF.Attrs().Index
+		if gre.MTU == 0 {
+			gre.MTU = parentIF.Attrs().MTU - greOverhead(mode)
+		}
+	}
+
+	if isErspanMode(mode) {
+		if err = addErspanInterface(gre, devName, local, parentIndex); err != nil {
+			return fmt.Errorf("Failed to add %s %s: %v", mode, devName, err)
+		}
+		return nil
+	}
+	if gre.Erspan != nil {
+		return fmt.Errorf("erspan settings need erspan mode")
+	}
+
+	attrs := netlink.LinkAttrs{
+		Name:   devName,
+		TxQLen: 1000,
+		MTU:    gre.MTU,
+	}
+	var greconf netlink.Link
+	if strings.HasSuffix(mode, "tap") {
+		greconf = &netlink.Gretap{
+			LinkAttrs: attrs,
+			Local:     local,
+			Remote:    gre.Remote,
+			IKey:      gre.Key,
+			OKey:      gre.Key,
+			Ttl:       uint8(gre.TTL),
+			PMtuDisc:  1,
+			Link:      uint32(parentIndex),
+		}
+	} else {
+		greconf = &netlink.Gretun{
+			LinkAttrs: attrs,
+			Local:     local,
+			Remote:    gre.Remote,
+			IKey:      gre.Key,
+			OKey:      gre.Key,
+			Ttl:       uint8(gre.TTL),
+			PMtuDisc:  1,
+			Link:      uint32(parentIndex),
+		}
+	}
+
+	if err = netlink.LinkAdd(greconf); err != nil {
+		return fmt.Errorf("Failed to add %s %s: %v", mode, devName, err)
+	}
+	return nil
+}
+
 // AddVLanInterface creates VLan interface by given vlan object
 func AddVLanInterface(vlan VLan, devName string) (err error) {
 	var parentIF netlink.Link
@@ -196,6 +509,71 @@ func AddMacVLanInterface(macvlan MacVLan, devName string) (err error) {
 	return nil
 }
 
+// AddMacVTapInterface creates MacVTap interface by given macvtap object
+func AddMacVTapInterface(macvtap MacVTap, devName string) (err error) {
+	var parentIF netlink.Link
+	logger.Infof("koko: create macvtap link %s under %s", devName, macvtap.ParentIF)
+
+	if parentIF, err = netlink.LinkByName(macvtap.ParentIF); err != nil {
+		return fmt.Errorf("Failed to get %s: %v", macvtap.ParentIF, err)
+	}
+
+	macvtapconf := netlink.Macvtap{
+		Macvlan: netlink.Macvlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:        devName,
+				ParentIndex: parentIF.Attrs().Index,
+			},
+			Mode: macvtap.Mode,
+		},
+	}
+
+	if err = netlink.LinkAdd(&macvtapconf); err != nil {
+		return fmt.Errorf("Failed to add macvtap %s: %v", devName, err)
+	}
+	return nil
+}
+
+// getTapDevNum reads major/minor number of the macvtap character device
+// from sysfs. It needs to be called in the namespace where sysfs is
+// mounted, i.e. before the link is moved into container.
+func getTapDevNum(link netlink.Link) (major, minor uint32, err error) {
+	path := fmt.Sprintf("/sys/class/net/%s/macvtap/tap%d/dev",
+		link.Attrs().Name, link.Attrs().Index)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if _, err = fmt.Sscanf(string(data), "%d:%d", &major, &minor); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return major, minor, nil
+}
+
+// AddIPVLanInterface creates IPVLan interface by given ipvlan object
+func AddIPVLanInterface(ipvlan IPVLan, devName string) (err error) {
+	var parentIF netlink.Link
+	logger.Infof("koko: create ipvlan link %s under %s", devName, ipvlan.ParentIF)
+
+	if parentIF, err = netlink.LinkByName(ipvlan.ParentIF); err != nil {
+		return fmt.Errorf("Failed to get %s: %v", ipvlan.ParentIF, err)
+	}
+
+	ipvlanconf := netlink.IPVlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        devName,
+			ParentIndex: parentIF.Attrs().Index,
+		},
+		Mode: ipvlan.Mode,
+		Flag: ipvlan.Flag,
+	}
+
+	if err = netlink.LinkAdd(&ipvlanconf); err != nil {
+		return fmt.Errorf("Failed to add ipvlan %s: %v", devName, err)
+	}
+	return nil
+}
+
 // GetDockerContainerNS retrieves container's network namespace from
 // docker container id, given as containerID.
 func GetDockerContainerNS(procPrefix, containerID string) (namespace string, err error) {
@@ -220,15 +598,68 @@ func GetDockerContainerNS(procPrefix, containerID string) (namespace string, err
 	return
 }
 
-// SetIngressMirror sets TC to mirror ingress from given port
-// as MirrorIngress.
+// SetMirrors sets TC for mirror sessions of veth, in current namespace.
+// If it fails, every session set so far is rolled back.
+func (veth *VEth) SetMirrors() (err error) {
+	return withJournal(func(j *journal) error {
+		return veth.setMirrors(j, "")
+	})
+}
+
+// SetIngressMirror sets TC for ingress mirror sessions of veth.
+//
+// Deprecated: Use SetMirrors.
 func (veth *VEth) SetIngressMirror() (err error) {
+	return withJournal(func(j *journal) error {
+		return veth.setMirrors(j, "ingress")
+	})
+}
+
+// SetEgressMirror sets TC for egress mirror sessions of veth.
+//
+// Deprecated: Use SetMirrors.
+func (veth *VEth) SetEgressMirror() (err error) {
+	return withJournal(func(j *journal) error {
+		return veth.setMirrors(j, "egress")
+	})
+}
+
+// setMirrors is SetMirrors with journal, for sessions of given direction
+// ("": all sessions). Filters of the sessions are recorded in a copy of
+// Mirrors, so that the slice of caller is not modified.
+func (veth *VEth) setMirrors(j *journal, direction string) (err error) {
+	mirrors := make([]Mirror, len(veth.Mirrors))
+	copy(mirrors, veth.Mirrors)
+	for i := range mirrors {
+		mirror := &mirrors[i]
+		if direction != "" && mirror.Direction != direction {
+			continue
+		}
+		switch mirror.Direction {
+		case "ingress":
+			err = veth.setIngressMirror(j, mirror)
+		case "egress":
+			err = veth.setEgressMirror(j, mirror)
+		default:
+			err = fmt.Errorf("unknown direction %q", mirror.Direction)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set tc %s mirror from %s: %v",
+				mirror.Direction, mirror.Source, err)
+		}
+	}
+	veth.Mirrors = mirrors
+	return nil
+}
+
+// setIngressMirror sets TC to mirror ingress from the source of mirror.
+func (veth *VEth) setIngressMirror(j *journal, mirror *Mirror) (err error) {
 	var linkSrc, linkDest netlink.Link
-	logger.Infof("koko: configure ingress mirroring")
+	logger.Infof("koko: configure ingress mirroring from %s", mirror.Source)
 
-	if linkSrc, err = netlink.LinkByName(veth.MirrorIngress); err != nil {
+	if linkSrc, err = netlink.LinkByName(mirror.Source); err != nil {
 		return fmt.Errorf("failed to lookup %q in %q: %v",
-			veth.MirrorIngress, veth.NsName, err)
+			mirror.Source, veth.NsName, err)
 	}
 
 	if linkDest, err = netlink.LinkByName(veth.LinkName); err != nil {
@@ -237,61 +668,32 @@ func (veth *VEth) SetIngressMirror() (err error) {
 	}
 
 	// tc qdisc add dev $SRC_IFACE ingress
-	qdisc := &netlink.Ingress{
-		QdiscAttrs: netlink.QdiscAttrs{
-			LinkIndex: linkSrc.Attrs().Index,
-			Handle:    netlink.MakeHandle(0xffff, 0),
-			Parent:    netlink.HANDLE_INGRESS,
-		},
-	}
-	if err = netlink.QdiscAdd(qdisc); err != nil {
-		if !os.IsExist(err) {
-			return err
-		}
+	filters := &MirrorFilters{}
+	if filters.QdiscCreated, err = addIngressQdisc(j, linkSrc); err != nil {
+		return err
 	}
 
 	// tc filter add dev $SRC_IFACE parent fffff:
 	// protocol all
-	// u32 match u32 0 0
+	// {u32 match u32 0 0|flower <match>}
 	// action mirred egress mirror dev $DST_IFACE
-	filter := &netlink.U32{
-		FilterAttrs: netlink.FilterAttrs{
-			LinkIndex: linkSrc.Attrs().Index,
-			Parent:    netlink.MakeHandle(0xffff, 0),
-			Protocol:  syscall.ETH_P_ALL,
-		},
-		Sel: &netlink.TcU32Sel{
-			Keys: []netlink.TcU32Key{
-				{
-					Mask: 0x0,
-					Val:  0,
-				},
-			},
-			Flags: netlink.TC_U32_TERMINAL,
-		},
-		Actions: []netlink.Action{
-			&netlink.MirredAction{
-				ActionAttrs: netlink.ActionAttrs{
-					Action: netlink.TC_ACT_PIPE,
-				},
-				MirredAction: netlink.TCA_EGRESS_MIRROR,
-				Ifindex:      linkDest.Attrs().Index,
-			},
-		},
+	filters.Prios, err = addMirrorFilters(j, linkSrc,
+		netlink.MakeHandle(0xffff, 0), linkDest, mirror.Match)
+	if err != nil {
+		return err
 	}
-
-	return netlink.FilterAdd(filter)
+	mirror.Filters = filters
+	return nil
 }
 
-// SetEgressMirror sets TC to mirror egress from given port
-// as MirrorEgress.
-func (veth *VEth) SetEgressMirror() (err error) {
+// setEgressMirror sets TC to mirror egress from the source of mirror.
+func (veth *VEth) setEgressMirror(j *journal, mirror *Mirror) (err error) {
 	var linkSrc, linkDest netlink.Link
-	logger.Infof("koko: configure egress mirroring")
+	logger.Infof("koko: configure egress mirroring from %s", mirror.Source)
 
-	if linkSrc, err = netlink.LinkByName(veth.MirrorEgress); err != nil {
+	if linkSrc, err = netlink.LinkByName(mirror.Source); err != nil {
 		return fmt.Errorf("failed to lookup %q in %q: %v",
-			veth.MirrorEgress, veth.NsName, err)
+			mirror.Source, veth.NsName, err)
 	}
 
 	/*
@@ -299,8 +701,8 @@ func (veth *VEth) SetEgressMirror() (err error) {
 			return fmt.Errorf("veth qlen must be non zero!")
 		}
 	*/
-	if err = netlink.LinkSetTxQLen(linkSrc, 1000); err != nil {
-		return fmt.Errorf("cannot set %s TxQLen: %v", veth.MirrorEgress, err)
+	if err = setTxQLen(j, linkSrc, 1000); err != nil {
+		return fmt.Errorf("cannot set %s TxQLen: %v", mirror.Source, err)
 	}
 
 	if linkDest, err = netlink.LinkByName(veth.LinkName); err != nil {
@@ -308,6 +710,28 @@ func (veth *VEth) SetEgressMirror() (err error) {
 			veth.LinkName, veth.NsName, err)
 	}
 
+	shaper, err := egressShaper(linkSrc)
+	if err != nil {
+		return err
+	}
+	if shaper != nil {
+		return fmt.Errorf("egress mirror of %s conflicts with egress shaping",
+			mirror.Source)
+	}
+
+	// netem at root moves under the bands of prio
+	netems, err := netemQdiscs(linkSrc)
+	if err != nil {
+		return err
+	}
+	if len(netems) != 0 && netems[0].Parent == netlink.HANDLE_ROOT {
+		if _, err = delNetem(j, linkSrc); err != nil {
+			return err
+		}
+	} else {
+		netems = nil
+	}
+
 	// tc qdisc add dev <SRC> handle 1: root prio
 	qdisc := netlink.NewPrio(
 		netlink.QdiscAttrs{
@@ -315,57 +739,207 @@ func (veth *VEth) SetEgressMirror() (err error) {
 			Handle:    netlink.MakeHandle(1, 0),
 			Parent:    netlink.HANDLE_ROOT,
 		})
-	if err = netlink.QdiscAdd(qdisc); err != nil {
-		if !os.IsExist(err) {
+	filters := &MirrorFilters{}
+	if filters.QdiscCreated, err = addQdisc(j, qdisc); err != nil {
+		return err
+	}
+	if len(netems) != 0 {
+		if err = placeNetem(j, linkSrc, netems[0]); err != nil {
 			return err
 		}
 	}
 	// tc filter add dev $SRC_IFACE parent 1:
 	// protocol all
-	// u32 match u32 0 0
+	// {u32 match u32 0 0|flower <match>}
 	// action mirred egress mirror dev $DST_IFACE
-	u32SelKeys := []netlink.TcU32Key{
-		{
-			Mask: 0x0,
-			Val:  0,
-		},
+	filters.Prios, err = addMirrorFilters(j, linkSrc,
+		netlink.MakeHandle(1, 0), linkDest, mirror.Match)
+	if err != nil {
+		return err
 	}
-	filter := &netlink.U32{
-		FilterAttrs: netlink.FilterAttrs{
-			LinkIndex: linkSrc.Attrs().Index,
-			Parent:    netlink.MakeHandle(1, 0),
-			Protocol:  syscall.ETH_P_ALL,
-		},
-		Sel: &netlink.TcU32Sel{
-			Keys:  u32SelKeys,
-			Flags: netlink.TC_U32_TERMINAL,
-		},
-		Actions: []netlink.Action{
-			&netlink.MirredAction{
-				ActionAttrs: netlink.ActionAttrs{
-					Action: netlink.TC_ACT_PIPE,
-				},
-				MirredAction: netlink.TCA_EGRESS_MIRROR,
-				Ifindex:      linkDest.Attrs().Index,
-			},
-		},
+	mirror.Filters = filters
+	return nil
+}
+
+// addQdisc adds given qdisc and returns true if it is created. If the
+// qdisc already exists, it is used as is, otherwise its removal is
+// registered to journal.
+func addQdisc(j *journal, qdisc netlink.Qdisc) (bool, error) {
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		if !os.IsExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	j.push(fmt.Sprintf("delete %s qdisc", qdisc.Type()), func() error {
+		return netlink.QdiscDel(qdisc)
+	})
+	return true, nil
+}
+
+// getFreeFilterPrio returns filter priority which is not used under
+// given parent, as kernel does for filters without priority (i.e. just
+// before existing ones), hence the filter can be deleted individually.
+func getFreeFilterPrio(link netlink.Link, parent uint32) (uint16, error) {
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list filters of %s: %v",
+			link.Attrs().Name, err)
+	}
+
+	prio := uint16(0xc000)
+	for _, filter := range filters {
+		if p := filter.Attrs().Priority; p <= prio {
+			prio = p - 1
+		}
+	}
+	if prio == 0 {
+		return 0, fmt.Errorf("no free filter priority in %s",
+			link.Attrs().Name)
+	}
+	return prio, nil
+}
+
+// addFilter adds given filter to the link with unused priority and
+// registers its removal to journal.
+func addFilter(j *journal, link netlink.Link, filter netlink.Filter) (err error) {
+	attrs := filter.Attrs()
+	if attrs.Priority, err = getFreeFilterPrio(link, attrs.Parent); err != nil {
+		return err
+	}
+	if err = netlink.FilterAdd(filter); err != nil {
+		return err
+	}
+	j.push(fmt.Sprintf("delete %s filter (prio %d) of %s",
+		filter.Type(), attrs.Priority, link.Attrs().Name), func() error {
+		return netlink.FilterDel(filter)
+	})
+	return nil
+}
+
+// setTxQLen sets TxQLen of the link and registers previous one to journal.
+func setTxQLen(j *journal, link netlink.Link, qlen int) error {
+	oldQLen := link.Attrs().TxQLen
+	if err := netlink.LinkSetTxQLen(link, qlen); err != nil {
+		return err
+	}
+	j.push(fmt.Sprintf("restore %s TxQLen to %d", link.Attrs().Name, oldQLen),
+		func() error {
+			return netlink.LinkSetTxQLen(link, oldQLen)
+		})
+	return nil
+}
+
+// setSysctl sets sysctl value and registers previous one to journal.
+func setSysctl(j *journal, name, value string) error {
+	oldValue, err := sysctl.Sysctl(name)
+	if err != nil {
+		return err
+	}
+	if _, err = sysctl.Sysctl(name, value); err != nil {
+		return err
 	}
+	j.push(fmt.Sprintf("restore %s to %s", name, oldValue), func() error {
+		_, err := sysctl.Sysctl(name, oldValue)
+		return err
+	})
+	return nil
+}
+
+// deleteLinkByName removes the link given by its name.
+func deleteLinkByName(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+// withJournal runs fn with new journal. If fn fails, all steps done in
+// fn are rolled back.
+func withJournal(fn func(j *journal) error) error {
+	j := newJournal()
+	if err := fn(j); err != nil {
+		j.rollback()
+		return err
+	}
+	j.release()
+	return nil
+}
 
-	return netlink.FilterAdd(filter)
+// UnsetMirrors unsets TC for mirror sessions of veth, in current
+// namespace. Sessions are unset in reverse order, so that the qdisc which
+// the first session created is removed last.
+func (veth *VEth) UnsetMirrors() (err error) {
+	return veth.unsetMirrors("")
 }
 
-// UnsetIngressMirror sets TC to mirror ingress from given port
-// as MirrorIngress.
+// UnsetIngressMirror unsets TC for ingress mirror sessions of veth.
+//
+// Deprecated: Use UnsetMirrors.
 func (veth *VEth) UnsetIngressMirror() (err error) {
+	return veth.unsetMirrors("ingress")
+}
+
+// UnsetEgressMirror unsets TC for egress mirror sessions of veth.
+//
+// Deprecated: Use UnsetMirrors.
+func (veth *VEth) UnsetEgressMirror() (err error) {
+	return veth.unsetMirrors("egress")
+}
+
+// unsetMirrors is UnsetMirrors for sessions of given direction ("": all
+// sessions).
+func (veth *VEth) unsetMirrors(direction string) (err error) {
+	for i := len(veth.Mirrors) - 1; i >= 0; i-- {
+		mirror := veth.Mirrors[i]
+		if direction != "" && mirror.Direction != direction {
+			continue
+		}
+		switch mirror.Direction {
+		case "ingress":
+			err = veth.unsetIngressMirror(&mirror)
+		case "egress":
+			err = veth.unsetEgressMirror(&mirror)
+		default:
+			err = fmt.Errorf("unknown direction %q", mirror.Direction)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to unset tc %s mirror from %s: %v",
+				mirror.Direction, mirror.Source, err)
+		}
+	}
+	return nil
+}
+
+// unsetIngressMirror removes the filters of ingress mirror from the source
+// of mirror. Ingress qdisc is also removed if koko recorded that it created
+// the qdisc for the mirror and no other filter remains.
+func (veth *VEth) unsetIngressMirror(mirror *Mirror) (err error) {
 	var linkSrc netlink.Link
-	logger.Infof("koko: unconfigure ingress mirroring")
+	logger.Infof("koko: unconfigure ingress mirroring from %s", mirror.Source)
 
-	if linkSrc, err = netlink.LinkByName(veth.MirrorIngress); err != nil {
+	if linkSrc, err = netlink.LinkByName(mirror.Source); err != nil {
 		return fmt.Errorf("failed to lookup %q in %q: %v",
-			veth.MirrorIngress, veth.NsName, err)
+			mirror.Source, veth.NsName, err)
 	}
+	// the link may be already removed
+	linkDest, _ := netlink.LinkByName(veth.LinkName)
 
-	// tc qdisc add dev $SRC_IFACE ingress
+	remaining, err := delMirrorFilters(linkSrc, netlink.MakeHandle(0xffff, 0),
+		mirror.Filters, linkDest)
+	if err != nil {
+		return err
+	}
+	filters := mirror.Filters
+	if remaining != 0 && filters != nil && filters.QdiscCreated {
+		handOverMirrorQdisc(veth, mirror)
+	}
+	if keepMirrorQdisc(remaining, filters) {
+		return nil
+	}
+
+	// tc qdisc del dev $SRC_IFACE ingress
 	qdisc := &netlink.Ingress{
 		QdiscAttrs: netlink.QdiscAttrs{
 			LinkIndex: linkSrc.Attrs().Index,
@@ -373,52 +947,114 @@ func (veth *VEth) UnsetIngressMirror() (err error) {
 			Parent:    netlink.HANDLE_INGRESS,
 		},
 	}
-
-	return netlink.QdiscDel(qdisc)
+	if err = netlink.QdiscDel(qdisc); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
-// UnsetEgressMirror sets TC to mirror egress from given port
-// as MirrorEgress.
-func (veth *VEth) UnsetEgressMirror() (err error) {
+// unsetEgressMirror removes the filters of egress mirror from the source
+// of mirror. Prio qdisc is also removed if koko recorded that it created the
+// qdisc for the mirror and no other filter remains.
+func (veth *VEth) unsetEgressMirror(mirror *Mirror) (err error) {
 	var linkSrc netlink.Link
-	logger.Infof("koko: unconfigure egress mirroring")
+	logger.Infof("koko: unconfigure egress mirroring from %s", mirror.Source)
 
-	if linkSrc, err = netlink.LinkByName(veth.MirrorEgress); err != nil {
+	if linkSrc, err = netlink.LinkByName(mirror.Source); err != nil {
 		return fmt.Errorf("failed to lookup %q in %q: %v",
-			veth.MirrorEgress, veth.NsName, err)
+			mirror.Source, veth.NsName, err)
 	}
+	// the link may be already removed
+	linkDest, _ := netlink.LinkByName(veth.LinkName)
 
-	// tc qdisc add dev <SRC> handle 1: root prio
-	qdisc := netlink.NewPrio(
-		netlink.QdiscAttrs{
-			LinkIndex: linkSrc.Attrs().Index,
-			Handle:    netlink.MakeHandle(1, 0),
-			Parent:    netlink.HANDLE_ROOT,
-		})
-	return netlink.QdiscDel(qdisc)
+	remaining, err := delMirrorFilters(linkSrc, netlink.MakeHandle(1, 0),
+		mirror.Filters, linkDest)
+	if err != nil {
+		return err
+	}
+	filters := mirror.Filters
+	if remaining != 0 && filters != nil && filters.QdiscCreated {
+		handOverMirrorQdisc(veth, mirror)
+	}
+	if keepMirrorQdisc(remaining, filters) {
+		return nil
+	}
+
+	// qdiscs of others under the bands of prio are kept
+	qdiscs, err := netlink.QdiscList(linkSrc)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %s: %v",
+			mirror.Source, err)
+	}
+	for _, q := range qdiscs {
+		major, _ := netlink.MajorMinor(q.Attrs().Parent)
+		if _, ok := q.(*netlink.Netem); !ok && major == 1 {
+			return nil
+		}
+	}
+
+	// netem under the bands of prio moves back to root
+	netems, err := netemQdiscs(linkSrc)
+	if err != nil {
+		return err
+	}
+
+	// tc qdisc del dev <SRC> handle 1: root prio
+	qdisc := netlink.NewPrio(
+		netlink.QdiscAttrs{
+			LinkIndex: linkSrc.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		})
+	if err = netlink.QdiscDel(qdisc); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(netems) == 0 {
+		return nil
+	}
+	return withJournal(func(j *journal) error {
+		return placeNetem(j, linkSrc, netems[0])
+	})
 }
 
 // SetVethLink is low-level handler to set IP address onveth links given
 // a single VEth data object.
 // ...primarily used privately by makeVeth().
+// If it fails, the link is restored to the state before the call.
 func (veth *VEth) SetVethLink(link netlink.Link) (err error) {
-	var vethNs ns.NetNS
+	return withJournal(func(j *journal) error {
+		if err := veth.setVethLink(j, link); err != nil {
+			return err
+		}
+		return veth.waitDAD(j)
+	})
+}
+
+// setVethLink is SetVethLink with journal.
+func (veth *VEth) setVethLink(j *journal, link netlink.Link) (err error) {
+	var vethNs, curNs ns.NetNS
 
 	vethLinkName := link.Attrs().Name
-	if veth.NsName == "" {
-		if vethNs, err = ns.GetCurrentNS(); err != nil {
-			return fmt.Errorf("%v", err)
-		}
-	} else {
-		if vethNs, err = ns.GetNS(veth.NsName); err != nil {
-			return fmt.Errorf("%v", err)
-		}
+	if curNs, err = j.openNS(""); err != nil {
+		return fmt.Errorf("%v", err)
+	}
+	if vethNs, err = j.openNS(veth.NsName); err != nil {
+		return fmt.Errorf("%v", err)
 	}
 
-	defer vethNs.Close()
 	if err = netlink.LinkSetNsFd(link, int(vethNs.Fd())); err != nil {
 		return fmt.Errorf("%v", err)
 	}
+	j.pushNS(vethNs, fmt.Sprintf("move %s back", vethLinkName), func() error {
+		link, err := netlink.LinkByName(vethLinkName)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetNsFd(link, int(curNs.Fd()))
+	})
 
 	err = vethNs.Do(func(_ ns.NetNS) error {
 		link, err := netlink.LinkByName(vethLinkName)
@@ -433,24 +1069,63 @@ func (veth *VEth) SetVethLink(link netlink.Link) (err error) {
 					"failed to rename link %s -> %s: %v",
 					vethLinkName, veth.LinkName, err)
 			}
+			j.push(fmt.Sprintf("rename %s back to %s",
+				veth.LinkName, vethLinkName), func() error {
+				return netlink.LinkSetName(link, vethLinkName)
+			})
+		}
+
+		if veth.MTU != 0 && veth.MTU != link.Attrs().MTU {
+			oldMTU := link.Attrs().MTU
+			if err = netlink.LinkSetMTU(link, veth.MTU); err != nil {
+				return fmt.Errorf("failed to set %q MTU to %d: %v",
+					veth.LinkName, veth.MTU, err)
+			}
+			j.push(fmt.Sprintf("restore %s MTU to %d", veth.LinkName, oldMTU),
+				func() error {
+					return netlink.LinkSetMTU(link, oldMTU)
+				})
+		}
+
+		if err = veth.setVRF(j, link); err != nil {
+			return err
+		}
+
+		if veth.HardwareAddr != nil {
+			oldAddr := link.Attrs().HardwareAddr
+			err = netlink.LinkSetHardwareAddr(link, veth.HardwareAddr)
+			if err != nil {
+				return fmt.Errorf("failed to set %q MAC addr %s: %v",
+					veth.LinkName, veth.HardwareAddr, err)
+			}
+			j.push(fmt.Sprintf("restore %s MAC addr to %s",
+				veth.LinkName, oldAddr), func() error {
+				return netlink.LinkSetHardwareAddr(link, oldAddr)
+			})
+		}
+
+		if err = veth.setIPv6(j); err != nil {
+			return err
+		}
+		if err = veth.setSysctls(j); err != nil {
+			return err
 		}
 
 		if err = netlink.LinkSetUp(link); err != nil {
 			return fmt.Errorf("failed to set %q up: %v",
 				veth.LinkName, err)
 		}
+		j.push(fmt.Sprintf("set %s down", veth.LinkName), func() error {
+			return netlink.LinkSetDown(link)
+		})
 
 		// Conditionally set the IP address.
 		for i := 0; i < len(veth.IPAddr); i++ {
 			// if IPv6, need to enable IPv6 using sysctl
 			if veth.IPAddr[i].IP.To4() == nil {
-				ipv6SysctlName := fmt.Sprintf("net.ipv6.conf.%s.disable_ipv6",
-					veth.LinkName)
-				if _, err := sysctl.Sysctl(ipv6SysctlName, "0"); err != nil {
-					return fmt.Errorf("failed to set ipv6.disable to 0 at %s: %v",
-						veth.LinkName, err)
+				if err := veth.enableIPv6(j); err != nil {
+					return err
 				}
-
 			}
 			addr := &netlink.Addr{IPNet: &veth.IPAddr[i], Label: ""}
 			if err = netlink.AddrAdd(link, addr); err != nil {
@@ -458,35 +1133,88 @@ func (veth *VEth) SetVethLink(link netlink.Link) (err error) {
 					"failed to add IP addr %v to %q: %v",
 					addr, veth.LinkName, err)
 			}
+			j.push(fmt.Sprintf("delete IP addr %v from %s",
+				addr, veth.LinkName), func() error {
+				return netlink.AddrDel(link, addr)
+			})
 		}
 
-		if veth.MirrorIngress != "" {
-			if err = veth.SetIngressMirror(); err != nil {
-				netlink.LinkDel(link)
-				return fmt.Errorf(
-					"failed to set tc ingress mirror :%v",
-					err)
-			}
+		if err = veth.addRoutes(j, link); err != nil {
+			return err
 		}
-		if veth.MirrorEgress != "" {
-			if err = veth.SetEgressMirror(); err != nil {
-				netlink.LinkDel(link)
-				return fmt.Errorf(
-					"failed to set tc egress mirror: %v", err)
-			}
+		if err = veth.addRules(j); err != nil {
+			return err
 		}
-		return nil
+		if err = veth.addNeighbors(j, link, veth.Neighbors); err != nil {
+			return err
+		}
+		if err = veth.setShaping(j, link); err != nil {
+			return err
+		}
+		if err = veth.setNetem(j, link); err != nil {
+			return err
+		}
+
+		return veth.setMirrors(j, "")
 	})
 
 	return err
 }
 
+// enableIPv6 enables IPv6 of veth, in current namespace.
+func (veth *VEth) enableIPv6(j *journal) error {
+	ipv6SysctlName := sysctlName("net.ipv6.conf.{link}.disable_ipv6",
+		veth.LinkName)
+	if err := setSysctl(j, ipv6SysctlName, "0"); err != nil {
+		return fmt.Errorf("failed to set ipv6.disable to 0 at %s: %v",
+			veth.LinkName, err)
+	}
+	return nil
+}
+
 // RemoveVethLink is low-level handler to get interface handle in
 // container/netns namespace and remove it.
+// If the link is recorded in StateDir, the recorded configuration (e.g.
+// mirroring of its peer) is used and the record is also removed.
 func (veth *VEth) RemoveVethLink() (err error) {
+	logger.Infof("koko: remove veth link %s", veth.LinkName)
+
+	record, err := findLink(veth.NsName, veth.LinkName)
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		return removeVeths(record.Endpoints)
+	}
+	return removeVeths([]VEth{*veth})
+}
+
+// removeVeths removes the link given as the first VEth, unsets mirroring
+// of all given VEths (i.e. the link and its peer) and removes its record.
+// Addresses allocated by IPAM are also released.
+func removeVeths(veths []VEth) error {
+	autoAddr := false
+	for i := len(veths) - 1; i >= 0; i-- {
+		if err := veths[i].removeVethLink(i == 0); err != nil {
+			return err
+		}
+		autoAddr = autoAddr || veths[i].AutoAddr
+	}
+	if err := forgetLink(veths[0].NsName, veths[0].LinkName); err != nil {
+		return err
+	}
+	if autoAddr {
+		return releaseAddrs(ipamOwner(veths[0]))
+	}
+	return nil
+}
+
+// removeVethLink unsets mirroring of the link and removes the link if
+// delLink is true. delLink is false for the peer of removed veth, which
+// kernel already removed.
+func (veth *VEth) removeVethLink(delLink bool) (err error) {
 	var vethNs ns.NetNS
 	var link netlink.Link
-	logger.Infof("koko: remove veth link %s", veth.LinkName)
 
 	if veth.NsName == "" {
 		if vethNs, err = ns.GetCurrentNS(); err != nil {
@@ -500,31 +1228,34 @@ func (veth *VEth) RemoveVethLink() (err error) {
 	defer vethNs.Close()
 
 	err = vethNs.Do(func(_ ns.NetNS) error {
-		if veth.MirrorIngress != "" {
-			if err = veth.UnsetIngressMirror(); err != nil {
-				return fmt.Errorf(
-					"failed to unset tc ingress mirror :%v",
-					err)
-			}
-		}
-		if veth.MirrorEgress != "" {
-			if err = veth.UnsetEgressMirror(); err != nil {
-				return fmt.Errorf(
-					"failed to unset tc egress mirror: %v",
-					err)
-			}
+		if err = veth.UnsetMirrors(); err != nil {
+			return err
 		}
-
-		if link, err = netlink.LinkByName(veth.LinkName); err != nil {
-			return fmt.Errorf("failed to lookup %q in %q: %v",
-				veth.LinkName, vethNs.Path(), err)
+		if err = veth.delRules(); err != nil {
+			return err
 		}
+		if delLink {
+			if link, err = netlink.LinkByName(veth.LinkName); err != nil {
+				return fmt.Errorf("failed to lookup %q in %q: %v",
+					veth.LinkName, vethNs.Path(), err)
+			}
 
-		if err = netlink.LinkDel(link); err != nil {
-			return fmt.Errorf("failed to remove link %q in %q: %v",
-				veth.LinkName, vethNs.Path(), err)
+			if err = veth.delRoutes(link); err != nil {
+				return err
+			}
+			err = withJournal(func(j *journal) error {
+				_, err := delNetem(j, link)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if err = netlink.LinkDel(link); err != nil {
+				return fmt.Errorf("failed to remove link %q in %q: %v",
+					veth.LinkName, vethNs.Path(), err)
+			}
 		}
-		return nil
+		return veth.removeVRF()
 	})
 
 	return err
@@ -547,6 +1278,13 @@ func GetMTU(ifname string) (mtu int, err error) {
 
 // SetMTU set veth's IF MTU
 func SetMTU(ifname string, mtu int) (err error) {
+	return withJournal(func(j *journal) error {
+		return setMTU(j, ifname, mtu)
+	})
+}
+
+// setMTU is SetMTU with journal.
+func setMTU(j *journal, ifname string, mtu int) (err error) {
 	var link netlink.Link
 	logger.Infof("koko: set interface %s mtu to %d", ifname, mtu)
 
@@ -558,51 +1296,66 @@ func SetMTU(ifname string, mtu int) (err error) {
 		return fmt.Errorf("failed to lookup %q: %v", ifname, err)
 	}
 
+	oldMTU := link.Attrs().MTU
 	if err = netlink.LinkSetMTU(link, mtu); err != nil {
 		return fmt.Errorf("failed to set MTU %q in %q: %v", ifname, mtu, err)
 	}
+	j.push(fmt.Sprintf("restore %s MTU to %d", ifname, oldMTU), func() error {
+		return netlink.LinkSetMTU(link, oldMTU)
+	})
 	return nil
 }
 
-// GetEgressTxQLen get veth's EgressIF TxQLen
+// GetEgressTxQLen get veth's EgressIF TxQLen (the first source of egress
+// mirror sessions)
 func (veth *VEth) GetEgressTxQLen() (qlen int, err error) {
 	var linkSrc netlink.Link
 
-	if veth.MirrorEgress == "" {
+	sources := veth.mirrorSources("egress")
+	if len(sources) == 0 {
 		return -1, fmt.Errorf("No EgressIF")
 	}
 
-	if linkSrc, err = netlink.LinkByName(veth.MirrorEgress); err != nil {
+	if linkSrc, err = netlink.LinkByName(sources[0]); err != nil {
 		return -1, fmt.Errorf("failed to lookup %q in %q: %v",
-			veth.MirrorEgress, veth.NsName, err)
+			sources[0], veth.NsName, err)
 	}
 
 	return linkSrc.Attrs().TxQLen, nil
 }
 
-// SetEgressTxQLen set veth's EgressIF TxQLen
+// SetEgressTxQLen set veth's EgressIF TxQLen (all sources of egress mirror
+// sessions)
 func (veth *VEth) SetEgressTxQLen(qlen int) (err error) {
 	var linkSrc netlink.Link
 	logger.Infof("koko: set veth %s egress tx qlen to %d", veth.LinkName, qlen)
 
-	if veth.MirrorEgress == "" {
+	sources := veth.mirrorSources("egress")
+	if len(sources) == 0 {
 		return fmt.Errorf("No EgressIF")
 	}
 
-	if linkSrc, err = netlink.LinkByName(veth.MirrorEgress); err != nil {
-		return fmt.Errorf("failed to lookup %q in %q: %v",
-			veth.MirrorEgress, veth.NsName, err)
-	}
+	for _, source := range sources {
+		if linkSrc, err = netlink.LinkByName(source); err != nil {
+			return fmt.Errorf("failed to lookup %q in %q: %v",
+				source, veth.NsName, err)
+		}
 
-	if err = netlink.LinkSetTxQLen(linkSrc, qlen); err != nil {
-		return fmt.Errorf("cannot set %s TxQLen: %v", veth.MirrorEgress, err)
+		if err = netlink.LinkSetTxQLen(linkSrc, qlen); err != nil {
+			return fmt.Errorf("cannot set %s TxQLen: %v", source, err)
+		}
 	}
 	return nil
 }
 
 // MakeVeth is top-level handler to create veth links given two VEth data
 // objects: veth1 and veth2.
+// If it fails, every step done so far is rolled back.
 func MakeVeth(veth1 VEth, veth2 VEth) error {
+	if err := checkNoPortVlan(veth1, veth2); err != nil {
+		return err
+	}
+
 	tempLinkName1 := veth1.LinkName
 	tempLinkName2 := veth2.LinkName
 
@@ -613,158 +1366,425 @@ func MakeVeth(veth1 VEth, veth2 VEth) error {
 		tempLinkName2 = getRandomIFName()
 	}
 
-	link1, link2, err := GetVethPair(tempLinkName1, tempLinkName2)
+	mtu, err := vethPairMTU(veth1, veth2)
 	if err != nil {
 		return err
 	}
 
-	if err = veth1.SetVethLink(link1); err != nil {
-		netlink.LinkDel(link1)
+	err = withJournal(func(j *journal) error {
+		link1, link2, err := getVethPair(tempLinkName1, tempLinkName2, mtu)
+		if err != nil {
+			return err
+		}
+		j.push(fmt.Sprintf("delete veth %s", tempLinkName1), func() error {
+			return deleteLinkByName(tempLinkName1)
+		})
+
+		if veth1.AutoAddr || veth2.AutoAddr {
+			if err = setAutoAddrs(j, &veth1, &veth2); err != nil {
+				return err
+			}
+		}
+
+		if err = veth1.setVethLink(j, link1); err != nil {
+			return err
+		}
+		if err = veth2.setVethLink(j, link2); err != nil {
+			return err
+		}
+
+		if veth1.PeerNeighbors {
+			if err = veth1.setPeerNeighbors(j, &veth2); err != nil {
+				return err
+			}
+		}
+		if veth2.PeerNeighbors {
+			if err = veth2.setPeerNeighbors(j, &veth1); err != nil {
+				return err
+			}
+		}
+
+		if err = veth1.waitDAD(j); err != nil {
+			return err
+		}
+		return veth2.waitDAD(j)
+	})
+	if err != nil {
 		return err
 	}
-	if err = veth2.SetVethLink(link2); err != nil {
-		netlink.LinkDel(link2)
-	}
-	return err
+
+	recordLink(LinkRecord{
+		Type:      "veth",
+		Endpoints: []VEth{veth1, veth2},
+	})
+	return nil
 }
 
 // MakeVxLan makes vxlan interface and put it into container namespace
+// If it fails, every step done so far is rolled back.
 func MakeVxLan(veth1 VEth, vxlan VxLan) (err error) {
-	var link netlink.Link
+	if err = checkNoPortVlan(veth1); err != nil {
+		return err
+	}
+
 	tempLinkName1 := getRandomIFName()
 
-	if err = AddVxLanInterface(vxlan, tempLinkName1); err != nil {
-		logger.Errorf("vxlan add failed: %v", err)
-		return fmt.Errorf("vxlan add failed: %v", err)
+	// vxlan MTU is needed at creation for mirroring
+	if veth1.MTU != 0 {
+		if vxlan.MTU != 0 && vxlan.MTU != veth1.MTU {
+			return fmt.Errorf("MTU of %s (%d) and vxlan (%d) differ",
+				veth1.LinkName, veth1.MTU, vxlan.MTU)
+		}
+		vxlan.MTU = veth1.MTU
 	}
 
-	if link, err = netlink.LinkByName(tempLinkName1); err != nil {
-		return fmt.Errorf("Cannot get %s: %v", tempLinkName1, err)
-	}
+	err = withJournal(func(j *journal) (err error) {
+		var link netlink.Link
 
-	if err = veth1.SetVethLink(link); err != nil {
-		netlink.LinkDel(link)
-		return fmt.Errorf("Cannot add IPaddr/netns failed: %v", err)
-	}
+		if err = AddVxLanInterface(vxlan, tempLinkName1); err != nil {
+			logger.Errorf("vxlan add failed: %v", err)
+			return fmt.Errorf("vxlan add failed: %v", err)
+		}
+		j.push(fmt.Sprintf("delete vxlan %s", tempLinkName1), func() error {
+			return deleteLinkByName(tempLinkName1)
+		})
 
-	if veth1.MirrorIngress != "" {
-		// need to adjast vxlan MTU as ingress
-		mtuMirror, err1 := GetMTU(veth1.MirrorIngress)
-		if err1 != nil {
-			return fmt.Errorf("failed to get %s MTU: %v", veth1.MirrorIngress, err1)
+		if link, err = netlink.LinkByName(tempLinkName1); err != nil {
+			return fmt.Errorf("Cannot get %s: %v", tempLinkName1, err)
 		}
-		mtuVxlan, err2 := GetMTU(veth1.LinkName)
-		if err2 != nil {
-			return fmt.Errorf("failed to get %s MTU: %v", veth1.LinkName, err2)
+
+		if err = veth1.adjustMirrorMTU(j, link); err != nil {
+			return err
 		}
 
-		if mtuMirror != mtuVxlan {
-			if err := SetMTU(veth1.MirrorIngress, vxlan.MTU); err != nil {
-				return fmt.Errorf("Cannot set %s MTU to %d",
-					veth1.MirrorIngress, vxlan.MTU)
-			}
+		if err = veth1.setVethLink(j, link); err != nil {
+			return fmt.Errorf("Cannot add IPaddr/netns failed: %v", err)
 		}
+		return veth1.waitDAD(j)
+	})
+	if err != nil {
+		return err
+	}
+
+	recordLink(LinkRecord{
+		Type:      "vxlan",
+		Endpoints: []VEth{veth1},
+		VxLan:     &vxlan,
+	})
+	return nil
+}
 
-		if err = veth1.SetIngressMirror(); err != nil {
-			netlink.LinkDel(link)
-			return fmt.Errorf(
-				"failed to set tc ingress mirror :%v",
-				err)
+// MakeGeneve makes geneve interface and put it into container namespace
+// If it fails, every step done so far is rolled back.
+func MakeGeneve(veth1 VEth, geneve Geneve) (err error) {
+	if err = checkNoPortVlan(veth1); err != nil {
+		return err
+	}
+
+	tempLinkName1 := getRandomIFName()
+
+	// geneve MTU is needed at creation for mirroring
+	if veth1.MTU != 0 {
+		if geneve.MTU != 0 && geneve.MTU != veth1.MTU {
+			return fmt.Errorf("MTU of %s (%d) and geneve (%d) differ",
+				veth1.LinkName, veth1.MTU, geneve.MTU)
 		}
+		geneve.MTU = veth1.MTU
 	}
-	if veth1.MirrorEgress != "" {
-		// need to adjast vxlan MTU as egress
-		mtuMirror, err1 := GetMTU(veth1.MirrorEgress)
-		if err1 != nil {
-			return fmt.Errorf("failed to get %s MTU: %v", veth1.MirrorEgress, err1)
+
+	err = withJournal(func(j *journal) (err error) {
+		var link netlink.Link
+
+		if err = AddGeneveInterface(geneve, tempLinkName1); err != nil {
+			logger.Errorf("geneve add failed: %v", err)
+			return fmt.Errorf("geneve add failed: %v", err)
 		}
-		mtuVxlan, err2 := GetMTU(veth1.LinkName)
-		if err2 != nil {
-			return fmt.Errorf("failed to get %s MTU: %v", veth1.LinkName, err2)
+		j.push(fmt.Sprintf("delete geneve %s", tempLinkName1), func() error {
+			return deleteLinkByName(tempLinkName1)
+		})
+
+		if link, err = netlink.LinkByName(tempLinkName1); err != nil {
+			return fmt.Errorf("Cannot get %s: %v", tempLinkName1, err)
 		}
 
-		if mtuMirror != mtuVxlan {
-			if mtu1, _ := GetMTU(veth1.MirrorEgress); vxlan.MTU != mtu1 {
-				if err := SetMTU(veth1.MirrorEgress, vxlan.MTU); err != nil {
-					return fmt.Errorf("Cannot set %s MTU to %d",
-						veth1.MirrorEgress, vxlan.MTU)
-				}
-			}
+		if err = veth1.adjustMirrorMTU(j, link); err != nil {
+			return err
 		}
 
-		if err = veth1.SetEgressMirror(); err != nil {
-			netlink.LinkDel(link)
-			return fmt.Errorf(
-				"failed to set tc egress mirror: %v", err)
+		if err = veth1.setVethLink(j, link); err != nil {
+			return fmt.Errorf("Cannot add IPaddr/netns failed: %v", err)
 		}
+		return veth1.waitDAD(j)
+	})
+	if err != nil {
+		return err
 	}
+
+	recordLink(LinkRecord{
+		Type:      "geneve",
+		Endpoints: []VEth{veth1},
+		Geneve:    &geneve,
+	})
 	return nil
 }
 
-// MakeVLan makes vlan interface
-func MakeVLan(veth1 VEth, vlan VLan) (err error) {
-	var link netlink.Link
+// MakeGre makes gre interface and put it into container namespace
+// If it fails, every step done so far is rolled back.
+func MakeGre(veth1 VEth, gre Gre) (err error) {
+	if err = checkNoPortVlan(veth1); err != nil {
+		return err
+	}
+
+	tempLinkName1 := getRandomIFName()
+	gre.setErspanDefaults(veth1)
 
-	if err = AddVLanInterface(vlan, veth1.LinkName); err != nil {
-		return fmt.Errorf("vlan add failed: %v", err)
+	// gre MTU is needed at creation for mirroring
+	if veth1.MTU != 0 {
+		if gre.MTU != 0 && gre.MTU != veth1.MTU {
+			return fmt.Errorf("MTU of %s (%d) and gre (%d) differ",
+				veth1.LinkName, veth1.MTU, gre.MTU)
+		}
+		gre.MTU = veth1.MTU
 	}
 
-	if link, err = netlink.LinkByName(veth1.LinkName); err != nil {
-		return fmt.Errorf("Cannot get %s: %v", veth1.LinkName, err)
+	err = withJournal(func(j *journal) (err error) {
+		var link netlink.Link
+
+		if err = AddGreInterface(gre, tempLinkName1); err != nil {
+			logger.Errorf("gre add failed: %v", err)
+			return fmt.Errorf("gre add failed: %v", err)
+		}
+		j.push(fmt.Sprintf("delete gre %s", tempLinkName1), func() error {
+			return deleteLinkByName(tempLinkName1)
+		})
+
+		if link, err = netlink.LinkByName(tempLinkName1); err != nil {
+			return fmt.Errorf("Cannot get %s: %v", tempLinkName1, err)
+		}
+
+		if err = veth1.adjustMirrorMTU(j, link); err != nil {
+			return err
+		}
+
+		if err = veth1.setVethLink(j, link); err != nil {
+			return fmt.Errorf("Cannot add IPaddr/netns failed: %v", err)
+		}
+		return veth1.waitDAD(j)
+	})
+	if err != nil {
+		return err
 	}
-	if err = veth1.SetVethLink(link); err != nil {
-		return fmt.Errorf("Cannot add IPaddr/netns failed: %v", err)
+
+	recordLink(LinkRecord{
+		Type:      "gre",
+		Endpoints: []VEth{veth1},
+		Gre:       &gre,
+	})
+	return nil
+}
+
+// adjustMirrorMTU sets MTU of the mirror source interfaces in veth's
+// namespace to the one of tunnel link (e.g. vxlan), because mirrored
+// packets which exceed tunnel MTU are dropped. It is called before the
+// link is moved into the namespace.
+func (veth *VEth) adjustMirrorMTU(j *journal, link netlink.Link) error {
+	if len(veth.Mirrors) == 0 {
+		return nil
 	}
+	mtu := link.Attrs().MTU
 
-	if veth1.MirrorIngress != "" {
-		if err = veth1.SetIngressMirror(); err != nil {
-			netlink.LinkDel(link)
-			return fmt.Errorf(
-				"failed to set tc ingress mirror :%v",
-				err)
+	vethNs, err := j.openNS(veth.NsName)
+	if err != nil {
+		return err
+	}
+	return vethNs.Do(func(_ ns.NetNS) error {
+		for _, mirrorIF := range veth.mirrorSources("") {
+			mtuMirror, err := GetMTU(mirrorIF)
+			if err != nil {
+				return fmt.Errorf("failed to get %s MTU: %v", mirrorIF, err)
+			}
+			if mtuMirror == mtu {
+				continue
+			}
+			if err = setMTU(j, mirrorIF, mtu); err != nil {
+				return fmt.Errorf("Cannot set %s MTU to %d", mirrorIF, mtu)
+			}
 		}
+		return nil
+	})
+}
+
+// MakeVLan makes vlan interface
+// If it fails, every step done so far is rolled back.
+func MakeVLan(veth1 VEth, vlan VLan) (err error) {
+	if err = checkNoPortVlan(veth1); err != nil {
+		return err
 	}
-	if veth1.MirrorEgress != "" {
-		if err = veth1.SetEgressMirror(); err != nil {
-			netlink.LinkDel(link)
-			return fmt.Errorf(
-				"failed to set tc egress mirror: %v", err)
+
+	err = withJournal(func(j *journal) (err error) {
+		var link netlink.Link
+
+		if err = AddVLanInterface(vlan, veth1.LinkName); err != nil {
+			return fmt.Errorf("vlan add failed: %v", err)
 		}
+		j.push(fmt.Sprintf("delete vlan %s", veth1.LinkName), func() error {
+			return deleteLinkByName(veth1.LinkName)
+		})
+
+		if link, err = netlink.LinkByName(veth1.LinkName); err != nil {
+			return fmt.Errorf("Cannot get %s: %v", veth1.LinkName, err)
+		}
+		if err = veth1.setVethLink(j, link); err != nil {
+			return fmt.Errorf("Cannot add IPaddr/netns failed: %v", err)
+		}
+		return veth1.waitDAD(j)
+	})
+	if err != nil {
+		return err
 	}
+
+	recordLink(LinkRecord{
+		Type:      "vlan",
+		Endpoints: []VEth{veth1},
+		VLan:      &vlan,
+	})
 	return nil
 }
 
 // MakeMacVLan makes macvlan interface
+// If it fails, every step done so far is rolled back.
 func MakeMacVLan(veth1 VEth, macvlan MacVLan) (err error) {
-	var link netlink.Link
-
-	if err = AddMacVLanInterface(macvlan, veth1.LinkName); err != nil {
-		return fmt.Errorf("macvlan add failed: %v", err)
+	if err = checkNoPortVlan(veth1); err != nil {
+		return err
 	}
 
-	if link, err = netlink.LinkByName(veth1.LinkName); err != nil {
-		return fmt.Errorf("Cannot get %s: %v", veth1.LinkName, err)
+	err = withJournal(func(j *journal) (err error) {
+		var link netlink.Link
+
+		if err = AddMacVLanInterface(macvlan, veth1.LinkName); err != nil {
+			return fmt.Errorf("macvlan add failed: %v", err)
+		}
+		j.push(fmt.Sprintf("delete macvlan %s", veth1.LinkName), func() error {
+			return deleteLinkByName(veth1.LinkName)
+		})
+
+		if link, err = netlink.LinkByName(veth1.LinkName); err != nil {
+			return fmt.Errorf("Cannot get %s: %v", veth1.LinkName, err)
+		}
+
+		if err = veth1.setVethLink(j, link); err != nil {
+			return fmt.Errorf("Cannot add IPaddr/netns failed: %v", err)
+		}
+		return veth1.waitDAD(j)
+	})
+	if err != nil {
+		return err
 	}
 
-	if err = veth1.SetVethLink(link); err != nil {
-		return fmt.Errorf("Cannot add IPaddr/netns failed: %v", err)
+	recordLink(LinkRecord{
+		Type:      "macvlan",
+		Endpoints: []VEth{veth1},
+		MacVLan:   &macvlan,
+	})
+	return nil
+}
+
+// MakeMacVTap makes macvtap interface and returns its character device,
+// which callers need to create in container's mount namespace.
+// If it fails, every step done so far is rolled back.
+func MakeMacVTap(veth1 VEth, macvtap MacVTap) (tap TapDevice, err error) {
+	if err = checkNoPortVlan(veth1); err != nil {
+		return tap, err
 	}
-	if veth1.MirrorIngress != "" {
-		if err = veth1.SetIngressMirror(); err != nil {
-			netlink.LinkDel(link)
-			return fmt.Errorf(
-				"failed to set tc ingress mirror :%v",
-				err)
+
+	err = withJournal(func(j *journal) (err error) {
+		var link netlink.Link
+
+		if err = AddMacVTapInterface(macvtap, veth1.LinkName); err != nil {
+			return fmt.Errorf("macvtap add failed: %v", err)
 		}
+		j.push(fmt.Sprintf("delete macvtap %s", veth1.LinkName), func() error {
+			return deleteLinkByName(veth1.LinkName)
+		})
+
+		if link, err = netlink.LinkByName(veth1.LinkName); err != nil {
+			return fmt.Errorf("Cannot get %s: %v", veth1.LinkName, err)
+		}
+		if tap.Major, tap.Minor, err = getTapDevNum(link); err != nil {
+			return err
+		}
+
+		if err = veth1.setVethLink(j, link); err != nil {
+			return fmt.Errorf("Cannot add IPaddr/netns failed: %v", err)
+		}
+		if err = veth1.waitDAD(j); err != nil {
+			return err
+		}
+
+		// interface index may be changed in container namespace.
+		vethNs, err := j.openNS(veth1.NsName)
+		if err != nil {
+			return err
+		}
+		return vethNs.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(veth1.LinkName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q in %q: %v",
+					veth1.LinkName, veth1.NsName, err)
+			}
+			tap.Index = link.Attrs().Index
+			return nil
+		})
+	})
+	if err != nil {
+		return tap, err
 	}
-	if veth1.MirrorEgress != "" {
-		if err = veth1.SetEgressMirror(); err != nil {
-			netlink.LinkDel(link)
-			return fmt.Errorf(
-				"failed to set tc egress mirror: %v", err)
+
+	recordLink(LinkRecord{
+		Type:      "macvtap",
+		Endpoints: []VEth{veth1},
+		MacVTap:   &macvtap,
+		Tap:       &tap,
+	})
+	return tap, nil
+}
+
+// MakeIPVLan makes ipvlan interface
+// If it fails, every step done so far is rolled back.
+func MakeIPVLan(veth1 VEth, ipvlan IPVLan) (err error) {
+	if err = checkNoPortVlan(veth1); err != nil {
+		return err
+	}
+
+	err = withJournal(func(j *journal) (err error) {
+		var link netlink.Link
+
+		if err = AddIPVLanInterface(ipvlan, veth1.LinkName); err != nil {
+			return fmt.Errorf("ipvlan add failed: %v", err)
+		}
+		j.push(fmt.Sprintf("delete ipvlan %s", veth1.LinkName), func() error {
+			return deleteLinkByName(veth1.LinkName)
+		})
+
+		if link, err = netlink.LinkByName(veth1.LinkName); err != nil {
+			return fmt.Errorf("Cannot get %s: %v", veth1.LinkName, err)
 		}
+
+		if err = veth1.setVethLink(j, link); err != nil {
+			return fmt.Errorf("Cannot add IPaddr/netns failed: %v", err)
+		}
+		return veth1.waitDAD(j)
+	})
+	if err != nil {
+		return err
 	}
-	return err
+
+	recordLink(LinkRecord{
+		Type:      "ipvlan",
+		Endpoints: []VEth{veth1},
+		IPVLan:    &ipvlan,
+	})
+	return nil
 }
 
 // IsExistLinkInNS finds interface name in given namespace. if foud return true.
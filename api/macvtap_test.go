@@ -0,0 +1,67 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestMakeMacVTap(t *testing.T) {
+	StateDir = t.TempDir()
+	defer func() { StateDir = "" }()
+
+	hostNs := newTestNS(t)
+	containerNs := newTestNS(t)
+	err := hostNs.Do(func(_ ns.NetNS) error {
+		err := netlink.LinkAdd(&netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "parent0"},
+			PeerName:  "parent1",
+		})
+		if err != nil {
+			t.Skipf("failed to add veth link: %v", err)
+		}
+		veth := VEth{NsName: containerNs.Path(), LinkName: "tap0"}
+
+		// test case1: parent which does not exist
+		_, err = MakeMacVTap(veth, MacVTap{ParentIF: "parent9",
+			Mode: netlink.MACVLAN_MODE_BRIDGE})
+		if err == nil {
+			t.Fatalf("case1: MakeMacVTap should fail")
+		}
+		if links, err := ListLinks(); err != nil || len(links) != 0 {
+			t.Fatalf("case1: %d records, err %v", len(links), err)
+		}
+
+		// test case2: tap device is the macvtap in container namespace
+		tap, err := MakeMacVTap(veth, MacVTap{ParentIF: "parent0",
+			Mode: netlink.MACVLAN_MODE_BRIDGE})
+		if err != nil {
+			t.Skipf("failed to make macvtap: %v", err)
+		}
+		var index int
+		err = containerNs.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName("tap0")
+			if err != nil {
+				return err
+			}
+			index = link.Attrs().Index
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("case2: LinkByName error: %v", err)
+		}
+		if tap.Index != index || tap.Major == 0 {
+			t.Fatalf("case2: tap %+v, index %d", tap, index)
+		}
+		record, err := findLink(veth.NsName, veth.LinkName)
+		if err != nil || record == nil || record.Type != "macvtap" ||
+			record.Tap == nil || *record.Tap != tap {
+			t.Fatalf("case2: record %+v, err %v", record, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("netns error: %v", err)
+	}
+}
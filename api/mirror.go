@@ -0,0 +1,470 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Mirror is a structure to describe a mirror session, which mirrors
+// packets of source interface in given direction to the veth.
+type Mirror struct {
+	Source    string         // source interface, in the namespace of veth
+	Direction string         // ingress or egress
+	Match     []MirrorMatch  // (optional) criteria of mirrored packets (empty: all packets)
+	Filters   *MirrorFilters // filters at the source, set by koko
+}
+
+// NewMirrors returns mirror sessions from source interface in given
+// direction (ingress, egress or both) with match criteria. 'both' gives
+// a session for each direction.
+func NewMirrors(direction, source string, matches []MirrorMatch) ([]Mirror, error) {
+	if source == "" {
+		return nil, fmt.Errorf("no mirror source interface")
+	}
+	directions := []string{direction}
+	switch direction {
+	case "ingress", "egress":
+	case "both":
+		directions = []string{"ingress", "egress"}
+	default:
+		return nil, fmt.Errorf("unknown mirror direction %q", direction)
+	}
+	mirrors := []Mirror{}
+	for _, dir := range directions {
+		mirrors = append(mirrors, Mirror{
+			Source:    source,
+			Direction: dir,
+			Match:     matches,
+		})
+	}
+	return mirrors, nil
+}
+
+// mirrorSources returns source interfaces of mirror sessions of veth in
+// given direction (empty: both directions), without duplication.
+func (veth *VEth) mirrorSources(direction string) []string {
+	sources := []string{}
+	found := map[string]bool{}
+	for _, mirror := range veth.Mirrors {
+		if (direction == "" || mirror.Direction == direction) &&
+			!found[mirror.Source] {
+			found[mirror.Source] = true
+			sources = append(sources, mirror.Source)
+		}
+	}
+	return sources
+}
+
+// MirrorFilters records the filters which koko added to the source
+// interface for a mirror, so that the mirror can be removed without
+// touching other filters.
+type MirrorFilters struct {
+	Prios        []uint16 // priorities of the filters
+	QdiscCreated bool     // the qdisc (ingress or prio) was created for the mirror
+}
+
+// MirrorMatch is a structure to describe criteria of mirrored packets,
+// which is compiled into flower filter. Fields which are not set match
+// any packet.
+type MirrorMatch struct {
+	EthType uint16     // (optional) ethertype (e.g. 0x0800)
+	VlanID  uint16     // (optional) VLAN ID (not combined with other fields)
+	IPProto uint8      // (optional) IP protocol (e.g. 6 for TCP)
+	Src     *net.IPNet // (optional) source address
+	Dst     *net.IPNet // (optional) destination address
+	SrcPort uint16     // (optional) source port of TCP, UDP or SCTP
+	DstPort uint16     // (optional) destination port of TCP, UDP or SCTP
+}
+
+var (
+	// matchEthTypes are ethertypes which can be given by name.
+	matchEthTypes = map[string]uint16{
+		"ip":  syscall.ETH_P_IP,
+		"ip6": syscall.ETH_P_IPV6,
+		"arp": syscall.ETH_P_ARP,
+	}
+	// matchIPProtos are IP protocols which can be given by name.
+	matchIPProtos = map[string]uint8{
+		"tcp":   syscall.IPPROTO_TCP,
+		"udp":   syscall.IPPROTO_UDP,
+		"sctp":  syscall.IPPROTO_SCTP,
+		"icmp":  syscall.IPPROTO_ICMP,
+		"icmp6": syscall.IPPROTO_ICMPV6,
+	}
+	// matchKeys are keys of MirrorMatch in '<key>=<value>'.
+	matchKeys = []string{"ethertype", "vid", "proto", "src", "dst",
+		"sport", "dport"}
+)
+
+// IsMirrorMatchItem returns true if given string is an item of mirror
+// match, i.e. name of ethertype/IP protocol or '<key>=<value>'.
+func IsMirrorMatchItem(s string) bool {
+	if _, ok := matchEthTypes[s]; ok {
+		return true
+	}
+	if _, ok := matchIPProtos[s]; ok {
+		return true
+	}
+	for _, key := range matchKeys {
+		if strings.HasPrefix(s, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMirrorMatch parses mirror match which has items separated by ','
+// or '+', such as 'tcp,dport=443'. Item is ethertype name (ip, ip6 or
+// arp), IP protocol name (tcp, udp, sctp, icmp or icmp6) or
+// '<key>=<value>', where key is ethertype, vid, proto, src, dst, sport or
+// dport.
+func ParseMirrorMatch(s string) (match MirrorMatch, err error) {
+	items := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '+'
+	})
+	if len(items) == 0 {
+		return match, fmt.Errorf("empty mirror match")
+	}
+	for _, item := range items {
+		if ethType, ok := matchEthTypes[item]; ok {
+			match.EthType = ethType
+			continue
+		}
+		if ipProto, ok := matchIPProtos[item]; ok {
+			match.IPProto = ipProto
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return match, fmt.Errorf("invalid mirror match %q", item)
+		}
+		var v uint64
+		switch kv[0] {
+		case "ethertype":
+			if ethType, ok := matchEthTypes[kv[1]]; ok {
+				match.EthType = ethType
+			} else if v, err = strconv.ParseUint(kv[1], 0, 16); err == nil {
+				match.EthType = uint16(v)
+			}
+		case "vid":
+			if v, err = strconv.ParseUint(kv[1], 10, 16); err == nil {
+				if v < 1 || v > 4094 {
+					err = fmt.Errorf("out of range")
+				}
+				match.VlanID = uint16(v)
+			}
+		case "proto":
+			if ipProto, ok := matchIPProtos[kv[1]]; ok {
+				match.IPProto = ipProto
+			} else if v, err = strconv.ParseUint(kv[1], 10, 8); err == nil {
+				match.IPProto = uint8(v)
+			}
+		case "src":
+			match.Src, err = parseMatchAddr(kv[1])
+		case "dst":
+			match.Dst, err = parseMatchAddr(kv[1])
+		case "sport":
+			if v, err = strconv.ParseUint(kv[1], 10, 16); err == nil {
+				match.SrcPort = uint16(v)
+			}
+		case "dport":
+			if v, err = strconv.ParseUint(kv[1], 10, 16); err == nil {
+				match.DstPort = uint16(v)
+			}
+		default:
+			return match, fmt.Errorf("unknown mirror match key %q", kv[0])
+		}
+		if err != nil {
+			return match, fmt.Errorf("invalid %s %q", kv[0], kv[1])
+		}
+	}
+	return match, match.Validate()
+}
+
+// parseMatchAddr parses address in CIDR notation, or single address.
+func parseMatchAddr(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address")
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+// Validate checks that fields of the match can be combined.
+func (match *MirrorMatch) Validate() error {
+	ipKeys := match.IPProto != 0 || match.Src != nil || match.Dst != nil
+	ports := match.SrcPort != 0 || match.DstPort != 0
+	if match.VlanID != 0 && (ipKeys || ports || match.EthType != 0) {
+		return fmt.Errorf("vid can not be combined with other keys")
+	}
+	if ports {
+		switch match.IPProto {
+		case syscall.IPPROTO_TCP, syscall.IPPROTO_UDP, syscall.IPPROTO_SCTP:
+		default:
+			return fmt.Errorf("ports need tcp, udp or sctp")
+		}
+	}
+	if match.Src != nil && match.Dst != nil &&
+		(match.Src.IP.To4() == nil) != (match.Dst.IP.To4() == nil) {
+		return fmt.Errorf("address family of src and dst differs")
+	}
+	if ipKeys {
+		for _, ethType := range match.ethTypes() {
+			if ethType != syscall.ETH_P_IP && ethType != syscall.ETH_P_IPV6 {
+				return fmt.Errorf("ethertype 0x%04x is not IP", ethType)
+			}
+		}
+	}
+	return nil
+}
+
+// ethTypes returns ethertypes of flower filters for the match. IP
+// protocol without address family needs filters for both IPv4 and IPv6.
+func (match *MirrorMatch) ethTypes() []uint16 {
+	var family net.IP
+	if match.Src != nil {
+		family = match.Src.IP
+	} else if match.Dst != nil {
+		family = match.Dst.IP
+	}
+	switch {
+	case match.VlanID != 0:
+		return []uint16{syscall.ETH_P_8021Q}
+	case match.EthType != 0:
+		return []uint16{match.EthType}
+	case family != nil && family.To4() != nil:
+		return []uint16{syscall.ETH_P_IP}
+	case family != nil:
+		return []uint16{syscall.ETH_P_IPV6}
+	case match.IPProto == syscall.IPPROTO_ICMP:
+		return []uint16{syscall.ETH_P_IP}
+	case match.IPProto == syscall.IPPROTO_ICMPV6:
+		return []uint16{syscall.ETH_P_IPV6}
+	case match.IPProto != 0:
+		return []uint16{syscall.ETH_P_IP, syscall.ETH_P_IPV6}
+	}
+	return []uint16{syscall.ETH_P_ALL}
+}
+
+// String returns the match in the notation of ParseMirrorMatch.
+func (match MirrorMatch) String() string {
+	s := []string{}
+	if match.EthType != 0 {
+		s = append(s, fmt.Sprintf("ethertype=0x%04x", match.EthType))
+	}
+	if match.VlanID != 0 {
+		s = append(s, fmt.Sprintf("vid=%d", match.VlanID))
+	}
+	if match.IPProto != 0 {
+		proto := strconv.Itoa(int(match.IPProto))
+		for name, p := range matchIPProtos {
+			if p == match.IPProto {
+				proto = name
+			}
+		}
+		s = append(s, "proto="+proto)
+	}
+	if match.Src != nil {
+		s = append(s, "src="+match.Src.String())
+	}
+	if match.Dst != nil {
+		s = append(s, "dst="+match.Dst.String())
+	}
+	if match.SrcPort != 0 {
+		s = append(s, fmt.Sprintf("sport=%d", match.SrcPort))
+	}
+	if match.DstPort != 0 {
+		s = append(s, fmt.Sprintf("dport=%d", match.DstPort))
+	}
+	return strings.Join(s, "+")
+}
+
+// MarshalJSON encodes MirrorMatch in the notation of ParseMirrorMatch.
+func (match MirrorMatch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(match.String())
+}
+
+// UnmarshalJSON decodes MirrorMatch encoded by MarshalJSON.
+func (match *MirrorMatch) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*match, err = ParseMirrorMatch(s)
+	return err
+}
+
+// flowers returns flower filters of the match with given attributes
+// (except protocol) and actions.
+func (match *MirrorMatch) flowers(attrs netlink.FilterAttrs, actions []netlink.Action) []netlink.Filter {
+	filters := []netlink.Filter{}
+	for _, ethType := range match.ethTypes() {
+		flower := &netlink.Flower{
+			FilterAttrs: attrs,
+			VlanId:      match.VlanID,
+			SrcPort:     match.SrcPort,
+			DestPort:    match.DstPort,
+			Actions:     actions,
+		}
+		flower.Protocol = ethType
+		if ethType != syscall.ETH_P_ALL {
+			flower.EthType = ethType
+		}
+		if match.IPProto != 0 {
+			ipProto := nl.IPProto(match.IPProto)
+			flower.IPProto = &ipProto
+		}
+		if match.Src != nil {
+			flower.SrcIP, flower.SrcIPMask = match.Src.IP, match.Src.Mask
+		}
+		if match.Dst != nil {
+			flower.DestIP, flower.DestIPMask = match.Dst.IP, match.Dst.Mask
+		}
+		filters = append(filters, flower)
+	}
+	return filters
+}
+
+// mirrorFilters returns filters which mirror packets matching given
+// criteria to dest link, for source link at given parent. Without
+// criteria, all packets are mirrored by u32 filter.
+func mirrorFilters(matches []MirrorMatch, linkSrc netlink.Link, parent uint32, linkDest netlink.Link) []netlink.Filter {
+	attrs := netlink.FilterAttrs{
+		LinkIndex: linkSrc.Attrs().Index,
+		Parent:    parent,
+		Protocol:  syscall.ETH_P_ALL,
+	}
+	actions := []netlink.Action{
+		&netlink.MirredAction{
+			ActionAttrs: netlink.ActionAttrs{
+				Action: netlink.TC_ACT_PIPE,
+			},
+			MirredAction: netlink.TCA_EGRESS_MIRROR,
+			Ifindex:      linkDest.Attrs().Index,
+		},
+	}
+
+	if len(matches) == 0 {
+		// u32 match u32 0 0
+		return []netlink.Filter{
+			&netlink.U32{
+				FilterAttrs: attrs,
+				Sel: &netlink.TcU32Sel{
+					Keys: []netlink.TcU32Key{
+						{
+							Mask: 0x0,
+							Val:  0,
+						},
+					},
+					Flags: netlink.TC_U32_TERMINAL,
+				},
+				Actions: actions,
+			},
+		}
+	}
+	filters := []netlink.Filter{}
+	for _, match := range matches {
+		filters = append(filters, match.flowers(attrs, actions)...)
+	}
+	return filters
+}
+
+// addMirrorFilters adds filters which mirror packets matching given
+// criteria from source link to dest link, and returns their priorities.
+func addMirrorFilters(j *journal, linkSrc netlink.Link, parent uint32, linkDest netlink.Link, matches []MirrorMatch) (prios []uint16, err error) {
+	for _, filter := range mirrorFilters(matches, linkSrc, parent, linkDest) {
+		if err = addFilter(j, linkSrc, filter); err != nil {
+			return nil, fmt.Errorf("failed to add %s filter to %s: %v",
+				filter.Type(), linkSrc.Attrs().Name, err)
+		}
+		prios = append(prios, filter.Attrs().Priority)
+	}
+	return prios, nil
+}
+
+// mirrorsTo returns true if the filter has mirred action to the link.
+func mirrorsTo(filter netlink.Filter, link netlink.Link) bool {
+	var actions []netlink.Action
+	switch f := filter.(type) {
+	case *netlink.U32:
+		actions = f.Actions
+	case *netlink.Flower:
+		actions = f.Actions
+	}
+	for _, action := range actions {
+		if mirred, ok := action.(*netlink.MirredAction); ok &&
+			mirred.Ifindex == link.Attrs().Index {
+			return true
+		}
+	}
+	return false
+}
+
+// delMirrorFilters deletes the filters of a mirror under given parent of
+// source link, and returns the number of other filters there. Without
+// the record of filters (e.g. links created by older koko), filters which
+// mirror to dest link are deleted.
+func delMirrorFilters(linkSrc netlink.Link, parent uint32, filters *MirrorFilters, linkDest netlink.Link) (int, error) {
+	list, err := netlink.FilterList(linkSrc, parent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list filters of %s: %v",
+			linkSrc.Attrs().Name, err)
+	}
+	prios := map[uint16]bool{}
+	if filters != nil {
+		for _, prio := range filters.Prios {
+			prios[prio] = true
+		}
+	} else if linkDest != nil {
+		for _, filter := range list {
+			if mirrorsTo(filter, linkDest) {
+				prios[filter.Attrs().Priority] = true
+			}
+		}
+	}
+
+	remaining := 0
+	deleted := map[uint16]bool{}
+	for _, filter := range list {
+		attrs := filter.Attrs()
+		if !prios[attrs.Priority] {
+			remaining++
+			continue
+		}
+		if deleted[attrs.Priority] {
+			continue
+		}
+		deleted[attrs.Priority] = true
+		// handle 0 deletes all filters of the priority (e.g. u32 hash table)
+		attrs.Handle = 0
+		if err = netlink.FilterDel(filter); err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("failed to delete %s filter (prio %d) of %s: %v",
+				filter.Type(), filter.Attrs().Priority,
+				linkSrc.Attrs().Name, err)
+		}
+	}
+	return remaining, nil
+}
+
+// keepMirrorQdisc returns true if the qdisc of a mirror must be kept after
+// its filters are deleted, i.e. other filters remain on it or koko did not
+// create it. Without the record of filters, koko cannot tell who created
+// the qdisc, so it is kept as well.
+func keepMirrorQdisc(remaining int, filters *MirrorFilters) bool {
+	return remaining != 0 || filters == nil || !filters.QdiscCreated
+}
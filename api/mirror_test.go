@@ -0,0 +1,243 @@
+package api
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseMirrorMatch(t *testing.T) {
+	// test case1: TCP port, for both IPv4 and IPv6
+	match1, err1 := ParseMirrorMatch("tcp,dport=443")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if match1.IPProto != syscall.IPPROTO_TCP || match1.DstPort != 443 {
+		t.Fatalf("Parse error: %+v", match1)
+	}
+	if len(match1.ethTypes()) != 2 {
+		t.Fatalf("ethTypes error: %v", match1.ethTypes())
+	}
+	if match1.String() != "proto=tcp+dport=443" {
+		t.Fatalf("String error: %s", match1.String())
+	}
+
+	// test case2: addresses decide the family, JSON round trip
+	match2, err2 := ParseMirrorMatch("proto=udp+src=192.168.1.1+dst=10.0.0.0/8")
+	if err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+	if ethTypes := match2.ethTypes(); len(ethTypes) != 1 || ethTypes[0] != syscall.ETH_P_IP {
+		t.Fatalf("ethTypes error: %v", ethTypes)
+	}
+	data, err2 := json.Marshal(match2)
+	if err2 != nil {
+		t.Fatalf("Marshal error: %v", err2)
+	}
+	var match2a MirrorMatch
+	if err2 = json.Unmarshal(data, &match2a); err2 != nil {
+		t.Fatalf("Unmarshal error: %v", err2)
+	}
+	if match2a.String() != match2.String() || match2a.Src.String() != "192.168.1.1/32" {
+		t.Fatalf("JSON error: %s", data)
+	}
+
+	// test case3: VLAN ID, ethertype by number
+	match3, err3 := ParseMirrorMatch("vid=100")
+	if err3 != nil || match3.ethTypes()[0] != syscall.ETH_P_8021Q {
+		t.Fatalf("Parse error: %+v, %v", match3, err3)
+	}
+	match3, err3 = ParseMirrorMatch("ethertype=0x88cc")
+	if err3 != nil || match3.EthType != 0x88cc {
+		t.Fatalf("Parse error: %+v, %v", match3, err3)
+	}
+
+	// test case4: invalid matches
+	invalids := []string{
+		"",
+		"http",
+		"dport=80",
+		"vid=100,tcp",
+		"vid=4095",
+		"src=192.168.1.1,dst=2001:db8::1",
+		"arp,proto=tcp",
+		"tcp,dport=65536",
+		"src=foo",
+	}
+	for _, str := range invalids {
+		if _, err4 := ParseMirrorMatch(str); err4 == nil {
+			t.Fatalf("Parse should fail with %q", str)
+		}
+	}
+}
+
+func TestKeepMirrorQdisc(t *testing.T) {
+	cases := []struct {
+		remaining int
+		filters   *MirrorFilters
+		keep      bool
+	}{
+		{0, &MirrorFilters{QdiscCreated: true}, false},
+		{1, &MirrorFilters{QdiscCreated: true}, true},
+		{0, &MirrorFilters{QdiscCreated: false}, true},
+		{0, nil, true},
+	}
+	for _, c := range cases {
+		if keep := keepMirrorQdisc(c.remaining, c.filters); keep != c.keep {
+			t.Fatalf("keepMirrorQdisc(%d, %+v) = %v", c.remaining, c.filters, keep)
+		}
+	}
+}
+
+// newTestNS creates a network namespace for the test, which is skipped
+// unless it runs as root.
+func newTestNS(t *testing.T) ns.NetNS {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root")
+	}
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Skipf("failed to create netns: %v", err)
+	}
+	t.Cleanup(func() {
+		netns.Close()
+		testutils.UnmountNS(netns)
+	})
+	return netns
+}
+
+func TestUnsetIngressMirror(t *testing.T) {
+	netns := newTestNS(t)
+	err := netns.Do(func(_ ns.NetNS) error {
+		links := map[string]netlink.Link{}
+		for _, name := range []string{"src", "dst", "other"} {
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: name},
+				PeerName:  name + "-peer",
+			})
+			if err != nil {
+				t.Skipf("failed to add veth link: %v", err)
+			}
+			if links[name], err = netlink.LinkByName(name); err != nil {
+				t.Fatalf("LinkByName error: %v", err)
+			}
+		}
+		parent := netlink.MakeHandle(0xffff, 0)
+		if _, err := addIngressQdisc(newJournal(), links["src"]); err != nil {
+			t.Skipf("failed to add ingress qdisc: %v", err)
+		}
+		// filter of others, which mirrors to another link
+		foreign := mirrorFilters(nil, links["src"], parent, links["other"])[0]
+		foreign.Attrs().Priority = 0xc000
+		if err := netlink.FilterAdd(foreign); err != nil {
+			t.Skipf("failed to add u32 filter: %v", err)
+		}
+
+		unset := func(filters *MirrorFilters) (nFilters int, hasQdisc bool) {
+			prios, err := addMirrorFilters(newJournal(), links["src"], parent, links["dst"], nil)
+			if err != nil {
+				t.Fatalf("addMirrorFilters error: %v", err)
+			}
+			if filters != nil {
+				filters.Prios = prios
+			}
+			veth := VEth{LinkName: "dst", Mirrors: []Mirror{
+				{Source: "src", Direction: "ingress", Filters: filters}}}
+			if err = veth.unsetIngressMirror(&veth.Mirrors[0]); err != nil {
+				t.Fatalf("unsetIngressMirror error: %v", err)
+			}
+			list, err := netlink.FilterList(links["src"], parent)
+			if err != nil {
+				t.Fatalf("FilterList error: %v", err)
+			}
+			qdiscs, err := netlink.QdiscList(links["src"])
+			if err != nil {
+				t.Fatalf("QdiscList error: %v", err)
+			}
+			for _, q := range qdiscs {
+				if _, ok := q.(*netlink.Ingress); ok {
+					hasQdisc = true
+				}
+			}
+			return len(list), hasQdisc
+		}
+
+		// test case1: filters of others remain, qdisc is kept
+		if n, ok := unset(&MirrorFilters{QdiscCreated: true}); n != 1 || !ok {
+			t.Fatalf("case1: %d filters, qdisc %v", n, ok)
+		}
+		// test case2: without record, only filters to the link are deleted
+		if n, ok := unset(nil); n != 1 || !ok {
+			t.Fatalf("case2: %d filters, qdisc %v", n, ok)
+		}
+		if err := netlink.FilterDel(foreign); err != nil {
+			t.Fatalf("FilterDel error: %v", err)
+		}
+		// test case3: qdisc is not created by koko, qdisc is kept
+		if n, ok := unset(&MirrorFilters{QdiscCreated: false}); n != 0 || !ok {
+			t.Fatalf("case3: %d filters, qdisc %v", n, ok)
+		}
+		// test case4: without record, qdisc is kept
+		if n, ok := unset(nil); n != 0 || !ok {
+			t.Fatalf("case4: %d filters, qdisc %v", n, ok)
+		}
+		// test case5: qdisc created by koko, no filter remains
+		if n, ok := unset(&MirrorFilters{QdiscCreated: true}); n != 0 || ok {
+			t.Fatalf("case5: %d filters, qdisc %v", n, ok)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("netns error: %v", err)
+	}
+}
+
+func TestSetMirrors(t *testing.T) {
+	netns := newTestNS(t)
+	err := netns.Do(func(_ ns.NetNS) error {
+		err := netlink.LinkAdd(&netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "src"},
+			PeerName:  "dst",
+		})
+		if err != nil {
+			t.Skipf("failed to add veth link: %v", err)
+		}
+
+		mirrors := []Mirror{{Source: "src", Direction: "ingress"}}
+		veth := VEth{LinkName: "dst", Mirrors: mirrors}
+		if err = veth.SetMirrors(); err != nil {
+			t.Skipf("failed to set mirror: %v", err)
+		}
+		if veth.Mirrors[0].Filters == nil || len(veth.Mirrors[0].Filters.Prios) != 1 {
+			t.Fatalf("filters should be recorded: %+v", veth.Mirrors[0].Filters)
+		}
+		if mirrors[0].Filters != nil {
+			t.Fatalf("slice of caller should not be modified: %+v", mirrors[0].Filters)
+		}
+
+		// deprecated wrapper unsets sessions of its direction only
+		if err = veth.UnsetEgressMirror(); err != nil {
+			t.Fatalf("UnsetEgressMirror error: %v", err)
+		}
+		link, _ := netlink.LinkByName("src")
+		list, _ := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+		if len(list) != 1 {
+			t.Fatalf("ingress filter should remain: %v", list)
+		}
+		if err = veth.UnsetIngressMirror(); err != nil {
+			t.Fatalf("UnsetIngressMirror error: %v", err)
+		}
+		if list, _ = netlink.FilterList(link, netlink.MakeHandle(0xffff, 0)); len(list) != 0 {
+			t.Fatalf("ingress filter should be deleted: %v", list)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("netns error: %v", err)
+	}
+}
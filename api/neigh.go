@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// addNeighbors adds permanent neighbor entries of veth to given link, in
+// current namespace.
+func (veth *VEth) addNeighbors(j *journal, link netlink.Link, entries []NeighEntry) error {
+	for _, entry := range entries {
+		if entry.IP.To4() == nil {
+			if err := veth.enableIPv6(j); err != nil {
+				return err
+			}
+		}
+		neigh := entry.neigh(link)
+		if err := netlink.NeighAdd(neigh); err != nil {
+			return fmt.Errorf("failed to add neighbor %s lladdr %s to %q: %v",
+				entry.IP, entry.MAC, veth.LinkName, err)
+		}
+		j.push(fmt.Sprintf("delete neighbor %s from %s", entry.IP,
+			veth.LinkName), func() error {
+			return netlink.NeighDel(neigh)
+		})
+	}
+	return nil
+}
+
+// setPeerNeighbors adds neighbor entries of peer's addresses and MAC
+// address to veth, i.e. the other end of veth pair. The entries are
+// appended to veth.Neighbors.
+func (veth *VEth) setPeerNeighbors(j *journal, peer *VEth) error {
+	peerNs, err := j.openNS(peer.NsName)
+	if err != nil {
+		return err
+	}
+	var mac net.HardwareAddr
+	err = peerNs.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(peer.LinkName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q in %q: %v",
+				peer.LinkName, peer.NsName, err)
+		}
+		mac = link.Attrs().HardwareAddr
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	entries := []NeighEntry{}
+	for _, addr := range peer.IPAddr {
+		entries = append(entries, NeighEntry{IP: addr.IP, MAC: mac})
+	}
+
+	vethNs, err := j.openNS(veth.NsName)
+	if err != nil {
+		return err
+	}
+	err = vethNs.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(veth.LinkName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q in %q: %v",
+				veth.LinkName, veth.NsName, err)
+		}
+		return veth.addNeighbors(j, link, entries)
+	})
+	if err != nil {
+		return err
+	}
+	veth.Neighbors = append(veth.Neighbors, entries...)
+	return nil
+}
+
+// MarshalJSON encodes NeighEntry with MAC address in string.
+func (entry NeighEntry) MarshalJSON() ([]byte, error) {
+	type neighAlias NeighEntry
+	return json.Marshal(struct {
+		neighAlias
+		MAC string
+	}{neighAlias(entry), entry.MAC.String()})
+}
+
+// UnmarshalJSON decodes NeighEntry encoded by MarshalJSON.
+func (entry *NeighEntry) UnmarshalJSON(data []byte) (err error) {
+	type neighAlias NeighEntry
+	v := struct {
+		*neighAlias
+		MAC string
+	}{neighAlias: (*neighAlias)(entry)}
+	if err = json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if entry.MAC, err = net.ParseMAC(v.MAC); err != nil {
+		return fmt.Errorf("failed to parse MAC addr %s: %v", v.MAC, err)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// Netem is a structure to describe impairment of veth by netem qdisc,
+// which is applied to egress of the interface.
+type Netem struct {
+	Delay     time.Duration `yaml:"delay"`     // (optional) delay of packets
+	Jitter    time.Duration `yaml:"jitter"`    // (optional) jitter of the delay
+	Loss      float32       `yaml:"loss"`      // (optional) loss rate in percent
+	Reorder   float32       `yaml:"reorder"`   // (optional) reorder rate in percent (needs Delay)
+	Duplicate float32       `yaml:"duplicate"` // (optional) duplication rate in percent
+	Limit     uint32        `yaml:"limit"`     // (optional) queue limit in packets (default: 1000)
+}
+
+// netemMajor is the major number of netem qdisc handle. netem at root or
+// under egress shaper is 10:, and netem under the band N of egress mirror
+// prio is (10+N):.
+const netemMajor = 0x10
+
+// Validate checks netem settings.
+func (netem *Netem) Validate() error {
+	if netem.Delay < 0 || netem.Jitter < 0 {
+		return fmt.Errorf("invalid delay %v/jitter %v", netem.Delay, netem.Jitter)
+	}
+	for _, rate := range []float32{netem.Loss, netem.Reorder, netem.Duplicate} {
+		if rate < 0 || rate > 100 {
+			return fmt.Errorf("invalid rate %v%% (should be 0-100)", rate)
+		}
+	}
+	if netem.Reorder != 0 && netem.Delay == 0 {
+		return fmt.Errorf("reorder needs delay")
+	}
+	return nil
+}
+
+// String returns netem settings in 'tc qdisc' like notation.
+func (netem *Netem) String() string {
+	s := []string{}
+	if netem.Delay != 0 {
+		s = append(s, fmt.Sprintf("delay %v", netem.Delay))
+		if netem.Jitter != 0 {
+			s = append(s, netem.Jitter.String())
+		}
+	}
+	if netem.Loss != 0 {
+		s = append(s, fmt.Sprintf("loss %v%%", netem.Loss))
+	}
+	if netem.Reorder != 0 {
+		s = append(s, fmt.Sprintf("reorder %v%%", netem.Reorder))
+	}
+	if netem.Duplicate != 0 {
+		s = append(s, fmt.Sprintf("duplicate %v%%", netem.Duplicate))
+	}
+	if netem.Limit != 0 {
+		s = append(s, fmt.Sprintf("limit %d", netem.Limit))
+	}
+	return strings.Join(s, " ")
+}
+
+// ParseNetem parses netem settings in
+// '[delay=<duration>][+jitter=<duration>][+loss=<percent>][+reorder=<percent>][+duplicate=<percent>][+limit=<packets>]',
+// where duration is such as '100ms' and percent is such as '0.5' or '0.5%'.
+func ParseNetem(s string) (netem Netem, err error) {
+	for _, opt := range strings.Split(s, "+") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return netem, fmt.Errorf("invalid netem option %q", opt)
+		}
+		switch kv[0] {
+		case "delay":
+			netem.Delay, err = time.ParseDuration(kv[1])
+		case "jitter":
+			netem.Jitter, err = time.ParseDuration(kv[1])
+		case "loss":
+			netem.Loss, err = parsePercent(kv[1])
+		case "reorder":
+			netem.Reorder, err = parsePercent(kv[1])
+		case "duplicate":
+			netem.Duplicate, err = parsePercent(kv[1])
+		case "limit":
+			var limit uint64
+			limit, err = strconv.ParseUint(kv[1], 10, 32)
+			netem.Limit = uint32(limit)
+		default:
+			return netem, fmt.Errorf("unknown netem option %q", kv[0])
+		}
+		if err != nil {
+			return netem, fmt.Errorf("invalid %s %q", kv[0], kv[1])
+		}
+	}
+	return netem, netem.Validate()
+}
+
+// parsePercent parses percentage with or without '%'.
+func parsePercent(s string) (float32, error) {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 32)
+	return float32(f), err
+}
+
+// qdisc returns netem qdisc of the settings, without placement.
+func (netem *Netem) qdisc() *netlink.Netem {
+	return netlink.NewNetem(netlink.QdiscAttrs{}, netlink.NetemQdiscAttrs{
+		Latency:     uint32(netem.Delay / time.Microsecond),
+		Jitter:      uint32(netem.Jitter / time.Microsecond),
+		Loss:        netem.Loss,
+		ReorderProb: netem.Reorder,
+		Duplicate:   netem.Duplicate,
+		Limit:       netem.Limit,
+	})
+}
+
+// egressMirrorPrio returns prio qdisc of egress mirror at root of the link,
+// or nil if it does not exist.
+func egressMirrorPrio(link netlink.Link) (*netlink.Prio, error) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list qdiscs of %s: %v",
+			link.Attrs().Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		attrs := qdisc.Attrs()
+		if prio, ok := qdisc.(*netlink.Prio); ok &&
+			attrs.Parent == netlink.HANDLE_ROOT &&
+			attrs.Handle == netlink.MakeHandle(1, 0) {
+			return prio, nil
+		}
+	}
+	return nil, nil
+}
+
+// netemQdiscs returns netem qdiscs which koko placed on the link, i.e.
+// netem at root, under egress shaper or under the bands of egress mirror
+// prio.
+func netemQdiscs(link netlink.Link) (netems []*netlink.Netem, err error) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list qdiscs of %s: %v",
+			link.Attrs().Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		netem, ok := qdisc.(*netlink.Netem)
+		if !ok {
+			continue
+		}
+		major, _ := netlink.MajorMinor(netem.Parent)
+		if netem.Parent == netlink.HANDLE_ROOT || major == 1 || major == shaperMajor {
+			netems = append(netems, netem)
+		}
+	}
+	return netems, nil
+}
+
+// placeNetem adds copies of given netem qdisc to the link: under each band
+// of egress mirror prio or under egress shaper if they exist, otherwise at
+// root, so that netem coexists with them.
+func placeNetem(j *journal, link netlink.Link, netem *netlink.Netem) error {
+	prio, err := egressMirrorPrio(link)
+	if err != nil {
+		return err
+	}
+	shaper, err := egressShaper(link)
+	if err != nil {
+		return err
+	}
+
+	placements := map[uint32]uint32{
+		netlink.HANDLE_ROOT: netlink.MakeHandle(netemMajor, 0),
+	}
+	if shaper != nil {
+		placements = map[uint32]uint32{
+			netlink.MakeHandle(shaperMajor, 1): netlink.MakeHandle(netemMajor, 0),
+		}
+	} else if prio != nil {
+		placements = map[uint32]uint32{}
+		for band := uint16(1); band <= uint16(prio.Bands); band++ {
+			placements[netlink.MakeHandle(1, band)] =
+				netlink.MakeHandle(netemMajor+band, 0)
+		}
+	}
+	for parent, handle := range placements {
+		qdisc := *netem
+		qdisc.QdiscAttrs = netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Handle:    handle,
+		}
+		if err = netlink.QdiscAdd(&qdisc); err != nil {
+			return fmt.Errorf("failed to add netem qdisc to %s: %v",
+				link.Attrs().Name, err)
+		}
+		j.push(fmt.Sprintf("delete netem qdisc %x: of %s", handle>>16,
+			link.Attrs().Name), func() error {
+			return netlink.QdiscDel(&qdisc)
+		})
+	}
+	return nil
+}
+
+// delNetem removes netem qdiscs which koko placed on the link and
+// registers their re-creation to journal. The removed qdiscs are returned.
+func delNetem(j *journal, link netlink.Link) ([]*netlink.Netem, error) {
+	netems, err := netemQdiscs(link)
+	if err != nil {
+		return nil, err
+	}
+	for _, netem := range netems {
+		netem := netem
+		if err = netlink.QdiscDel(netem); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to delete netem qdisc of %s: %v",
+				link.Attrs().Name, err)
+		}
+		j.push(fmt.Sprintf("restore netem qdisc of %s", link.Attrs().Name),
+			func() error {
+				return netlink.QdiscAdd(netem)
+			})
+	}
+	return netems, nil
+}
+
+// setNetem applies netem settings of veth to given link, in current
+// namespace.
+func (veth *VEth) setNetem(j *journal, link netlink.Link) error {
+	if veth.Netem == nil {
+		return nil
+	}
+	if err := veth.Netem.Validate(); err != nil {
+		return err
+	}
+	logger.Infof("koko: set netem %s to %s", veth.Netem, veth.LinkName)
+	return placeNetem(j, link, veth.Netem.qdisc())
+}
+
+// SetNetem replaces netem settings of existing veth with given ones. nil
+// removes the netem. The record of the link in StateDir is also updated.
+func (veth *VEth) SetNetem(netem *Netem) error {
+	err := withJournal(func(j *journal) error {
+		vethNs, err := j.openNS(veth.NsName)
+		if err != nil {
+			return err
+		}
+		return vethNs.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(veth.LinkName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q in %q: %v",
+					veth.LinkName, veth.NsName, err)
+			}
+			if _, err = delNetem(j, link); err != nil {
+				return err
+			}
+			veth.Netem = netem
+			return veth.setNetem(j, link)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return updateEndpointRecord(veth.NsName, veth.LinkName, func(v *VEth) {
+		v.Netem = netem
+	})
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseNetem(t *testing.T) {
+	// test case1: all settings
+	netem1, err1 := ParseNetem("delay=100ms+jitter=10ms+loss=0.5%+reorder=25+duplicate=1+limit=2000")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if netem1.Delay != 100*time.Millisecond || netem1.Jitter != 10*time.Millisecond ||
+		netem1.Loss != 0.5 || netem1.Reorder != 25 || netem1.Duplicate != 1 ||
+		netem1.Limit != 2000 {
+		t.Fatalf("Parse error: %+v", netem1)
+	}
+	if netem1.String() != "delay 100ms 10ms loss 0.5% reorder 25% duplicate 1% limit 2000" {
+		t.Fatalf("String error: %s", netem1.String())
+	}
+
+	// test case2: invalid settings
+	invalids := []string{
+		"delay=100",
+		"loss=101",
+		"reorder=25",
+		"limit=-1",
+		"rate=1mbit",
+		"delay",
+	}
+	for _, str := range invalids {
+		if _, err2 := ParseNetem(str); err2 == nil {
+			t.Fatalf("Parse should fail with %s", str)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/binary"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// addRawLink creates a link of given kind with IFLA_INFO_DATA filled by
+// fillData. It is used for link attributes which netlink package does not
+// send in LinkAdd (e.g. ERSPAN, and UDP checksum of geneve, which
+// netlink.Geneve has as fields but does not encode).
+func addRawLink(kind, name string, mtu int, fillData func(data *nl.RtAttr)) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK,
+		unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(unix.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(unix.IFLA_IFNAME, nl.ZeroTerminated(name)))
+	req.AddData(nl.NewRtAttr(unix.IFLA_TXQLEN, nl.Uint32Attr(1000)))
+	if mtu != 0 {
+		req.AddData(nl.NewRtAttr(unix.IFLA_MTU, nl.Uint32Attr(uint32(mtu))))
+	}
+
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated(kind))
+	fillData(linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil))
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// addGeneveCsumLink creates given geneve link with its UDP checksum
+// attributes, which the kernel does not allow to change after creation.
+func addGeneveCsumLink(geneve *netlink.Geneve) error {
+	return addRawLink("geneve", geneve.Name, geneve.MTU, func(data *nl.RtAttr) {
+		data.AddRtAttr(nl.IFLA_GENEVE_ID, nl.Uint32Attr(geneve.ID))
+		if ip4 := geneve.Remote.To4(); ip4 != nil {
+			data.AddRtAttr(nl.IFLA_GENEVE_REMOTE, []byte(ip4))
+		} else {
+			data.AddRtAttr(nl.IFLA_GENEVE_REMOTE6, []byte(geneve.Remote.To16()))
+		}
+		data.AddRtAttr(nl.IFLA_GENEVE_PORT, htons(geneve.Dport))
+		if geneve.Ttl != 0 {
+			data.AddRtAttr(nl.IFLA_GENEVE_TTL, nl.Uint8Attr(geneve.Ttl))
+		}
+		if geneve.Tos != 0 {
+			data.AddRtAttr(nl.IFLA_GENEVE_TOS, nl.Uint8Attr(geneve.Tos))
+		}
+		data.AddRtAttr(nl.IFLA_GENEVE_UDP_CSUM, nl.Uint8Attr(geneve.UdpCsum))
+		data.AddRtAttr(nl.IFLA_GENEVE_UDP_ZERO_CSUM6_TX,
+			nl.Uint8Attr(geneve.UdpZeroCsum6Tx))
+		data.AddRtAttr(nl.IFLA_GENEVE_UDP_ZERO_CSUM6_RX,
+			nl.Uint8Attr(geneve.UdpZeroCsum6Rx))
+	})
+}
+
+// htons converts port number into network byte order attribute.
+func htons(port uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, port)
+	return b
+}
+
+// boolToUint8 converts bool into uint8 as netlink attributes take.
+func boolToUint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Route is a structure to describe static route via veth in its namespace.
+type Route struct {
+	Dst    *net.IPNet // destination (nil: default route)
+	Gw     net.IP     // (optional) gateway address
+	Metric int        // (optional) metric of the route
+	Table  int        // (optional) routing table ID (0: main table or table of VRF)
+	Src    net.IP     // (optional) preferred source address
+}
+
+// String returns the route in 'ip route' like notation.
+func (route Route) String() string {
+	s := "default"
+	if route.Dst != nil {
+		s = route.Dst.String()
+	}
+	if route.Gw != nil {
+		s += " via " + route.Gw.String()
+	}
+	if route.Metric != 0 {
+		s += fmt.Sprintf(" metric %d", route.Metric)
+	}
+	if route.Table != 0 {
+		s += fmt.Sprintf(" table %d", route.Table)
+	}
+	if route.Src != nil {
+		s += " src " + route.Src.String()
+	}
+	return s
+}
+
+// isIPv6 returns true if the route is IPv6 one.
+func (route Route) isIPv6() bool {
+	switch {
+	case route.Dst != nil:
+		return route.Dst.IP.To4() == nil
+	case route.Gw != nil:
+		return route.Gw.To4() == nil
+	case route.Src != nil:
+		return route.Src.To4() == nil
+	}
+	return false
+}
+
+// netlinkRoute returns netlink route of the route via given link. table is
+// used if the route does not have its table.
+func (route Route) netlinkRoute(link netlink.Link, table int) *netlink.Route {
+	family := netlink.FAMILY_V4
+	if route.isIPv6() {
+		family = netlink.FAMILY_V6
+	}
+	if route.Table != 0 {
+		table = route.Table
+	}
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Family:    family,
+		Dst:       route.Dst,
+		Gw:        route.Gw,
+		Priority:  route.Metric,
+		Table:     table,
+		Src:       route.Src,
+	}
+}
+
+// addRoutes adds routes of veth via given link, in current namespace.
+// Routes go to the table of the VRF if veth is in VRF.
+func (veth *VEth) addRoutes(j *journal, link netlink.Link) error {
+	for _, route := range veth.Routes {
+		if route.isIPv6() {
+			if err := veth.enableIPv6(j); err != nil {
+				return err
+			}
+		}
+		nlRoute := route.netlinkRoute(link, veth.vrfTable())
+		if err := netlink.RouteAdd(nlRoute); err != nil {
+			return fmt.Errorf("failed to add route %s to %q: %v",
+				route, veth.LinkName, err)
+		}
+		j.push(fmt.Sprintf("delete route %s", route), func() error {
+			return netlink.RouteDel(nlRoute)
+		})
+	}
+	return nil
+}
+
+// delRoutes removes routes of veth via given link, in current namespace.
+// Routes which are already removed are ignored.
+func (veth *VEth) delRoutes(link netlink.Link) error {
+	for _, route := range veth.Routes {
+		err := netlink.RouteDel(route.netlinkRoute(link, veth.vrfTable()))
+		if err != nil && err != unix.ESRCH {
+			return fmt.Errorf("failed to delete route %s from %q: %v",
+				route, veth.LinkName, err)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes Route with destination in CIDR notation.
+func (route Route) MarshalJSON() ([]byte, error) {
+	type routeAlias Route
+	dst := ""
+	if route.Dst != nil {
+		dst = route.Dst.String()
+	}
+	return json.Marshal(struct {
+		routeAlias
+		Dst string `json:",omitempty"`
+	}{routeAlias(route), dst})
+}
+
+// UnmarshalJSON decodes Route encoded by MarshalJSON.
+func (route *Route) UnmarshalJSON(data []byte) error {
+	type routeAlias Route
+	v := struct {
+		*routeAlias
+		Dst string
+	}{routeAlias: (*routeAlias)(route)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	route.Dst = nil
+	if v.Dst != "" {
+		_, dst, err := net.ParseCIDR(v.Dst)
+		if err != nil {
+			return fmt.Errorf("failed to parse route dst %s: %v", v.Dst, err)
+		}
+		route.Dst = dst
+	}
+	return nil
+}
+
+// ParseRoute parses route in
+// '{<dst CIDR>|default}[+via=<gw>][+metric=<metric>][+table=<table>][+src=<src>]'.
+func ParseRoute(s string) (route Route, err error) {
+	n := strings.Split(s, "+")
+	var via, src string
+	var metric, table int
+	for _, opt := range n[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return route, fmt.Errorf("invalid route option %q", opt)
+		}
+		switch kv[0] {
+		case "via":
+			via = kv[1]
+		case "src":
+			src = kv[1]
+		case "metric":
+			if metric, err = strconv.Atoi(kv[1]); err != nil {
+				return route, fmt.Errorf("invalid metric %q", kv[1])
+			}
+		case "table":
+			if table, err = strconv.Atoi(kv[1]); err != nil {
+				return route, fmt.Errorf("invalid table %q", kv[1])
+			}
+		default:
+			return route, fmt.Errorf("unknown route option %q", kv[0])
+		}
+	}
+	return NewRoute(n[0], via, src, metric, table)
+}
+
+// NewRoute creates route from destination ("default" or CIDR), gateway
+// and source address (both can be empty), metric and table.
+func NewRoute(dst, via, src string, metric, table int) (route Route, err error) {
+	if dst != "default" {
+		if _, route.Dst, err = net.ParseCIDR(dst); err != nil {
+			return route, fmt.Errorf("failed to parse route dst %s: %v",
+				dst, err)
+		}
+	}
+	if via != "" {
+		if route.Gw = net.ParseIP(via); route.Gw == nil {
+			return route, fmt.Errorf("failed to parse gateway %s", via)
+		}
+	}
+	if src != "" {
+		if route.Src = net.ParseIP(src); route.Src == nil {
+			return route, fmt.Errorf("failed to parse src %s", src)
+		}
+	}
+	if metric < 0 || table < 0 {
+		return route, fmt.Errorf("invalid metric %d/table %d", metric, table)
+	}
+	route.Metric = metric
+	route.Table = table
+
+	ipv6 := route.isIPv6()
+	for _, ip := range []net.IP{route.Gw, route.Src} {
+		if ip != nil && (ip.To4() == nil) != ipv6 {
+			return route, fmt.Errorf("address family of route %s differs",
+				route)
+		}
+	}
+	return route, nil
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	// test case1: default route
+	route1, err1 := ParseRoute("default+via=192.168.1.254+metric=100")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if route1.Dst != nil || !route1.Gw.Equal(net.ParseIP("192.168.1.254")) ||
+		route1.Metric != 100 || route1.isIPv6() {
+		t.Fatalf("Parse error: %v", route1)
+	}
+
+	// test case2: IPv6 route with table and src, encoded in JSON
+	route2, err2 := ParseRoute("2001:db8:1::/48+via=2001:db8::fe+table=10+src=2001:db8::1")
+	if err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+	if route2.String() != "2001:db8:1::/48 via 2001:db8::fe table 10 src 2001:db8::1" {
+		t.Fatalf("Parse error: %v", route2)
+	}
+	data, err2 := json.Marshal(route2)
+	if err2 != nil {
+		t.Fatalf("Marshal error: %v", err2)
+	}
+	route3 := Route{}
+	if err2 = json.Unmarshal(data, &route3); err2 != nil {
+		t.Fatalf("Unmarshal error: %v", err2)
+	}
+	if route3.String() != route2.String() {
+		t.Fatalf("Marshal error: %s", data)
+	}
+
+	// test case3: invalid routes
+	invalids := []string{
+		"10.0.0.0",
+		"10.0.0.0/8+via=foo",
+		"10.0.0.0/8+metric=foo",
+		"10.0.0.0/8+dev=eth0",
+		"10.0.0.0/8+via=2001:db8::fe",
+	}
+	for _, str := range invalids {
+		if _, err3 := ParseRoute(str); err3 == nil {
+			t.Fatalf("Parse should fail with %q", str)
+		}
+	}
+}
@@ -0,0 +1,682 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// Bitrate is a rate in bit per second. It is written as tc does, such as
+// '10mbit' (units are 1000-based).
+type Bitrate uint64
+
+// ByteSize is a size in bytes. It is written as tc does, such as '32kb'
+// (units are 1024-based).
+type ByteSize uint32
+
+// Shaping is a structure to describe bandwidth shaping of veth. Egress is
+// shaped by TBF, or HTB if Ceil is set, and ingress is policed.
+type Shaping struct {
+	Rate         Bitrate       `yaml:"rate"`          // (optional) egress rate
+	Burst        ByteSize      `yaml:"burst"`         // (optional) egress burst (default: 10ms of rate)
+	Latency      time.Duration `yaml:"latency"`       // (optional) max queueing latency of TBF (default: 50ms)
+	Ceil         Bitrate       `yaml:"ceil"`          // (optional) egress ceil rate, with HTB
+	IngressRate  Bitrate       `yaml:"ingress-rate"`  // (optional) ingress policing rate
+	IngressBurst ByteSize      `yaml:"ingress-burst"` // (optional) ingress policing burst (default: 10ms of rate)
+
+	IngressQdiscCreated bool   `yaml:"-"` // (set by koko) ingress qdisc is created for policing
+	IngressPrio         uint16 `yaml:"-"` // (set by koko) priority of ingress policing filter
+}
+
+// shaperMajor is the major number of egress shaper (TBF/HTB) qdisc
+// handle, i.e. 20:. HTB has class 20:1 as default one.
+const shaperMajor = 0x20
+
+// defaultLatency is the max queueing latency of TBF without Latency.
+const defaultLatency = 50 * time.Millisecond
+
+var (
+	bitrateUnits = []struct {
+		suffix string
+		scale  uint64
+	}{{"gbit", 1000000000}, {"mbit", 1000000}, {"kbit", 1000}, {"bit", 1}}
+	byteSizeUnits = []struct {
+		suffix string
+		scale  uint64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}}
+)
+
+// ParseBitrate parses rate such as '10mbit' (gbit, mbit, kbit or bit).
+// Number without unit is in bit per second.
+func ParseBitrate(s string) (Bitrate, error) {
+	num, scale := strings.ToLower(s), uint64(1)
+	for _, unit := range bitrateUnits {
+		if strings.HasSuffix(num, unit.suffix) {
+			num, scale = strings.TrimSuffix(num, unit.suffix), unit.scale
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 || f*float64(scale) >= math.MaxUint64 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return Bitrate(f * float64(scale)), nil
+}
+
+// String returns the rate with the largest unit which keeps it integer.
+func (rate Bitrate) String() string {
+	for _, unit := range bitrateUnits {
+		if uint64(rate) >= unit.scale && uint64(rate)%unit.scale == 0 {
+			return fmt.Sprintf("%d%s", uint64(rate)/unit.scale, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dbit", uint64(rate))
+}
+
+// UnmarshalYAML decodes Bitrate in string (e.g. '10mbit') or number.
+func (rate *Bitrate) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+	if err = unmarshal(&s); err != nil {
+		return err
+	}
+	*rate, err = ParseBitrate(s)
+	return err
+}
+
+// ParseByteSize parses size such as '32kb' (gb, mb, kb or b). Number
+// without unit is in bytes.
+func ParseByteSize(s string) (ByteSize, error) {
+	num, scale := strings.ToLower(s), uint64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(num, unit.suffix) {
+			num, scale = strings.TrimSuffix(num, unit.suffix), unit.scale
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 || f*float64(scale) > math.MaxUint32 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(f * float64(scale)), nil
+}
+
+// String returns the size with the largest unit which keeps it integer.
+func (size ByteSize) String() string {
+	for _, unit := range byteSizeUnits {
+		if uint64(size) >= unit.scale && uint64(size)%unit.scale == 0 {
+			return fmt.Sprintf("%d%s", uint64(size)/unit.scale, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%db", uint32(size))
+}
+
+// UnmarshalYAML decodes ByteSize in string (e.g. '32kb') or number.
+func (size *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+	if err = unmarshal(&s); err != nil {
+		return err
+	}
+	*size, err = ParseByteSize(s)
+	return err
+}
+
+// Validate checks shaping settings.
+func (shaping *Shaping) Validate() error {
+	if shaping.Rate == 0 && shaping.IngressRate == 0 {
+		return fmt.Errorf("shaping needs rate or ingress-rate")
+	}
+	if shaping.Rate == 0 && (shaping.Burst != 0 || shaping.Latency != 0 ||
+		shaping.Ceil != 0) {
+		return fmt.Errorf("burst, latency and ceil need rate")
+	}
+	if shaping.Ceil != 0 && shaping.Ceil < shaping.Rate {
+		return fmt.Errorf("ceil %s is less than rate %s", shaping.Ceil,
+			shaping.Rate)
+	}
+	if shaping.Ceil != 0 && shaping.Latency != 0 {
+		return fmt.Errorf("latency is for TBF, i.e. without ceil")
+	}
+	if shaping.Latency < 0 {
+		return fmt.Errorf("invalid latency %v", shaping.Latency)
+	}
+	if shaping.IngressRate/8 > math.MaxUint32 {
+		return fmt.Errorf("ingress-rate %s is too large", shaping.IngressRate)
+	}
+	if shaping.IngressRate == 0 && shaping.IngressBurst != 0 {
+		return fmt.Errorf("ingress-burst needs ingress-rate")
+	}
+	return nil
+}
+
+// String returns shaping settings in 'tc' like notation.
+func (shaping *Shaping) String() string {
+	s := []string{}
+	if shaping.Rate != 0 {
+		s = append(s, fmt.Sprintf("rate %s burst %s", shaping.Rate,
+			shaping.burst()))
+		if shaping.Ceil != 0 {
+			s = append(s, fmt.Sprintf("ceil %s", shaping.Ceil))
+		} else {
+			s = append(s, fmt.Sprintf("latency %v", shaping.latency()))
+		}
+	}
+	if shaping.IngressRate != 0 {
+		s = append(s, fmt.Sprintf("ingress-rate %s ingress-burst %s",
+			shaping.IngressRate, shaping.ingressBurst()))
+	}
+	return strings.Join(s, " ")
+}
+
+// ParseShaping parses shaping settings in
+// '[rate=<rate>][+burst=<size>][+latency=<duration>][+ceil=<rate>][+ingress-rate=<rate>][+ingress-burst=<size>]',
+// where rate is such as '10mbit' and size is such as '32kb'.
+func ParseShaping(s string) (shaping Shaping, err error) {
+	for _, opt := range strings.Split(s, "+") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return shaping, fmt.Errorf("invalid shaping option %q", opt)
+		}
+		switch kv[0] {
+		case "rate":
+			shaping.Rate, err = ParseBitrate(kv[1])
+		case "burst":
+			shaping.Burst, err = ParseByteSize(kv[1])
+		case "latency":
+			shaping.Latency, err = time.ParseDuration(kv[1])
+		case "ceil":
+			shaping.Ceil, err = ParseBitrate(kv[1])
+		case "ingress-rate":
+			shaping.IngressRate, err = ParseBitrate(kv[1])
+		case "ingress-burst":
+			shaping.IngressBurst, err = ParseByteSize(kv[1])
+		default:
+			return shaping, fmt.Errorf("unknown shaping option %q", kv[0])
+		}
+		if err != nil {
+			return shaping, err
+		}
+	}
+	return shaping, shaping.Validate()
+}
+
+// defaultBurst returns burst for given rate, i.e. bytes sent in 10ms at
+// the rate, but at least 10kb to pass a jumbo frame.
+func defaultBurst(rate Bitrate) ByteSize {
+	if burst := rate / 8 / 100; burst > 10*1024 {
+		return ByteSize(burst)
+	}
+	return 10 * 1024
+}
+
+// burst returns egress burst, or default one.
+func (shaping *Shaping) burst() ByteSize {
+	if shaping.Burst != 0 {
+		return shaping.Burst
+	}
+	return defaultBurst(shaping.Rate)
+}
+
+// latency returns max queueing latency of TBF, or default one.
+func (shaping *Shaping) latency() time.Duration {
+	if shaping.Latency != 0 {
+		return shaping.Latency
+	}
+	return defaultLatency
+}
+
+// ingressBurst returns ingress policing burst, or default one.
+func (shaping *Shaping) ingressBurst() ByteSize {
+	if shaping.IngressBurst != 0 {
+		return shaping.IngressBurst
+	}
+	return defaultBurst(shaping.IngressRate)
+}
+
+// egressShaper returns egress shaper (TBF or HTB) at root of the link, or
+// nil if it does not exist.
+func egressShaper(link netlink.Link) (netlink.Qdisc, error) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list qdiscs of %s: %v",
+			link.Attrs().Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		attrs := qdisc.Attrs()
+		if attrs.Parent == netlink.HANDLE_ROOT &&
+			attrs.Handle == netlink.MakeHandle(shaperMajor, 0) {
+			return qdisc, nil
+		}
+	}
+	return nil, nil
+}
+
+// addEgressShaper adds TBF (or HTB and its default class if Ceil is set)
+// at root of the link. netem at root moves under the shaper.
+func (shaping *Shaping) addEgressShaper(j *journal, link netlink.Link) error {
+	prio, err := egressMirrorPrio(link)
+	if err != nil {
+		return err
+	}
+	if prio != nil {
+		return fmt.Errorf("egress shaping of %s conflicts with egress mirror",
+			link.Attrs().Name)
+	}
+	netems, err := delNetem(j, link)
+	if err != nil {
+		return err
+	}
+
+	attrs := netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(shaperMajor, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	}
+	rate := uint64(shaping.Rate / 8)
+	if shaping.Ceil == 0 {
+		// tc qdisc add dev <link> root handle 20: tbf rate <rate> burst <burst> latency <latency>
+		burst := uint32(shaping.burst())
+		qdisc := &netlink.Tbf{
+			QdiscAttrs: attrs,
+			Rate:       rate,
+			Limit:      uint32(float64(rate)*shaping.latency().Seconds()) + burst,
+			Buffer:     netlink.Xmittime(rate, burst),
+		}
+		if _, err = addQdisc(j, qdisc); err != nil {
+			return fmt.Errorf("failed to add tbf qdisc to %s: %v",
+				link.Attrs().Name, err)
+		}
+	} else {
+		// tc qdisc add dev <link> root handle 20: htb default 1
+		// tc class add dev <link> parent 20: classid 20:1 htb rate <rate> ceil <ceil> burst <burst>
+		qdisc := netlink.NewHtb(attrs)
+		qdisc.Defcls = 1
+		if _, err = addQdisc(j, qdisc); err != nil {
+			return fmt.Errorf("failed to add htb qdisc to %s: %v",
+				link.Attrs().Name, err)
+		}
+		class := netlink.NewHtbClass(netlink.ClassAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    attrs.Handle,
+			Handle:    netlink.MakeHandle(shaperMajor, 1),
+		}, netlink.HtbClassAttrs{
+			Rate:   uint64(shaping.Rate),
+			Ceil:   uint64(shaping.Ceil),
+			Buffer: uint32(shaping.burst()),
+		})
+		if err = netlink.ClassAdd(class); err != nil {
+			return fmt.Errorf("failed to add htb class to %s: %v",
+				link.Attrs().Name, err)
+		}
+		j.push(fmt.Sprintf("delete htb class of %s", link.Attrs().Name),
+			func() error {
+				return netlink.ClassDel(class)
+			})
+	}
+
+	if len(netems) != 0 {
+		return placeNetem(j, link, netems[0])
+	}
+	return nil
+}
+
+// delEgressShaper removes egress shaper of the link if it exists, and
+// registers its re-creation to journal. netem under the shaper moves back
+// to root.
+func delEgressShaper(j *journal, link netlink.Link) error {
+	shaper, err := egressShaper(link)
+	if err != nil || shaper == nil {
+		return err
+	}
+	netems, err := delNetem(j, link)
+	if err != nil {
+		return err
+	}
+
+	var classes []netlink.Class
+	if htb, ok := shaper.(*netlink.Htb); ok {
+		if classes, err = netlink.ClassList(link, htb.Handle); err != nil {
+			return fmt.Errorf("failed to list classes of %s: %v",
+				link.Attrs().Name, err)
+		}
+		// version in dump (e.g. 3.17) is rejected on creation
+		restored := netlink.NewHtb(htb.QdiscAttrs)
+		restored.Defcls = htb.Defcls
+		shaper = restored
+	}
+	if err = netlink.QdiscDel(shaper); err != nil {
+		return fmt.Errorf("failed to delete %s qdisc of %s: %v",
+			shaper.Type(), link.Attrs().Name, err)
+	}
+	j.push(fmt.Sprintf("restore %s qdisc of %s", shaper.Type(),
+		link.Attrs().Name), func() error {
+		if err := netlink.QdiscAdd(shaper); err != nil {
+			return err
+		}
+		for _, class := range classes {
+			if err := netlink.ClassAdd(class); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if len(netems) != 0 {
+		return placeNetem(j, link, netems[0])
+	}
+	return nil
+}
+
+// ingressQdisc returns ingress qdisc of the link.
+func ingressQdisc(link netlink.Link) *netlink.Ingress {
+	return &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+}
+
+// addIngressQdisc adds ingress qdisc to the link, or uses existing one,
+// and returns true if it is created.
+func addIngressQdisc(j *journal, link netlink.Link) (bool, error) {
+	// tc qdisc add dev <link> ingress
+	return addQdisc(j, ingressQdisc(link))
+}
+
+// delIngressQdisc removes ingress qdisc of the link if no filter remains
+// under it, and registers its re-creation to journal. It returns true if
+// the qdisc is removed or does not exist.
+func delIngressQdisc(j *journal, link netlink.Link) (bool, error) {
+	filters, err := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		if os.IsNotExist(err) || err == syscall.EINVAL {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to list filters of %s: %v",
+			link.Attrs().Name, err)
+	}
+	if len(filters) != 0 {
+		return false, nil
+	}
+
+	// tc qdisc del dev <link> ingress
+	qdisc := ingressQdisc(link)
+	if err = netlink.QdiscDel(qdisc); err != nil {
+		if os.IsNotExist(err) || err == syscall.EINVAL {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to delete ingress qdisc of %s: %v",
+			link.Attrs().Name, err)
+	}
+	j.push(fmt.Sprintf("restore ingress qdisc of %s", link.Attrs().Name),
+		func() error {
+			return netlink.QdiscAdd(qdisc)
+		})
+	return true, nil
+}
+
+// addIngressPolicer adds the filter to police ingress of the link.
+func (shaping *Shaping) addIngressPolicer(j *journal, link netlink.Link) (err error) {
+	if shaping.IngressQdiscCreated, err = addIngressQdisc(j, link); err != nil {
+		return err
+	}
+
+	// tc filter add dev <link> parent ffff: protocol all
+	// u32 match u32 0 0
+	// police rate <rate> burst <burst> drop
+	police := netlink.NewPoliceAction()
+	police.Rate = uint32(shaping.IngressRate / 8)
+	police.Burst = uint32(shaping.ingressBurst())
+	police.ExceedAction = netlink.TC_POLICE_SHOT
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.MakeHandle(0xffff, 0),
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		Sel: &netlink.TcU32Sel{
+			Keys:  []netlink.TcU32Key{{Mask: 0x0, Val: 0}},
+			Flags: netlink.TC_U32_TERMINAL,
+		},
+		Actions: []netlink.Action{police},
+	}
+	if err := addFilter(j, link, filter); err != nil {
+		return fmt.Errorf("failed to add ingress policer to %s: %v",
+			link.Attrs().Name, err)
+	}
+	shaping.IngressPrio = filter.Priority
+	return nil
+}
+
+// ingressPolicers returns ingress policing filters of the link.
+func ingressPolicers(link netlink.Link) (filters []*netlink.U32, err error) {
+	list, err := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		if os.IsNotExist(err) || err == syscall.EINVAL {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list filters of %s: %v",
+			link.Attrs().Name, err)
+	}
+	for _, filter := range list {
+		u32, ok := filter.(*netlink.U32)
+		if !ok {
+			continue
+		}
+		for _, action := range u32.Actions {
+			if _, ok := action.(*netlink.PoliceAction); ok {
+				filters = append(filters, u32)
+				break
+			}
+		}
+	}
+	return filters, nil
+}
+
+// delIngressPolicer removes ingress policing filter of the link which koko
+// added with given priority, and registers its re-creation to journal.
+// Policing filters of others are kept, hence nothing is removed if prio is
+// 0 (i.e. not recorded). The ingress qdisc is kept.
+func delIngressPolicer(j *journal, link netlink.Link, prio uint16) error {
+	if prio == 0 {
+		return nil
+	}
+	filters, err := ingressPolicers(link)
+	if err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		filter := filter
+		if filter.Priority != prio {
+			continue
+		}
+		if err = netlink.FilterDel(filter); err != nil {
+			return fmt.Errorf("failed to delete ingress policer of %s: %v",
+				link.Attrs().Name, err)
+		}
+		j.push(fmt.Sprintf("restore ingress policer of %s", link.Attrs().Name),
+			func() error {
+				return netlink.FilterAdd(filter)
+			})
+	}
+	return nil
+}
+
+// setShaping applies shaping settings of veth to given link, in current
+// namespace.
+func (veth *VEth) setShaping(j *journal, link netlink.Link) error {
+	if veth.Shaping == nil {
+		return nil
+	}
+	shaping := veth.Shaping
+	if err := shaping.Validate(); err != nil {
+		return err
+	}
+	logger.Infof("koko: set shaping %s to %s", shaping, veth.LinkName)
+	if shaping.Rate != 0 {
+		if err := shaping.addEgressShaper(j, link); err != nil {
+			return err
+		}
+	}
+	if shaping.IngressRate != 0 {
+		return shaping.addIngressPolicer(j, link)
+	}
+	return nil
+}
+
+// SetShaping replaces shaping settings of existing veth with given ones.
+// nil removes the shaping. The record of the link in StateDir is also
+// updated, and the ingress qdisc is removed if koko created it for
+// policing and no filter remains.
+func (veth *VEth) SetShaping(shaping *Shaping) error {
+	recorded, err := veth.recordedShaping()
+	if err != nil {
+		return err
+	}
+	if recorded == nil {
+		recorded = &Shaping{}
+	}
+
+	err = withJournal(func(j *journal) error {
+		vethNs, err := j.openNS(veth.NsName)
+		if err != nil {
+			return err
+		}
+		return vethNs.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(veth.LinkName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q in %q: %v",
+					veth.LinkName, veth.NsName, err)
+			}
+			if err = delEgressShaper(j, link); err != nil {
+				return err
+			}
+			if err = delIngressPolicer(j, link, recorded.IngressPrio); err != nil {
+				return err
+			}
+			kept := false
+			if recorded.IngressQdiscCreated {
+				removed, err := delIngressQdisc(j, link)
+				if err != nil {
+					return err
+				}
+				kept = !removed
+			}
+			veth.Shaping = shaping
+			if err = veth.setShaping(j, link); err != nil {
+				return err
+			}
+			// the qdisc which koko created is still owned by policing
+			if kept && shaping != nil && shaping.IngressRate != 0 {
+				shaping.IngressQdiscCreated = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return updateEndpointRecord(veth.NsName, veth.LinkName, func(v *VEth) {
+		v.Shaping = shaping
+	})
+}
+
+// recordedShaping returns shaping settings of veth in its record in
+// StateDir, which has the filter and qdisc koko added for policing, or nil
+// if it is not recorded.
+func (veth *VEth) recordedShaping() (*Shaping, error) {
+	record, err := findLink(veth.NsName, veth.LinkName)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	for _, v := range record.Endpoints {
+		if v.NsName == veth.NsName && v.LinkName == veth.LinkName {
+			return v.Shaping, nil
+		}
+	}
+	return nil, nil
+}
+
+// tbfLatency returns max queueing latency of TBF from its rate (bytes per
+// second), limit and burst (bytes), as the kernel keeps them.
+func tbfLatency(rate uint64, limit, burst uint32) time.Duration {
+	if rate == 0 || limit <= burst {
+		return 0
+	}
+	return time.Duration(float64(limit-burst) / float64(rate) *
+		float64(time.Second)).Round(time.Millisecond)
+}
+
+// GetShaping returns current shaping settings of existing veth, which are
+// read from its qdiscs and filters. It returns nil if it is not shaped.
+func (veth *VEth) GetShaping() (shaping *Shaping, err error) {
+	var vethNs ns.NetNS
+	if veth.NsName == "" {
+		vethNs, err = ns.GetCurrentNS()
+	} else {
+		vethNs, err = ns.GetNS(veth.NsName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer vethNs.Close()
+
+	s := Shaping{}
+	err = vethNs.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(veth.LinkName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q in %q: %v",
+				veth.LinkName, veth.NsName, err)
+		}
+		shaper, err := egressShaper(link)
+		if err != nil {
+			return err
+		}
+		switch shaper := shaper.(type) {
+		case *netlink.Tbf:
+			s.Rate = Bitrate(shaper.Rate * 8)
+			s.Burst = ByteSize(netlink.Xmitsize(shaper.Rate, shaper.Buffer))
+			s.Latency = tbfLatency(shaper.Rate, shaper.Limit, uint32(s.Burst))
+		case *netlink.Htb:
+			classes, err := netlink.ClassList(link, shaper.Handle)
+			if err != nil {
+				return fmt.Errorf("failed to list classes of %s: %v",
+					veth.LinkName, err)
+			}
+			for _, class := range classes {
+				if htb, ok := class.(*netlink.HtbClass); ok &&
+					htb.Handle == netlink.MakeHandle(shaperMajor, 1) {
+					s.Rate = Bitrate(htb.Rate * 8)
+					s.Ceil = Bitrate(htb.Ceil * 8)
+					s.Burst = ByteSize(netlink.Xmitsize(htb.Rate, htb.Buffer))
+				}
+			}
+		}
+
+		policers, err := ingressPolicers(link)
+		if err != nil {
+			return err
+		}
+		for _, filter := range policers {
+			for _, action := range filter.Actions {
+				if police, ok := action.(*netlink.PoliceAction); ok {
+					s.IngressRate = Bitrate(police.Rate) * 8
+					s.IngressBurst = ByteSize(police.Burst)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil || (s.Rate == 0 && s.IngressRate == 0) {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseBitrate(t *testing.T) {
+	rates := map[string]Bitrate{
+		"10mbit":  10000000,
+		"1.5Gbit": 1500000000,
+		"64kbit":  64000,
+		"1000":    1000,
+	}
+	for str, expected := range rates {
+		rate, err := ParseBitrate(str)
+		if err != nil || rate != expected {
+			t.Fatalf("ParseBitrate(%s) = %d, %v", str, rate, err)
+		}
+	}
+	if rate := Bitrate(1500000000); rate.String() != "1500mbit" {
+		t.Fatalf("String error: %s", rate.String())
+	}
+	if _, err := ParseBitrate("10mbps"); err == nil {
+		t.Fatalf("ParseBitrate should fail with 10mbps")
+	}
+
+	size, err := ParseByteSize("32kb")
+	if err != nil || size != 32768 || size.String() != "32kb" {
+		t.Fatalf("ParseByteSize error: %d, %v", size, err)
+	}
+	if _, err := ParseByteSize("8gb"); err == nil {
+		t.Fatalf("ParseByteSize should fail with 8gb")
+	}
+}
+
+func TestParseShaping(t *testing.T) {
+	// test case1: TBF with ingress policing
+	shaping1, err1 := ParseShaping("rate=10mbit+burst=32kb+latency=40ms+ingress-rate=1mbit")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if shaping1.Rate != 10000000 || shaping1.Burst != 32768 ||
+		shaping1.Latency != 40*time.Millisecond || shaping1.IngressRate != 1000000 {
+		t.Fatalf("Parse error: %+v", shaping1)
+	}
+	if shaping1.String() != "rate 10mbit burst 32kb latency 40ms ingress-rate 1mbit ingress-burst 10kb" {
+		t.Fatalf("String error: %s", shaping1.String())
+	}
+
+	// test case2: HTB with default burst
+	shaping2, err2 := ParseShaping("rate=100mbit+ceil=1gbit")
+	if err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+	if shaping2.String() != "rate 100mbit burst 125000b ceil 1gbit" {
+		t.Fatalf("String error: %s", shaping2.String())
+	}
+
+	// test case3: invalid settings
+	invalids := []string{
+		"burst=32kb",
+		"rate=10mbit+ceil=1mbit",
+		"rate=10mbit+ceil=20mbit+latency=50ms",
+		"ingress-burst=32kb+rate=10mbit",
+		"ingress-rate=100gbit",
+		"rate=fast",
+		"peakrate=10mbit",
+	}
+	for _, str := range invalids {
+		if _, err3 := ParseShaping(str); err3 == nil {
+			t.Fatalf("Parse should fail with %s", str)
+		}
+	}
+}
+
+func TestTBFLatency(t *testing.T) {
+	tests := []struct {
+		rate         uint64
+		limit, burst uint32
+		want         time.Duration
+	}{
+		{1250000, 62500 + 40000, 40000, 50 * time.Millisecond},
+		{1250000, 40000, 40000, 0},
+		// limit < burst must not underflow
+		{1250000, 1000, 40000, 0},
+		{0, 62500, 40000, 0},
+	}
+	for i, test := range tests {
+		got := tbfLatency(test.rate, test.limit, test.burst)
+		if got != test.want {
+			t.Errorf("case%d: got %v, want %v", i+1, got, test.want)
+		}
+	}
+}
+
+func TestDelIngressQdisc(t *testing.T) {
+	netns := newTestNS(t)
+	err := netns.Do(func(_ ns.NetNS) error {
+		links := map[string]netlink.Link{}
+		for _, name := range []string{"src", "dst"} {
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: name},
+				PeerName:  name + "-peer",
+			})
+			if err != nil {
+				t.Skipf("failed to add veth link: %v", err)
+			}
+			if links[name], err = netlink.LinkByName(name); err != nil {
+				t.Fatalf("LinkByName error: %v", err)
+			}
+		}
+		hasQdisc := func() bool {
+			qdiscs, err := netlink.QdiscList(links["src"])
+			if err != nil {
+				t.Fatalf("QdiscList error: %v", err)
+			}
+			for _, q := range qdiscs {
+				if _, ok := q.(*netlink.Ingress); ok {
+					return true
+				}
+			}
+			return false
+		}
+
+		// test case1: no ingress qdisc
+		if removed, err := delIngressQdisc(newJournal(), links["src"]); err != nil || !removed {
+			t.Fatalf("case1: removed %v, err %v", removed, err)
+		}
+
+		if _, err := addIngressQdisc(newJournal(), links["src"]); err != nil {
+			t.Skipf("failed to add ingress qdisc: %v", err)
+		}
+		parent := netlink.MakeHandle(0xffff, 0)
+		foreign := mirrorFilters(nil, links["src"], parent, links["dst"])[0]
+		foreign.Attrs().Priority = 0xc000
+		if err := netlink.FilterAdd(foreign); err != nil {
+			t.Skipf("failed to add u32 filter: %v", err)
+		}
+		// test case2: filters of others remain, qdisc is kept
+		if removed, err := delIngressQdisc(newJournal(), links["src"]); err != nil || removed || !hasQdisc() {
+			t.Fatalf("case2: removed %v, err %v", removed, err)
+		}
+
+		if err := netlink.FilterDel(foreign); err != nil {
+			t.Fatalf("FilterDel error: %v", err)
+		}
+		// test case3: qdisc is removed, and restored by rollback
+		j := newJournal()
+		if removed, err := delIngressQdisc(j, links["src"]); err != nil || !removed || hasQdisc() {
+			t.Fatalf("case3: removed %v, err %v", removed, err)
+		}
+		j.rollback()
+		if !hasQdisc() {
+			t.Fatalf("case3: qdisc is not restored")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("netns error: %v", err)
+	}
+}
+
+func TestDelIngressPolicer(t *testing.T) {
+	netns := newTestNS(t)
+	err := netns.Do(func(_ ns.NetNS) error {
+		err := netlink.LinkAdd(&netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "veth0"},
+			PeerName:  "veth1",
+		})
+		if err != nil {
+			t.Skipf("failed to add veth link: %v", err)
+		}
+		link, err := netlink.LinkByName("veth0")
+		if err != nil {
+			t.Fatalf("LinkByName error: %v", err)
+		}
+		// test case1: filter which is not policer is kept
+		if _, err = addIngressQdisc(newJournal(), link); err != nil {
+			t.Skipf("failed to add ingress qdisc: %v", err)
+		}
+		parent := netlink.MakeHandle(0xffff, 0)
+		mirror := mirrorFilters(nil, link, parent, link)[0]
+		mirror.Attrs().Priority = 0xc000
+		if err = netlink.FilterAdd(mirror); err != nil {
+			t.Skipf("failed to add u32 filter: %v", err)
+		}
+		if err = delIngressPolicer(newJournal(), link, 0xc000); err != nil {
+			t.Fatalf("delIngressPolicer error: %v", err)
+		}
+		if filters, err := netlink.FilterList(link, parent); err != nil || len(filters) != 1 {
+			t.Fatalf("case1: filters %v, err %v", filters, err)
+		}
+
+		// policer of others, and the one of koko
+		foreign := &Shaping{IngressRate: 10000000}
+		if err = foreign.addIngressPolicer(newJournal(), link); err != nil {
+			t.Skipf("failed to add ingress policer: %v", err)
+		}
+		shaping := &Shaping{IngressRate: 1000000}
+		if err = shaping.addIngressPolicer(newJournal(), link); err != nil {
+			t.Fatalf("addIngressPolicer error: %v", err)
+		}
+		prios := func() (prios []uint16) {
+			filters, err := ingressPolicers(link)
+			if err != nil {
+				t.Fatalf("ingressPolicers error: %v", err)
+			}
+			for _, filter := range filters {
+				prios = append(prios, filter.Priority)
+			}
+			return prios
+		}
+
+		// test case2: without record, no policer is deleted
+		if err = delIngressPolicer(newJournal(), link, 0); err != nil {
+			t.Fatalf("delIngressPolicer error: %v", err)
+		}
+		if p := prios(); len(p) != 2 {
+			t.Fatalf("case2: policers %v", p)
+		}
+
+		// test case3: only recorded one is deleted, and restored by rollback
+		j := newJournal()
+		if err = delIngressPolicer(j, link, shaping.IngressPrio); err != nil {
+			t.Fatalf("delIngressPolicer error: %v", err)
+		}
+		if p := prios(); len(p) != 1 || p[0] != foreign.IngressPrio {
+			t.Fatalf("case3: policers %v", p)
+		}
+		j.rollback()
+		if p := prios(); len(p) != 2 {
+			t.Fatalf("case3: policers %v after rollback", p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("netns error: %v", err)
+	}
+}
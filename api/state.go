@@ -0,0 +1,375 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultStateDir is the directory where koko command keeps its state.
+const DefaultStateDir = "/var/lib/koko"
+
+var (
+	// StateDir is the directory to keep links which koko created. If it
+	// is empty, links are not recorded.
+	StateDir string
+)
+
+// LinkRecord is a structure to describe a link which koko created.
+type LinkRecord struct {
+	ID        string     `json:"id"`
+	Type      string     `json:"type"` // veth, vxlan, geneve, gre, vlan, macvlan, macvtap, ipvlan or hub
+	Created   time.Time  `json:"created"`
+	Endpoints []VEth     `json:"endpoints"` // the link (and its peer, for veth)
+	VxLan     *VxLan     `json:"vxlan,omitempty"`
+	Geneve    *Geneve    `json:"geneve,omitempty"`
+	Gre       *Gre       `json:"gre,omitempty"`
+	VLan      *VLan      `json:"vlan,omitempty"`
+	MacVLan   *MacVLan   `json:"macvlan,omitempty"`
+	MacVTap   *MacVTap   `json:"macvtap,omitempty"`
+	Tap       *TapDevice `json:"tap,omitempty"` // character device of macvtap
+	IPVLan    *IPVLan    `json:"ipvlan,omitempty"`
+	Hub       *Hub       `json:"hub,omitempty"`
+}
+
+// MarshalJSON encodes VEth with IP addresses in CIDR notation and MAC
+// address in string.
+func (veth VEth) MarshalJSON() ([]byte, error) {
+	type vethAlias VEth
+	addrs := []string{}
+	for _, addr := range veth.IPAddr {
+		addrs = append(addrs, addr.String())
+	}
+	return json.Marshal(struct {
+		vethAlias
+		IPAddr       []string
+		HardwareAddr string `json:",omitempty"`
+	}{vethAlias(veth), addrs, veth.HardwareAddr.String()})
+}
+
+// UnmarshalJSON decodes VEth encoded by MarshalJSON. MirrorIngress and
+// MirrorEgress in records of older koko are decoded as mirror sessions.
+func (veth *VEth) UnmarshalJSON(data []byte) error {
+	type vethAlias VEth
+	v := struct {
+		*vethAlias
+		IPAddr        []string
+		HardwareAddr  string
+		MirrorIngress string
+		MirrorEgress  string
+	}{vethAlias: (*vethAlias)(veth)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.MirrorIngress != "" {
+		veth.Mirrors = append(veth.Mirrors,
+			Mirror{Source: v.MirrorIngress, Direction: "ingress"})
+	}
+	if v.MirrorEgress != "" {
+		veth.Mirrors = append(veth.Mirrors,
+			Mirror{Source: v.MirrorEgress, Direction: "egress"})
+	}
+	veth.HardwareAddr = nil
+	if v.HardwareAddr != "" {
+		mac, err := net.ParseMAC(v.HardwareAddr)
+		if err != nil {
+			return fmt.Errorf("failed to parse MAC addr %s: %v",
+				v.HardwareAddr, err)
+		}
+		veth.HardwareAddr = mac
+	}
+	veth.IPAddr = nil
+	for _, addr := range v.IPAddr {
+		ip, mask, err := net.ParseCIDR(addr)
+		if err != nil {
+			return fmt.Errorf("failed to parse IP addr %s: %v", addr, err)
+		}
+		veth.IPAddr = append(veth.IPAddr, net.IPNet{IP: ip, Mask: mask.Mask})
+	}
+	return nil
+}
+
+// newLinkID generates random ID for LinkRecord.
+func newLinkID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%012x", time.Now().UnixNano()&0xffffffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+// lockState creates StateDir and takes its file lock. Callers need to call
+// returned unlock function.
+func lockState() (unlock func(), err error) {
+	if err = os.MkdirAll(StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", StateDir, err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(StateDir, "links.lock"),
+		os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state lock: %v", err)
+	}
+	return flockState(lock, syscall.LOCK_EX)
+}
+
+// rlockState takes shared file lock of StateDir for reading, without
+// creating it. If nothing is recorded yet (i.e. no lock file), it does
+// not lock anything.
+func rlockState() (unlock func(), err error) {
+	lock, err := os.Open(filepath.Join(StateDir, "links.lock"))
+	if os.IsNotExist(err) {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state lock: %v", err)
+	}
+	return flockState(lock, syscall.LOCK_SH)
+}
+
+// flockState takes given file lock of opened lock file.
+func flockState(lock *os.File, how int) (unlock func(), err error) {
+	if err = syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock state: %v", err)
+	}
+	return func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+	}, nil
+}
+
+// readStateFile decodes given file in StateDir into v. v is untouched if
+// the file does not exist.
+func readStateFile(name string, v interface{}) error {
+	stateFile := filepath.Join(StateDir, name)
+	data, err := os.ReadFile(stateFile)
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", stateFile, err)
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("failed to read %s: %v", stateFile, err)
+	}
+	return nil
+}
+
+// writeStateFile encodes v into given file in StateDir.
+func writeStateFile(name string, v interface{}) error {
+	stateFile := filepath.Join(StateDir, name)
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := stateFile + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmpFile, err)
+	}
+	return os.Rename(tmpFile, stateFile)
+}
+
+// updateState loads recorded links from StateDir under file lock and
+// calls fn with them. If fn returns true, the links are written back.
+func updateState(fn func(records []LinkRecord) ([]LinkRecord, bool)) error {
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	records := []LinkRecord{}
+	if err = readStateFile("links.json", &records); err != nil {
+		return err
+	}
+
+	records, changed := fn(records)
+	if !changed {
+		return nil
+	}
+	return writeStateFile("links.json", records)
+}
+
+// readState loads recorded links from StateDir under shared file lock.
+// Missing StateDir or state file is treated as no link.
+func readState() ([]LinkRecord, error) {
+	unlock, err := rlockState()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	records := []LinkRecord{}
+	if err = readStateFile("links.json", &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// recordLink adds given link into state. It does nothing if StateDir is
+// not set.
+func recordLink(record LinkRecord) {
+	if StateDir == "" {
+		return
+	}
+	if record.ID == "" {
+		record.ID = newLinkID()
+	}
+	record.Created = time.Now()
+
+	err := updateState(func(records []LinkRecord) ([]LinkRecord, bool) {
+		return append(records, record), true
+	})
+	if err != nil {
+		logger.Warnf("koko: failed to record link %s: %v",
+			record.Endpoints[0].LinkName, err)
+	}
+}
+
+// handOverMirrorQdisc records that the qdisc which the mirror session of
+// veth created is owned by another session from the same source, so that
+// the qdisc is removed with the last session.
+func handOverMirrorQdisc(veth *VEth, mirror *Mirror) {
+	if StateDir == "" {
+		return
+	}
+	err := updateState(func(records []LinkRecord) ([]LinkRecord, bool) {
+		for i := range records {
+			for k := range records[i].Endpoints {
+				other := &records[i].Endpoints[k]
+				if other.NsName != veth.NsName || other.LinkName == veth.LinkName {
+					continue
+				}
+				for m := range other.Mirrors {
+					session := &other.Mirrors[m]
+					if session.Source == mirror.Source &&
+						session.Direction == mirror.Direction &&
+						session.Filters != nil {
+						session.Filters.QdiscCreated = true
+						return records, true
+					}
+				}
+			}
+		}
+		return records, false
+	})
+	if err != nil {
+		logger.Warnf("koko: failed to hand over %s qdisc of %s: %v",
+			mirror.Direction, mirror.Source, err)
+	}
+}
+
+// forgetLink removes the record which has given interface from state.
+func forgetLink(nsName, linkName string) error {
+	if StateDir == "" {
+		return nil
+	}
+	return updateState(func(records []LinkRecord) ([]LinkRecord, bool) {
+		for i, record := range records {
+			if record.hasEndpoint(nsName, linkName) {
+				return append(records[:i], records[i+1:]...), true
+			}
+		}
+		return records, false
+	})
+}
+
+// updateEndpointRecord calls fn with the record of given interface to
+// update it. It does nothing if StateDir is not set or the interface is
+// not recorded.
+func updateEndpointRecord(nsName, linkName string, fn func(veth *VEth)) error {
+	if StateDir == "" {
+		return nil
+	}
+	return updateState(func(records []LinkRecord) ([]LinkRecord, bool) {
+		for i := range records {
+			for k, veth := range records[i].Endpoints {
+				if veth.NsName == nsName && veth.LinkName == linkName {
+					fn(&records[i].Endpoints[k])
+					return records, true
+				}
+			}
+		}
+		return records, false
+	})
+}
+
+// hasEndpoint returns true if the record has given interface.
+func (record *LinkRecord) hasEndpoint(nsName, linkName string) bool {
+	for _, veth := range record.Endpoints {
+		if veth.NsName == nsName && veth.LinkName == linkName {
+			return true
+		}
+	}
+	return false
+}
+
+// findLink finds the record which has given interface. It returns nil if
+// it is not found.
+func findLink(nsName, linkName string) (found *LinkRecord, err error) {
+	if StateDir == "" {
+		return nil, nil
+	}
+	records, err := readState()
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		if records[i].hasEndpoint(nsName, linkName) {
+			found = &records[i]
+		}
+	}
+	return found, nil
+}
+
+// ListLinks returns all links recorded in StateDir.
+func ListLinks() ([]LinkRecord, error) {
+	if StateDir == "" {
+		return nil, fmt.Errorf("state directory is not set")
+	}
+	return readState()
+}
+
+// GetLink returns the link recorded by given ID. Unique prefix of the ID
+// is also accepted.
+func GetLink(id string) (link LinkRecord, err error) {
+	links, err := ListLinks()
+	if err != nil {
+		return link, err
+	}
+
+	found := 0
+	for _, record := range links {
+		if record.ID == id {
+			return record, nil
+		}
+		if id != "" && strings.HasPrefix(record.ID, id) {
+			link = record
+			found++
+		}
+	}
+	switch found {
+	case 0:
+		return link, fmt.Errorf("no such link: %s", id)
+	case 1:
+		return link, nil
+	}
+	return link, fmt.Errorf("link ID %s is ambiguous", id)
+}
+
+// DeleteLink removes the link recorded by given ID and its record.
+func DeleteLink(id string) error {
+	link, err := GetLink(id)
+	if err != nil {
+		return err
+	}
+	logger.Infof("koko: remove %s link %s", link.Type, link.ID)
+	return removeVeths(link.Endpoints)
+}
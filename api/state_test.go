@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkRecord(t *testing.T) {
+	StateDir = t.TempDir()
+	defer func() { StateDir = "" }()
+
+	_, ipnet, _ := net.ParseCIDR("192.168.1.0/24")
+	veth1 := VEth{
+		NsName:   "/var/run/netns/testns1",
+		LinkName: "link1",
+		IPAddr:   []net.IPNet{*ipnet},
+		Mirrors: []Mirror{{
+			Source:    "eth0",
+			Direction: "ingress",
+			Filters: &MirrorFilters{
+				Prios:        []uint16{49151, 49152},
+				QdiscCreated: true,
+			},
+		}},
+	}
+	veth2 := VEth{LinkName: "link2"}
+
+	// test case1: record and find links
+	recordLink(LinkRecord{ID: "0123456789ab", Type: "veth",
+		Endpoints: []VEth{veth1, veth2}})
+	recordLink(LinkRecord{ID: "0123ffffffff", Type: "vlan",
+		Endpoints: []VEth{{LinkName: "vlan100"}}, VLan: &VLan{"eth0", 100}})
+
+	links, err := ListLinks()
+	if err != nil {
+		t.Fatalf("ListLinks error: %v", err)
+	}
+	if len(links) != 2 {
+		t.Fatalf("ListLinks returns %d links, should be 2", len(links))
+	}
+	if !links[0].Endpoints[0].IPAddr[0].IP.Equal(ipnet.IP) {
+		t.Fatalf("recorded IPAddr %v should be %v",
+			links[0].Endpoints[0].IPAddr, ipnet)
+	}
+
+	if mirrors := links[0].Endpoints[0].Mirrors; len(mirrors) != 1 ||
+		mirrors[0].Filters == nil || len(mirrors[0].Filters.Prios) != 2 ||
+		!mirrors[0].Filters.QdiscCreated {
+		t.Fatalf("recorded Mirrors %+v", mirrors)
+	}
+
+	found, err := findLink("", "link2")
+	if err != nil || found == nil || found.ID != "0123456789ab" {
+		t.Fatalf("findLink error: %v %v", found, err)
+	}
+
+	// test case2: get link by ID prefix
+	if _, err = GetLink("0123"); err == nil {
+		t.Fatalf("GetLink should fail with ambiguous ID")
+	}
+	link, err := GetLink("0123f")
+	if err != nil || link.VLan.ID != 100 {
+		t.Fatalf("GetLink error: %v %v", link, err)
+	}
+
+	// test case3: forget link
+	if err = forgetLink("/var/run/netns/testns1", "link1"); err != nil {
+		t.Fatalf("forgetLink error: %v", err)
+	}
+	if links, _ = ListLinks(); len(links) != 1 || links[0].Type != "vlan" {
+		t.Fatalf("forgetLink error: %v", links)
+	}
+}
+
+func TestVEthJSON(t *testing.T) {
+	str := `{"NsName":"","LinkName":"link1","IPAddr":["2001:db8::1/64"],
+		"Neighbors":[{"IP":"2001:db8::2","MAC":"02:00:00:00:00:02"}],
+		"MirrorIngress":"eth0"}`
+	veth := VEth{}
+
+	if err := json.Unmarshal([]byte(str), &veth); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if veth.IPAddr[0].String() != "2001:db8::1/64" {
+		t.Fatalf("IPAddr %v should be 2001:db8::1/64", veth.IPAddr[0])
+	}
+	// MirrorIngress of older records is a mirror session
+	if len(veth.Mirrors) != 1 || veth.Mirrors[0].Source != "eth0" ||
+		veth.Mirrors[0].Direction != "ingress" {
+		t.Fatalf("Mirrors %+v should be ingress from eth0", veth.Mirrors)
+	}
+
+	data, err := json.Marshal(veth)
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+	veth2 := VEth{}
+	if err = json.Unmarshal(data, &veth2); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if veth2.LinkName != "link1" || veth2.IPAddr[0].String() != "2001:db8::1/64" ||
+		len(veth2.Neighbors) != 1 || len(veth2.Mirrors) != 1 ||
+		veth2.Neighbors[0].MAC.String() != "02:00:00:00:00:02" {
+		t.Fatalf("Marshal error: %s", data)
+	}
+}
+
+func TestHandOverMirrorQdisc(t *testing.T) {
+	StateDir = t.TempDir()
+	defer func() { StateDir = "" }()
+
+	mirror := func(direction string, created bool) Mirror {
+		return Mirror{Source: "eth0", Direction: direction,
+			Filters: &MirrorFilters{Prios: []uint16{49152}, QdiscCreated: created}}
+	}
+	veth1 := VEth{NsName: "/var/run/netns/testns1", LinkName: "link1",
+		Mirrors: []Mirror{mirror("ingress", true)}}
+	veth3 := VEth{NsName: "/var/run/netns/testns1", LinkName: "link3",
+		Mirrors: []Mirror{mirror("egress", false), mirror("ingress", false)}}
+	veth5 := VEth{NsName: "/var/run/netns/testns2", LinkName: "link5",
+		Mirrors: []Mirror{mirror("ingress", false)}}
+	recordLink(LinkRecord{Type: "veth", Endpoints: []VEth{veth5, {LinkName: "link6"}}})
+	recordLink(LinkRecord{Type: "veth", Endpoints: []VEth{veth1, {LinkName: "link2"}}})
+	recordLink(LinkRecord{Type: "veth", Endpoints: []VEth{veth3, {LinkName: "link4"}}})
+
+	// test case1: session of same source and direction takes over the qdisc
+	handOverMirrorQdisc(&veth1, &veth1.Mirrors[0])
+	found, err := findLink("/var/run/netns/testns1", "link3")
+	if err != nil || found == nil {
+		t.Fatalf("findLink error: %v %v", found, err)
+	}
+	mirrors := found.Endpoints[0].Mirrors
+	if !mirrors[1].Filters.QdiscCreated {
+		t.Fatalf("qdisc should be handed over to link3: %+v", mirrors[1].Filters)
+	}
+	if mirrors[0].Filters.QdiscCreated {
+		t.Fatalf("egress session should not take over ingress qdisc: %+v",
+			mirrors[0].Filters)
+	}
+
+	// test case2: session in other namespace is not touched
+	found, err = findLink("/var/run/netns/testns2", "link5")
+	if err != nil || found == nil {
+		t.Fatalf("findLink error: %v %v", found, err)
+	}
+	if found.Endpoints[0].Mirrors[0].Filters.QdiscCreated {
+		t.Fatalf("qdisc should not be handed over to link5: %+v",
+			found.Endpoints[0].Mirrors[0].Filters)
+	}
+
+	// test case3: without other session, nothing changes
+	veth7 := VEth{NsName: "/var/run/netns/testns3", LinkName: "link7",
+		Mirrors: []Mirror{mirror("ingress", true)}}
+	handOverMirrorQdisc(&veth7, &veth7.Mirrors[0])
+	records, err := ListLinks()
+	if err != nil || len(records) != 3 {
+		t.Fatalf("ListLinks error: %v %v", records, err)
+	}
+}
+
+func TestReadState(t *testing.T) {
+	StateDir = filepath.Join(t.TempDir(), "koko")
+	defer func() { StateDir = "" }()
+
+	// test case1: missing StateDir is no link, and it is not created
+	links, err := ListLinks()
+	if err != nil || len(links) != 0 {
+		t.Fatalf("ListLinks error: %v %v", links, err)
+	}
+	if found, err := findLink("", "link1"); err != nil || found != nil {
+		t.Fatalf("findLink error: %v %v", found, err)
+	}
+	if _, err = os.Stat(StateDir); !os.IsNotExist(err) {
+		t.Fatalf("%s should not be created: %v", StateDir, err)
+	}
+
+	// test case2: reading does not block other readers
+	recordLink(LinkRecord{Type: "veth", Endpoints: []VEth{{LinkName: "link1"}}})
+	unlock, err := rlockState()
+	if err != nil {
+		t.Fatalf("rlockState error: %v", err)
+	}
+	defer unlock()
+	if found, err := findLink("", "link1"); err != nil || found == nil {
+		t.Fatalf("findLink error: %v %v", found, err)
+	}
+}
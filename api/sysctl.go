@@ -0,0 +1,65 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SysctlLinkName is the placeholder of sysctl keys in VEth.Sysctls, which
+// is replaced with the interface name (e.g. 'net.ipv4.conf.{link}.rp_filter').
+const SysctlLinkName = "{link}"
+
+// sysctlName returns sysctl name of given key for the interface. In dotted
+// form, dots in the interface name (e.g. 'eth0.100') are written as slashes.
+func sysctlName(key, linkName string) string {
+	if i := strings.IndexAny(key, "./"); i >= 0 && key[i] == '.' {
+		linkName = strings.Replace(linkName, ".", "/", -1)
+	}
+	return strings.Replace(key, SysctlLinkName, linkName, -1)
+}
+
+// ParseSysctl parses sysctl setting in '<key>=<value>', where key is in
+// dotted (e.g. 'net.ipv4.ip_forward') or slash form (e.g.
+// 'net/ipv4/ip_forward').
+func ParseSysctl(s string) (key, value string, err error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return "", "", fmt.Errorf("invalid sysctl %q (should be <key>=<value>)", s)
+	}
+	if err = validateSysctlKey(kv[0]); err != nil {
+		return "", "", err
+	}
+	return kv[0], kv[1], nil
+}
+
+// validateSysctlKey checks that given key stays under /proc/sys.
+func validateSysctlKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "..") {
+		return fmt.Errorf("invalid sysctl key %q", key)
+	}
+	return nil
+}
+
+// setSysctls applies sysctl settings of veth, in current namespace. Keys
+// with SysctlLinkName are for the interface, others are for the namespace.
+// Namespace-wide values are kept when the interface is removed.
+func (veth *VEth) setSysctls(j *journal) error {
+	keys := []string{}
+	for key := range veth.Sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := validateSysctlKey(key); err != nil {
+			return err
+		}
+		name := sysctlName(key, veth.LinkName)
+		if err := setSysctl(j, name, veth.Sysctls[key]); err != nil {
+			return fmt.Errorf("failed to set %s to %s: %v",
+				name, veth.Sysctls[key], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+)
+
+func TestSysctlName(t *testing.T) {
+	// test case1: dotted form with VLAN interface name
+	name1 := sysctlName("net.ipv4.conf.{link}.rp_filter", "eth0.100")
+	if name1 != "net.ipv4.conf.eth0/100.rp_filter" {
+		t.Fatalf("sysctlName error: %s", name1)
+	}
+
+	// test case2: slash form and namespace-wide key
+	name2 := sysctlName("net/ipv6/conf/{link}/accept_ra", "eth0.100")
+	if name2 != "net/ipv6/conf/eth0.100/accept_ra" {
+		t.Fatalf("sysctlName error: %s", name2)
+	}
+	if name3 := sysctlName("net.ipv4.ip_forward", "eth0"); name3 != "net.ipv4.ip_forward" {
+		t.Fatalf("sysctlName error: %s", name3)
+	}
+}
+
+func TestParseSysctl(t *testing.T) {
+	// test case1: value with '='
+	key1, value1, err1 := ParseSysctl("net.ipv4.conf.{link}.rp_filter=a=b")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if key1 != "net.ipv4.conf.{link}.rp_filter" || value1 != "a=b" {
+		t.Fatalf("Parse error: %s %s", key1, value1)
+	}
+
+	// test case2: invalid settings
+	invalids := []string{
+		"net.ipv4.ip_forward",
+		"=1",
+		"/proc/sys/net/ipv4/ip_forward=1",
+		"net/../../etc/passwd=1",
+	}
+	for _, str := range invalids {
+		if _, _, err2 := ParseSysctl(str); err2 == nil {
+			t.Fatalf("Parse should fail with %s", str)
+		}
+	}
+}
+
+func TestSetStableSecret(t *testing.T) {
+	netns := newTestNS(t)
+	err := netns.Do(func(_ ns.NetNS) error {
+		err := netlink.LinkAdd(&netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "veth0"},
+			PeerName:  "veth1",
+		})
+		if err != nil {
+			t.Skipf("failed to add veth link: %v", err)
+		}
+		name := sysctlName("net.ipv6.conf.{link}.stable_secret", "veth0")
+		if _, err := sysctl.Sysctl(name); err == nil {
+			t.Skip("stable_secret is set by default")
+		}
+
+		// test case1: unset one is set, and the journal notes it is left
+		j := newJournal()
+		secret := GenerateStableSecret("netns:ns1", "veth0")
+		if err := setStableSecret(j, name, secret); err != nil {
+			t.Skipf("failed to set stable_secret: %v", err)
+		}
+		if value, err := sysctl.Sysctl(name); err != nil || !net.ParseIP(value).Equal(net.ParseIP(secret)) {
+			t.Fatalf("case1: stable_secret %q, err %v", value, err)
+		}
+		if len(j.actions) != 1 || j.actions[0].desc != "leave "+name+" (kernel cannot unset it)" {
+			t.Fatalf("case1: journal %v", j.actions)
+		}
+
+		// test case2: set one is kept and not journaled
+		j2 := newJournal()
+		if err := setStableSecret(j2, name, GenerateStableSecret("netns:ns2", "veth0")); err != nil {
+			t.Fatalf("case2: setStableSecret error: %v", err)
+		}
+		if value, err := sysctl.Sysctl(name); err != nil || !net.ParseIP(value).Equal(net.ParseIP(secret)) {
+			t.Fatalf("case2: stable_secret %q, err %v", value, err)
+		}
+		if len(j2.actions) != 0 {
+			t.Fatalf("case2: journal %v", j2.actions)
+		}
+		j.rollback()
+		j2.release()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("netns error: %v", err)
+	}
+}
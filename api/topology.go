@@ -0,0 +1,793 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"gopkg.in/yaml.v2"
+)
+
+// Topology is a structure to describe endpoints and links, which koko
+// creates/destroys at once. It is usually given as YAML (or JSON) file.
+type Topology struct {
+	Endpoints []TopologyEndpoint `yaml:"endpoints"`
+	Links     []TopologyLink     `yaml:"links"`
+}
+
+// TopologyEndpoint is a structure to describe a network namespace which
+// links in topology refer by its name.
+type TopologyEndpoint struct {
+	Name   string `yaml:"name"`   // endpoint name, referred from links
+	Type   string `yaml:"type"`   // docker, crio, netns, pid, path or current
+	Target string `yaml:"target"` // container ID/name, netns name, pid or path
+}
+
+// TopologyInterface is a structure to describe an interface of a link
+// in topology.
+type TopologyInterface struct {
+	Endpoint           string            `yaml:"endpoint"`             // endpoint name (empty: current namespace)
+	Name               string            `yaml:"name"`                 // interface name
+	IPAddr             []string          `yaml:"ipaddr"`               // (optional) <IP addr>/<prefixlen> or "auto" (veth only)
+	MAC                string            `yaml:"mac"`                  // (optional) MAC addr or "auto"
+	MTU                int               `yaml:"mtu"`                  // (optional) interface MTU
+	Routes             []TopologyRoute   `yaml:"routes"`               // (optional) static routes via the interface
+	VRF                string            `yaml:"vrf"`                  // (optional) VRF which the interface is enslaved to
+	VRFTable           uint32            `yaml:"vrf-table"`            // (optional) routing table of the VRF (required to create it)
+	Rules              []TopologyRule    `yaml:"rules"`                // (optional) policy routing rules in the namespace
+	Neighbors          []TopologyNeigh   `yaml:"neighbors"`            // (optional) static neighbor (ARP/ND) entries
+	PeerNeighbors      bool              `yaml:"peer-neighbors"`       // (optional) add neighbor entries of the peer (veth only)
+	IPv6               *IPv6Settings     `yaml:"ipv6"`                 // (optional) IPv6 settings of the interface
+	Sysctls            map[string]string `yaml:"sysctls"`              // (optional) sysctl settings ("{link}" is the interface)
+	Netem              *Netem            `yaml:"netem"`                // (optional) impairment by netem at egress
+	Shaping            *Shaping          `yaml:"shaping"`              // (optional) bandwidth shaping (egress) and policing (ingress)
+	MirrorIngress      string            `yaml:"mirror-ingress"`       // (optional) source interface for ingress mirror
+	MirrorEgress       string            `yaml:"mirror-egress"`        // (optional) source interface for egress mirror
+	MirrorIngressMatch []string          `yaml:"mirror-ingress-match"` // (optional) criteria of ingress mirrored packets (e.g. "tcp,dport=443")
+	MirrorEgressMatch  []string          `yaml:"mirror-egress-match"`  // (optional) criteria of egress mirrored packets
+	Mirrors            []TopologyMirror  `yaml:"mirrors"`              // (optional) mirror sessions to the interface
+	AccessVlan         int               `yaml:"vlan"`                 // (optional) access VLAN ID of the hub port (hub only)
+	TrunkVlans         []int             `yaml:"trunk"`                // (optional) trunk VLAN IDs of the hub port (hub only)
+}
+
+// TopologyMirror is a structure to describe a mirror session to an
+// interface in topology.
+type TopologyMirror struct {
+	Source    string   `yaml:"source"`    // source interface in the endpoint
+	Direction string   `yaml:"direction"` // ingress, egress or both
+	Match     []string `yaml:"match"`     // (optional) criteria of mirrored packets (e.g. "tcp,dport=443")
+}
+
+// TopologyRoute is a structure to describe a static route of an interface
+// in topology.
+type TopologyRoute struct {
+	Dst    string `yaml:"dst"`    // <IP addr>/<prefixlen> (empty: default route)
+	Via    string `yaml:"via"`    // (optional) gateway address
+	Metric int    `yaml:"metric"` // (optional) metric of the route
+	Table  int    `yaml:"table"`  // (optional) routing table ID
+	Src    string `yaml:"src"`    // (optional) preferred source address
+}
+
+// TopologyRule is a structure to describe a policy routing rule of an
+// interface in topology.
+type TopologyRule struct {
+	From     string `yaml:"from"`     // (optional) <IP addr>/<prefixlen>
+	To       string `yaml:"to"`       // (optional) <IP addr>/<prefixlen>
+	FwMark   uint32 `yaml:"fwmark"`   // (optional) firewall mark
+	Iif      string `yaml:"iif"`      // (optional) input interface
+	Table    int    `yaml:"table"`    // routing table ID (empty: table of the VRF)
+	Priority int    `yaml:"priority"` // (optional) priority of the rule
+}
+
+// TopologyNeigh is a structure to describe a static neighbor entry of an
+// interface in topology.
+type TopologyNeigh struct {
+	IP  string `yaml:"ip"`  // IPv4/v6 address
+	MAC string `yaml:"mac"` // MAC address of the IP address
+}
+
+// TopologyLink is a structure to describe a link in topology.
+type TopologyLink struct {
+	Type           string              `yaml:"type"`            // veth, vxlan, geneve, gre, vlan, macvlan, macvtap, ipvlan or hub
+	Interfaces     []TopologyInterface `yaml:"interfaces"`      // two for veth, members for hub, otherwise one
+	Parent         string              `yaml:"parent"`          // parent interface (vxlan multicast, gre, vlan, macvlan, macvtap, ipvlan)
+	Bridge         string              `yaml:"bridge"`          // hub bridge name
+	BridgeEndpoint string              `yaml:"bridge-endpoint"` // (optional) endpoint of the hub bridge
+	ID             int                 `yaml:"id"`              // VxLan/Geneve ID, Gre key or VLan ID
+	Remote         string              `yaml:"remote"`          // VxLan/Geneve/Gre destination address (or VxLan multicast group)
+	Local          string              `yaml:"local"`           // (optional) VxLan/Gre local address
+	Port           int                 `yaml:"port"`            // (optional) VxLan/Geneve UDP port
+	MTU            int                 `yaml:"mtu"`             // (optional) tunnel interface MTU
+	Mode           string              `yaml:"mode"`            // MacVLan, MacVTap, IPVLan or Gre mode
+	Flag           string              `yaml:"flag"`            // (optional) IPVLan flag
+	Erspan         *Erspan             `yaml:"erspan"`          // (optional) ERSPAN settings of gre in erspan/ip6erspan mode
+}
+
+// ipvlanModes is the list of ipvlan modes which topology accepts.
+var ipvlanModes = map[string]netlink.IPVlanMode{
+	"l2":  netlink.IPVLAN_MODE_L2,
+	"l3":  netlink.IPVLAN_MODE_L3,
+	"l3s": netlink.IPVLAN_MODE_L3S,
+}
+
+// ipvlanFlags is the list of ipvlan flags which topology accepts.
+var ipvlanFlags = map[string]netlink.IPVlanFlag{
+	"":        netlink.IPVLAN_FLAG_BRIDGE,
+	"bridge":  netlink.IPVLAN_FLAG_BRIDGE,
+	"private": netlink.IPVLAN_FLAG_PRIVATE,
+	"vepa":    netlink.IPVLAN_FLAG_VEPA,
+}
+
+// greModes is the list of gre modes which topology accepts.
+var greModes = map[string]bool{
+	"":          true,
+	"gre":       true,
+	"gretap":    true,
+	"ip6gre":    true,
+	"ip6gretap": true,
+	"erspan":    true,
+	"ip6erspan": true,
+}
+
+// macvlanModes is the list of macvlan/macvtap modes which topology accepts.
+var macvlanModes = map[string]netlink.MacvlanMode{
+	"default":  netlink.MACVLAN_MODE_DEFAULT,
+	"private":  netlink.MACVLAN_MODE_PRIVATE,
+	"vepa":     netlink.MACVLAN_MODE_VEPA,
+	"bridge":   netlink.MACVLAN_MODE_BRIDGE,
+	"passthru": netlink.MACVLAN_MODE_PASSTHRU,
+}
+
+// GetEndpointNS retrieves network namespace path of given endpoint type
+// (docker, crio, netns, pid, path or current) and its target.
+func GetEndpointNS(endpointType, target string) (namespace string, err error) {
+	switch endpointType {
+	case "docker":
+		return GetDockerContainerNS("", target)
+	case "crio":
+		runtimeClient, runtimeConn, err := GetCrioRuntimeClient()
+		if err != nil {
+			return "", err
+		}
+		defer CloseCrioConnection(runtimeConn)
+		return GetCrioContainerNS(runtimeClient, "", target)
+	case "netns":
+		return fmt.Sprintf("/var/run/netns/%s", target), nil
+	case "pid":
+		return fmt.Sprintf("/proc/%s/ns/net", target), nil
+	case "path":
+		return target, nil
+	case "current", "":
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown endpoint type: %s", endpointType)
+}
+
+// EndpointKey returns the identifier of an endpoint by its type and target
+// as given by user (e.g. "docker:<container name>"). Unlike namespace path,
+// it does not change when the container is restarted, hence it is used to
+// generate MAC address.
+func EndpointKey(endpointType, target string) string {
+	if endpointType == "current" || endpointType == "" {
+		return ""
+	}
+	return endpointType + ":" + target
+}
+
+// LoadTopology reads topology file (YAML or JSON) given as path.
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return ParseTopology(data)
+}
+
+// ParseTopology parses topology (YAML or JSON) and validates it.
+func ParseTopology(data []byte) (*Topology, error) {
+	topo := &Topology{}
+	if err := yaml.UnmarshalStrict(data, topo); err != nil {
+		return nil, fmt.Errorf("failed to parse topology: %v", err)
+	}
+	if err := topo.validate(); err != nil {
+		return nil, err
+	}
+	return topo, nil
+}
+
+// validate checks references among endpoints and links.
+func (topo *Topology) validate() error {
+	endpoints := map[string]bool{}
+	for _, ep := range topo.Endpoints {
+		if ep.Name == "" {
+			return fmt.Errorf("endpoint without name")
+		}
+		if endpoints[ep.Name] {
+			return fmt.Errorf("duplicated endpoint %s", ep.Name)
+		}
+		switch ep.Type {
+		case "docker", "crio", "netns", "pid", "path":
+			if ep.Target == "" {
+				return fmt.Errorf("endpoint %s has no target", ep.Name)
+			}
+		case "current":
+		default:
+			return fmt.Errorf("endpoint %s has unknown type: %s",
+				ep.Name, ep.Type)
+		}
+		endpoints[ep.Name] = true
+	}
+
+	for i, link := range topo.Links {
+		numIF := 1
+		switch link.Type {
+		case "veth":
+			numIF = 2
+		case "vxlan", "geneve":
+			if net.ParseIP(link.Remote) == nil {
+				return fmt.Errorf("link %d: invalid %s remote %q",
+					i, link.Type, link.Remote)
+			}
+			if link.Local != "" && net.ParseIP(link.Local) == nil {
+				return fmt.Errorf("link %d: invalid %s local %q",
+					i, link.Type, link.Local)
+			}
+		case "gre":
+			if net.ParseIP(link.Remote) == nil {
+				return fmt.Errorf("link %d: invalid gre remote %q",
+					i, link.Remote)
+			}
+			if link.Local != "" && net.ParseIP(link.Local) == nil {
+				return fmt.Errorf("link %d: invalid gre local %q",
+					i, link.Local)
+			}
+			if !greModes[strings.ToLower(link.Mode)] {
+				return fmt.Errorf("link %d: unknown gre mode %q",
+					i, link.Mode)
+			}
+			if link.Erspan != nil {
+				if !isErspanMode(strings.ToLower(link.Mode)) {
+					return fmt.Errorf("link %d: erspan needs erspan mode", i)
+				}
+				if err := link.Erspan.Validate(); err != nil {
+					return fmt.Errorf("link %d: %v", i, err)
+				}
+			}
+			if isErspanMode(strings.ToLower(link.Mode)) && link.ID > erspanMaxSession {
+				return fmt.Errorf("link %d: invalid erspan session %d",
+					i, link.ID)
+			}
+		case "vlan":
+		case "hub":
+			if link.Bridge == "" {
+				return fmt.Errorf("link %d: hub needs bridge", i)
+			}
+			if link.BridgeEndpoint != "" && !endpoints[link.BridgeEndpoint] {
+				return fmt.Errorf("link %d: unknown endpoint %s",
+					i, link.BridgeEndpoint)
+			}
+			if len(link.Interfaces) == 0 {
+				return fmt.Errorf("link %d: hub needs member interface(s)", i)
+			}
+			numIF = len(link.Interfaces)
+		case "macvlan", "macvtap":
+			if _, ok := macvlanModes[strings.ToLower(link.Mode)]; !ok {
+				return fmt.Errorf("link %d: unknown %s mode %q",
+					i, link.Type, link.Mode)
+			}
+		case "ipvlan":
+			if _, ok := ipvlanModes[strings.ToLower(link.Mode)]; !ok {
+				return fmt.Errorf("link %d: unknown ipvlan mode %q",
+					i, link.Mode)
+			}
+			if _, ok := ipvlanFlags[strings.ToLower(link.Flag)]; !ok {
+				return fmt.Errorf("link %d: unknown ipvlan flag %q",
+					i, link.Flag)
+			}
+		default:
+			return fmt.Errorf("link %d: unknown link type: %s",
+				i, link.Type)
+		}
+		needParent := link.Type != "veth" && link.Type != "geneve" &&
+			link.Type != "gre" && link.Type != "hub"
+		if link.Type == "vxlan" {
+			// unicast remote is routed without parent
+			needParent = net.ParseIP(link.Remote).IsMulticast()
+		}
+		if needParent && link.Parent == "" {
+			return fmt.Errorf("link %d: %s needs parent interface",
+				i, link.Type)
+		}
+		if len(link.Interfaces) != numIF {
+			return fmt.Errorf("link %d: %s needs %d interface(s)",
+				i, link.Type, numIF)
+		}
+		if link.Type == "veth" && link.Interfaces[0].MTU != 0 &&
+			link.Interfaces[1].MTU != 0 &&
+			link.Interfaces[0].MTU != link.Interfaces[1].MTU {
+			return fmt.Errorf("link %d: MTU of veth ends differ", i)
+		}
+		for _, intf := range link.Interfaces {
+			if intf.Endpoint != "" && !endpoints[intf.Endpoint] {
+				return fmt.Errorf("link %d: unknown endpoint %s",
+					i, intf.Endpoint)
+			}
+			if intf.Name == "" {
+				return fmt.Errorf("link %d: interface without name", i)
+			}
+			if intf.MTU < 0 {
+				return fmt.Errorf("link %d: invalid MTU %d", i, intf.MTU)
+			}
+			for _, addr := range intf.IPAddr {
+				if addr == "auto" && link.Type == "veth" {
+					continue
+				}
+				if _, _, err := net.ParseCIDR(addr); err != nil {
+					return fmt.Errorf("link %d: failed to parse IP addr %s: %v",
+						i, addr, err)
+				}
+			}
+			for _, r := range intf.Routes {
+				if _, err := r.toRoute(); err != nil {
+					return fmt.Errorf("link %d: %v", i, err)
+				}
+			}
+			for _, r := range intf.Rules {
+				if _, err := r.toRule(); err != nil {
+					return fmt.Errorf("link %d: %v", i, err)
+				}
+			}
+			for _, n := range intf.Neighbors {
+				if _, err := NewNeighEntry(n.IP, n.MAC); err != nil {
+					return fmt.Errorf("link %d: %v", i, err)
+				}
+			}
+			if intf.PeerNeighbors && link.Type != "veth" {
+				return fmt.Errorf("link %d: peer-neighbors is for veth", i)
+			}
+			if intf.IPv6 != nil {
+				if err := intf.IPv6.Validate(); err != nil {
+					return fmt.Errorf("link %d: %v", i, err)
+				}
+			}
+			if intf.Shaping != nil {
+				if err := intf.Shaping.Validate(); err != nil {
+					return fmt.Errorf("link %d: %v", i, err)
+				}
+			}
+			if intf.Netem != nil {
+				if err := intf.Netem.Validate(); err != nil {
+					return fmt.Errorf("link %d: %v", i, err)
+				}
+			}
+			for key := range intf.Sysctls {
+				if err := validateSysctlKey(key); err != nil {
+					return fmt.Errorf("link %d: %v", i, err)
+				}
+			}
+			for _, m := range intf.mirrors() {
+				if _, err := m.toMirrors(); err != nil {
+					return fmt.Errorf("link %d: %v", i, err)
+				}
+			}
+			if intf.VRFTable != 0 && intf.VRF == "" {
+				return fmt.Errorf("link %d: vrf-table without vrf", i)
+			}
+			if (intf.AccessVlan != 0 || len(intf.TrunkVlans) != 0) &&
+				link.Type != "hub" {
+				return fmt.Errorf("link %d: vlan/trunk is for hub", i)
+			}
+			if err := validatePortVlan(intf.AccessVlan, intf.TrunkVlans); err != nil {
+				return fmt.Errorf("link %d: %v", i, err)
+			}
+		}
+	}
+
+	_, err := topo.order()
+	return err
+}
+
+// ifKey returns unique key of given interface name in the namespace of
+// given endpoint name.
+func (topo *Topology) ifKey(endpoint, name string) string {
+	for _, ep := range topo.Endpoints {
+		if ep.Name == endpoint && ep.Type == "current" {
+			endpoint = ""
+		}
+	}
+	return endpoint + "/" + name
+}
+
+// order returns indexes of links in the order to create them. A link which
+// uses other link as parent interface or mirror source comes after it.
+func (topo *Topology) order() ([]int, error) {
+	creator := map[string]int{}
+	for i, link := range topo.Links {
+		for _, intf := range link.Interfaces {
+			creator[topo.ifKey(intf.Endpoint, intf.Name)] = i
+		}
+	}
+
+	deps := make([][]int, len(topo.Links))
+	for i, link := range topo.Links {
+		refs := []string{}
+		if link.Parent != "" {
+			refs = append(refs, topo.ifKey("", link.Parent))
+		}
+		for _, intf := range link.Interfaces {
+			for _, m := range intf.mirrors() {
+				refs = append(refs, topo.ifKey(intf.Endpoint, m.Source))
+			}
+		}
+		for _, ref := range refs {
+			if j, ok := creator[ref]; ok && j != i {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+
+	done := make([]bool, len(topo.Links))
+	order := []int{}
+	for len(order) < len(topo.Links) {
+		progress := false
+		for i := range topo.Links {
+			if done[i] {
+				continue
+			}
+			ready := true
+			for _, j := range deps[i] {
+				if !done[j] {
+					ready = false
+				}
+			}
+			if ready {
+				done[i] = true
+				order = append(order, i)
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, fmt.Errorf("links have circular dependency")
+		}
+	}
+	return order, nil
+}
+
+// topologyNS is the namespace of an endpoint in topology.
+type topologyNS struct {
+	nsName string // namespace path
+	key    string // endpoint key (see EndpointKey)
+}
+
+// resolveEndpoints returns a map from endpoint name to its namespace.
+func (topo *Topology) resolveEndpoints() (map[string]topologyNS, error) {
+	namespaces := map[string]topologyNS{"": {}}
+	for _, ep := range topo.Endpoints {
+		nsName, err := GetEndpointNS(ep.Type, ep.Target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get namespace of %s: %v",
+				ep.Name, err)
+		}
+		namespaces[ep.Name] = topologyNS{
+			nsName: nsName,
+			key:    EndpointKey(ep.Type, ep.Target),
+		}
+	}
+	return namespaces, nil
+}
+
+// mirrors returns mirror sessions of the interface, including the ones by
+// mirror-ingress and mirror-egress.
+func (intf *TopologyInterface) mirrors() []TopologyMirror {
+	mirrors := []TopologyMirror{}
+	if intf.MirrorIngress != "" || len(intf.MirrorIngressMatch) != 0 {
+		mirrors = append(mirrors, TopologyMirror{
+			Source:    intf.MirrorIngress,
+			Direction: "ingress",
+			Match:     intf.MirrorIngressMatch,
+		})
+	}
+	if intf.MirrorEgress != "" || len(intf.MirrorEgressMatch) != 0 {
+		mirrors = append(mirrors, TopologyMirror{
+			Source:    intf.MirrorEgress,
+			Direction: "egress",
+			Match:     intf.MirrorEgressMatch,
+		})
+	}
+	return append(mirrors, intf.Mirrors...)
+}
+
+// toMirrors converts mirror session in topology into Mirror.
+func (m *TopologyMirror) toMirrors() ([]Mirror, error) {
+	var matches []MirrorMatch
+	for _, spec := range m.Match {
+		match, err := ParseMirrorMatch(spec)
+		if err != nil {
+			return nil, fmt.Errorf("mirror match %q: %v", spec, err)
+		}
+		matches = append(matches, match)
+	}
+	return NewMirrors(m.Direction, m.Source, matches)
+}
+
+// toRoute converts route in topology into Route.
+func (r *TopologyRoute) toRoute() (Route, error) {
+	dst := r.Dst
+	if dst == "" {
+		dst = "default"
+	}
+	return NewRoute(dst, r.Via, r.Src, r.Metric, r.Table)
+}
+
+// toRule converts rule in topology into Rule.
+func (r *TopologyRule) toRule() (Rule, error) {
+	return NewRule(r.From, r.To, r.Iif, r.FwMark, r.Table, r.Priority)
+}
+
+// toVEth converts interface in topology into VEth.
+func (intf *TopologyInterface) toVEth(namespaces map[string]topologyNS) (veth VEth, err error) {
+	veth.NsName = namespaces[intf.Endpoint].nsName
+	veth.LinkName = intf.Name
+	for _, m := range intf.mirrors() {
+		mirrors, err := m.toMirrors()
+		if err != nil {
+			return veth, err
+		}
+		veth.Mirrors = append(veth.Mirrors, mirrors...)
+	}
+	for _, addr := range intf.IPAddr {
+		if addr == "auto" {
+			veth.AutoAddr = true
+			continue
+		}
+		ip, mask, err := net.ParseCIDR(addr)
+		if err != nil {
+			return veth, fmt.Errorf("failed to parse IP addr %s: %v",
+				addr, err)
+		}
+		veth.IPAddr = append(veth.IPAddr, net.IPNet{IP: ip, Mask: mask.Mask})
+	}
+
+	veth.MTU = intf.MTU
+	for _, r := range intf.Routes {
+		route, err := r.toRoute()
+		if err != nil {
+			return veth, err
+		}
+		veth.Routes = append(veth.Routes, route)
+	}
+	if intf.VRF != "" {
+		veth.VRF = &VRF{Name: intf.VRF, Table: intf.VRFTable}
+	}
+	for _, r := range intf.Rules {
+		rule, err := r.toRule()
+		if err != nil {
+			return veth, err
+		}
+		veth.Rules = append(veth.Rules, rule)
+	}
+	for _, n := range intf.Neighbors {
+		entry, err := NewNeighEntry(n.IP, n.MAC)
+		if err != nil {
+			return veth, err
+		}
+		veth.Neighbors = append(veth.Neighbors, entry)
+	}
+	veth.PeerNeighbors = intf.PeerNeighbors
+	if intf.IPv6 != nil {
+		settings := *intf.IPv6
+		if settings.AddrGenMode == "stable-privacy" {
+			settings.StableSecret = GenerateStableSecret(
+				namespaces[intf.Endpoint].key, intf.Name)
+		}
+		veth.IPv6 = &settings
+	}
+	veth.Sysctls = intf.Sysctls
+	veth.Netem = intf.Netem
+	veth.Shaping = intf.Shaping
+	veth.AccessVlan = intf.AccessVlan
+	veth.TrunkVlans = intf.TrunkVlans
+
+	// endpoint key is used instead of namespace, which may change
+	// when container is re-created.
+	switch intf.MAC {
+	case "":
+	case "auto":
+		veth.HardwareAddr = GenerateHardwareAddr(
+			namespaces[intf.Endpoint].key, intf.Name)
+	default:
+		if veth.HardwareAddr, err = net.ParseMAC(intf.MAC); err != nil {
+			return veth, fmt.Errorf("failed to parse MAC addr %s: %v",
+				intf.MAC, err)
+		}
+	}
+	return veth, nil
+}
+
+// makeLink creates given link of topology.
+func (link *TopologyLink) makeLink(namespaces map[string]topologyNS) error {
+	veth1, err := link.Interfaces[0].toVEth(namespaces)
+	if err != nil {
+		return err
+	}
+
+	switch link.Type {
+	case "veth":
+		veth2, err := link.Interfaces[1].toVEth(namespaces)
+		if err != nil {
+			return err
+		}
+		return MakeVeth(veth1, veth2)
+	case "vxlan":
+		vxlan := VxLan{
+			ParentIF: link.Parent,
+			ID:       link.ID,
+			MTU:      link.MTU,
+			UDPPort:  link.Port,
+			Local:    net.ParseIP(link.Local),
+		}
+		if remote := net.ParseIP(link.Remote); remote.IsMulticast() {
+			vxlan.Group = remote
+		} else {
+			vxlan.IPAddr = remote
+		}
+		return MakeVxLan(veth1, vxlan)
+	case "geneve":
+		geneve := Geneve{
+			ID:      link.ID,
+			IPAddr:  net.ParseIP(link.Remote),
+			MTU:     link.MTU,
+			UDPPort: link.Port,
+		}
+		return MakeGeneve(veth1, geneve)
+	case "gre":
+		gre := Gre{
+			Mode:     strings.ToLower(link.Mode),
+			Local:    net.ParseIP(link.Local),
+			Remote:   net.ParseIP(link.Remote),
+			Key:      uint32(link.ID),
+			ParentIF: link.Parent,
+			MTU:      link.MTU,
+			Erspan:   link.Erspan,
+		}
+		return MakeGre(veth1, gre)
+	case "vlan":
+		vlan := VLan{
+			ParentIF: link.Parent,
+			ID:       link.ID,
+		}
+		return MakeVLan(veth1, vlan)
+	case "macvlan":
+		macvlan := MacVLan{
+			ParentIF: link.Parent,
+			Mode:     macvlanModes[strings.ToLower(link.Mode)],
+		}
+		return MakeMacVLan(veth1, macvlan)
+	case "macvtap":
+		macvtap := MacVTap{
+			ParentIF: link.Parent,
+			Mode:     macvlanModes[strings.ToLower(link.Mode)],
+		}
+		// the character device is recorded, as koko show shows
+		_, err := MakeMacVTap(veth1, macvtap)
+		return err
+	case "ipvlan":
+		ipvlan := IPVLan{
+			ParentIF: link.Parent,
+			Mode:     ipvlanModes[strings.ToLower(link.Mode)],
+			Flag:     ipvlanFlags[strings.ToLower(link.Flag)],
+		}
+		return MakeIPVLan(veth1, ipvlan)
+	case "hub":
+		members := []VEth{veth1}
+		for _, intf := range link.Interfaces[1:] {
+			veth, err := intf.toVEth(namespaces)
+			if err != nil {
+				return err
+			}
+			members = append(members, veth)
+		}
+		return MakeHub(link.hub(namespaces), members)
+	}
+	return fmt.Errorf("unknown link type: %s", link.Type)
+}
+
+// hub returns the hub of given hub link.
+func (link *TopologyLink) hub(namespaces map[string]topologyNS) Hub {
+	return Hub{Name: link.Bridge, NsName: namespaces[link.BridgeEndpoint].nsName}
+}
+
+// removeLink removes given link of topology. Peer of veth is removed by
+// kernel, hence only its mirroring is unset. If the link is recorded in
+// StateDir, the recorded endpoints (e.g. filters and qdiscs which koko
+// added for mirroring) are used instead of the topology. For hub, its
+// members in the topology are removed, and the bridge is removed if koko
+// created it and no other port remains.
+func (link *TopologyLink) removeLink(namespaces map[string]topologyNS) error {
+	if link.Type == "hub" {
+		for _, intf := range link.Interfaces {
+			veth, err := intf.toVEth(namespaces)
+			if err != nil {
+				return err
+			}
+			if err = veth.RemoveVethLink(); err != nil {
+				return err
+			}
+		}
+		return link.hub(namespaces).removeBridge()
+	}
+
+	veths := []VEth{}
+	for _, intf := range link.Interfaces {
+		veth, err := intf.toVEth(namespaces)
+		if err != nil {
+			return err
+		}
+		veths = append(veths, veth)
+	}
+
+	record, err := findLink(veths[0].NsName, veths[0].LinkName)
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		return removeVeths(record.Endpoints)
+	}
+	return removeVeths(veths)
+}
+
+// Apply creates all links in topology in dependency order. If one of them
+// fails, links created so far are removed.
+func (topo *Topology) Apply() error {
+	order, err := topo.order()
+	if err != nil {
+		return err
+	}
+	namespaces, err := topo.resolveEndpoints()
+	if err != nil {
+		return err
+	}
+
+	for n, i := range order {
+		link := topo.Links[i]
+		logger.Infof("koko: create %s link %s", link.Type, link.Interfaces[0].Name)
+		if err = link.makeLink(namespaces); err != nil {
+			for m := n - 1; m >= 0; m-- {
+				created := topo.Links[order[m]]
+				if err1 := created.removeLink(namespaces); err1 != nil {
+					logger.Errorf("failed to remove %s link %s: %v",
+						created.Type, created.Interfaces[0].Name, err1)
+				}
+			}
+			return fmt.Errorf("failed to create %s link %s: %v",
+				link.Type, link.Interfaces[0].Name, err)
+		}
+	}
+	return nil
+}
+
+// Destroy removes all links in topology in reverse dependency order. It
+// continues even if some of them fail and returns all errors.
+func (topo *Topology) Destroy() error {
+	order, err := topo.order()
+	if err != nil {
+		return err
+	}
+	namespaces, err := topo.resolveEndpoints()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for n := len(order) - 1; n >= 0; n-- {
+		link := topo.Links[order[n]]
+		if err = link.removeLink(namespaces); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove %s link %s: %v",
+				link.Type, link.Interfaces[0].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
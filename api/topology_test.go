@@ -0,0 +1,255 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseTopology(t *testing.T) {
+	// test case1: veth/vlan/vxlan, vlan uses veth as parent
+	str1 := `
+endpoints:
+  - name: c1
+    type: netns
+    target: testns1
+  - name: host
+    type: current
+links:
+  - type: vlan
+    parent: link2
+    id: 100
+    interfaces:
+      - endpoint: c1
+        name: vlan100
+  - type: veth
+    interfaces:
+      - endpoint: c1
+        name: link1
+        ipaddr: [192.168.1.1/24, "2001:db8::1/64"]
+        routes:
+          - via: 192.168.1.254
+          - dst: 10.0.0.0/8
+            via: 192.168.1.253
+            metric: 10
+        vrf: red
+        vrf-table: 10
+        rules:
+          - from: 192.168.1.0/24
+            table: 100
+        netem:
+          delay: 100ms
+          loss: 0.5
+        shaping:
+          rate: 10mbit
+          burst: 32kb
+          ingress-rate: 1000000
+      - endpoint: host
+        name: link2
+  - type: vxlan
+    parent: eth0
+    remote: 10.1.1.1
+    id: 10
+    interfaces:
+      - name: vxlan10
+        mirror-egress: link2
+        mirror-egress-match: ["tcp,dport=443", "udp+dport=53"]
+        mirrors:
+          - source: vlan100
+            direction: ingress
+`
+	topo1, err1 := ParseTopology([]byte(str1))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if len(topo1.Endpoints) != 2 || len(topo1.Links) != 3 {
+		t.Fatalf("Parse error: %d endpoints, %d links",
+			len(topo1.Endpoints), len(topo1.Links))
+	}
+	order1, _ := topo1.order()
+	if len(order1) != 3 || order1[0] != 1 {
+		t.Fatalf("order error %v should start with veth", order1)
+	}
+
+	namespaces := map[string]topologyNS{"": {},
+		"c1": {nsName: "/var/run/netns/testns1", key: "netns:testns1"}}
+	veth1, err1 := topo1.Links[1].Interfaces[0].toVEth(namespaces)
+	if err1 != nil {
+		t.Fatalf("toVEth error: %v", err1)
+	}
+	if veth1.NsName != "/var/run/netns/testns1" || len(veth1.IPAddr) != 2 ||
+		len(veth1.Routes) != 2 || veth1.Routes[1].Metric != 10 ||
+		veth1.VRF == nil || veth1.VRF.Table != 10 || len(veth1.Rules) != 1 ||
+		veth1.Netem == nil || veth1.Netem.Delay != 100*time.Millisecond ||
+		veth1.Shaping == nil || veth1.Shaping.Burst != 32768 ||
+		veth1.Shaping.IngressRate != 1000000 {
+		t.Fatalf("toVEth error: %+v", veth1)
+	}
+
+	vxlan1, err1 := topo1.Links[2].Interfaces[0].toVEth(namespaces)
+	if err1 != nil {
+		t.Fatalf("toVEth error: %v", err1)
+	}
+	if len(vxlan1.Mirrors) != 2 || len(vxlan1.Mirrors[0].Match) != 2 ||
+		vxlan1.Mirrors[0].Match[0].DstPort != 443 ||
+		vxlan1.Mirrors[1].Source != "vlan100" || vxlan1.Mirrors[1].Direction != "ingress" {
+		t.Fatalf("toVEth error: %+v", vxlan1)
+	}
+
+	// test case2: JSON, with ERSPAN
+	str2 := `{"links": [{"type": "macvlan", "parent": "eth0", "mode": "bridge",
+		"interfaces": [{"name": "macvlan0"}]},
+		{"type": "gre", "mode": "erspan", "remote": "10.1.1.1", "id": 10,
+		"erspan": {"version": 2, "dir": "egress"},
+		"interfaces": [{"name": "erspan0", "mirror-egress": "macvlan0"}]},
+		{"type": "macvtap", "parent": "eth0", "mode": "passthru",
+		"interfaces": [{"name": "macvtap0"}]},
+		{"type": "vxlan", "remote": "2001:db8::1", "id": 20,
+		"interfaces": [{"name": "vxlan20"}]}]}`
+	if _, err2 := ParseTopology([]byte(str2)); err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+
+	// test case3: invalid topologies
+	invalids := []string{
+		// unknown endpoint
+		"links: [{type: veth, interfaces: [{endpoint: c1, name: a}, {name: b}]}]",
+		// veth with one interface
+		"links: [{type: veth, interfaces: [{name: a}]}]",
+		// unknown macvlan mode
+		"links: [{type: macvlan, parent: eth0, mode: foo, interfaces: [{name: a}]}]",
+		// vxlan multicast group without parent
+		"links: [{type: vxlan, remote: 239.1.1.1, id: 10, interfaces: [{name: a}]}]",
+		// unknown macvtap mode
+		"links: [{type: macvtap, parent: eth0, mode: source, interfaces: [{name: a}]}]",
+		// macvtap without parent
+		"links: [{type: macvtap, mode: bridge, interfaces: [{name: a}]}]",
+		// unknown ipvlan mode
+		"links: [{type: ipvlan, parent: eth0, mode: l4, interfaces: [{name: a}]}]",
+		// unknown gre mode
+		"links: [{type: gre, remote: 10.1.1.1, mode: foo, interfaces: [{name: a}]}]",
+		// MTU of veth ends differ
+		"links: [{type: veth, interfaces: [{name: a, mtu: 9000}, {name: b, mtu: 1500}]}]",
+		// invalid route
+		"links: [{type: vlan, parent: eth0, interfaces: [{name: a, routes: [{dst: 10.0.0.0}]}]}]",
+		// vrf-table without vrf
+		"links: [{type: vlan, parent: eth0, interfaces: [{name: a, vrf-table: 10}]}]",
+		// auto address of vlan
+		"links: [{type: vlan, parent: eth0, interfaces: [{name: a, ipaddr: [auto]}]}]",
+		// unknown addr-gen-mode
+		"links: [{type: vlan, parent: eth0, interfaces: [{name: a, ipv6: {addr-gen-mode: foo}}]}]",
+		// reorder without delay
+		"links: [{type: vlan, parent: eth0, interfaces: [{name: a, netem: {reorder: 10}}]}]",
+		// ceil less than rate
+		"links: [{type: vlan, parent: eth0, interfaces: [{name: a, shaping: {rate: 10mbit, ceil: 1mbit}}]}]",
+		// mirror match without mirror
+		"links: [{type: vlan, parent: eth0, interfaces: [{name: a, mirror-ingress-match: [tcp]}]}]",
+		// unknown mirror direction
+		"links: [{type: vlan, parent: eth0, interfaces: [{name: a, mirrors: [{source: b, direction: in}]}]}]",
+		// port without protocol
+		"links: [{type: vlan, parent: eth0, interfaces: [{name: a, mirror-ingress: b, mirror-ingress-match: [dport=80]}]}]",
+		// erspan settings of gretap
+		"links: [{type: gre, remote: 10.1.1.1, mode: gretap, erspan: {version: 1}, interfaces: [{name: a}]}]",
+		// erspan session out of range
+		"links: [{type: gre, remote: 10.1.1.1, mode: erspan, id: 1024, interfaces: [{name: a}]}]",
+		// peer-neighbors of vlan
+		"links: [{type: vlan, parent: eth0, interfaces: [{name: a, peer-neighbors: true}]}]",
+		// unknown field
+		"links: [{type: vlan, parent: eth0, vid: 10, interfaces: [{name: a}]}]",
+		// hub without bridge
+		"links: [{type: hub, interfaces: [{name: a}]}]",
+		// hub without member
+		"links: [{type: hub, bridge: br0, interfaces: []}]",
+		// unknown endpoint of hub bridge
+		"links: [{type: hub, bridge: br0, bridge-endpoint: c1, interfaces: [{name: a}]}]",
+		// invalid VLAN ID of hub port
+		"links: [{type: hub, bridge: br0, interfaces: [{name: a, trunk: [4095]}]}]",
+		// access VLAN of veth
+		"links: [{type: veth, interfaces: [{name: a, vlan: 10}, {name: b}]}]",
+		// circular dependency
+		"links: [{type: vlan, parent: b, interfaces: [{name: a}]}, " +
+			"{type: vlan, parent: a, interfaces: [{name: b}]}]",
+	}
+	for _, str := range invalids {
+		if _, err := ParseTopology([]byte(str)); err == nil {
+			t.Fatalf("Parse should fail: %s", str)
+		}
+	}
+}
+
+func TestTopologyMAC(t *testing.T) {
+	topo, err := ParseTopology([]byte(`
+endpoints:
+  - {name: c1, type: docker, target: web}
+links:
+  - type: veth
+    interfaces:
+      - {endpoint: c1, name: eth1, mac: auto, ipv6: {addr-gen-mode: stable-privacy}}
+      - {name: veth1}
+`))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	// MAC address is the same as "-d web,eth1,mac=auto" and does not
+	// depend on the namespace path, which changes on restart
+	mac := GenerateHardwareAddr(EndpointKey("docker", "web"), "eth1")
+	secret := GenerateStableSecret(EndpointKey("docker", "web"), "eth1")
+	for _, nsName := range []string{"/proc/100/ns/net", "/proc/200/ns/net"} {
+		namespaces := map[string]topologyNS{"": {},
+			"c1": {nsName: nsName, key: EndpointKey("docker", "web")}}
+		veth, err := topo.Links[0].Interfaces[0].toVEth(namespaces)
+		if err != nil {
+			t.Fatalf("toVEth error: %v", err)
+		}
+		if !bytes.Equal(veth.HardwareAddr, mac) {
+			t.Fatalf("HardwareAddr %s should be %s", veth.HardwareAddr, mac)
+		}
+		// so does stable_secret, without changing the topology
+		if veth.IPv6 == nil || veth.IPv6.StableSecret != secret {
+			t.Fatalf("stable_secret %+v should be %s", veth.IPv6, secret)
+		}
+		if topo.Links[0].Interfaces[0].IPv6.StableSecret != "" {
+			t.Fatalf("topology is changed by toVEth")
+		}
+	}
+}
+
+func TestTopologyHub(t *testing.T) {
+	topo, err := ParseTopology([]byte(`
+endpoints:
+  - {name: c1, type: netns, target: testns1}
+  - {name: sw, type: netns, target: switch}
+links:
+  - type: hub
+    bridge: br0
+    bridge-endpoint: sw
+    interfaces:
+      - {endpoint: c1, name: eth1, ipaddr: [192.168.1.1/24], vlan: 10}
+      - {endpoint: c1, name: eth2, trunk: [10, 20]}
+`))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	namespaces := map[string]topologyNS{"": {},
+		"c1": {nsName: "/var/run/netns/testns1", key: "netns:testns1"},
+		"sw": {nsName: "/var/run/netns/switch", key: "netns:switch"}}
+	link := topo.Links[0]
+	if hub := link.hub(namespaces); hub.Name != "br0" ||
+		hub.NsName != "/var/run/netns/switch" {
+		t.Fatalf("hub error: %+v", hub)
+	}
+	veth1, err := link.Interfaces[0].toVEth(namespaces)
+	if err != nil {
+		t.Fatalf("toVEth error: %v", err)
+	}
+	veth2, err := link.Interfaces[1].toVEth(namespaces)
+	if err != nil {
+		t.Fatalf("toVEth error: %v", err)
+	}
+	if veth1.AccessVlan != 10 || len(veth1.IPAddr) != 1 ||
+		len(veth2.TrunkVlans) != 2 || veth2.TrunkVlans[1] != 20 {
+		t.Fatalf("toVEth error: %+v, %+v", veth1, veth2)
+	}
+}
@@ -0,0 +1,431 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// VRF is a structure to describe VRF device which veth is enslaved to, in
+// veth's namespace. The VRF is created if it does not exist. Members of the
+// VRFs which koko created are kept in StateDir, and the VRF is removed with
+// its last member.
+type VRF struct {
+	Name    string // VRF device name
+	Table   uint32 // routing table ID (required to create the VRF)
+	Created bool   // (set by koko) the VRF is created by koko
+}
+
+// Rule is a structure to describe policy routing rule (ip rule) in veth's
+// namespace.
+type Rule struct {
+	Priority int        // (optional) priority of the rule (0: kernel assigns)
+	Src      *net.IPNet // (optional) 'from' selector
+	Dst      *net.IPNet // (optional) 'to' selector
+	Mark     uint32     // (optional) 'fwmark' selector
+	IifName  string     // (optional) 'iif' selector
+	Table    int        // routing table ID (0: table of the VRF)
+}
+
+// String returns the rule in 'ip rule' like notation.
+func (rule Rule) String() string {
+	s := []string{}
+	if rule.Priority != 0 {
+		s = append(s, fmt.Sprintf("pref %d", rule.Priority))
+	}
+	if rule.Src != nil {
+		s = append(s, "from "+rule.Src.String())
+	}
+	if rule.Dst != nil {
+		s = append(s, "to "+rule.Dst.String())
+	}
+	if rule.Mark != 0 {
+		s = append(s, fmt.Sprintf("fwmark %#x", rule.Mark))
+	}
+	if rule.IifName != "" {
+		s = append(s, "iif "+rule.IifName)
+	}
+	s = append(s, fmt.Sprintf("table %d", rule.Table))
+	return strings.Join(s, " ")
+}
+
+// families returns address families of the rule. Rule without address
+// selectors (e.g. only fwmark or iif) is for both IPv4 and IPv6.
+func (rule Rule) families() []int {
+	for _, addr := range []*net.IPNet{rule.Src, rule.Dst} {
+		if addr == nil {
+			continue
+		}
+		if addr.IP.To4() == nil {
+			return []int{netlink.FAMILY_V6}
+		}
+		return []int{netlink.FAMILY_V4}
+	}
+	return []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+}
+
+// netlinkRules returns netlink rules of the rule, one for each address
+// family. table is used if the rule does not have its table.
+func (rule Rule) netlinkRules(table int) []*netlink.Rule {
+	nlRules := []*netlink.Rule{}
+	for _, family := range rule.families() {
+		nlRule := netlink.NewRule()
+		nlRule.Family = family
+		if rule.Priority != 0 {
+			nlRule.Priority = rule.Priority
+		}
+		nlRule.Src = rule.Src
+		nlRule.Dst = rule.Dst
+		nlRule.Mark = rule.Mark
+		nlRule.IifName = rule.IifName
+		nlRule.Table = rule.Table
+		if nlRule.Table == 0 {
+			nlRule.Table = table
+		}
+		nlRules = append(nlRules, nlRule)
+	}
+	return nlRules
+}
+
+// vrfTable returns routing table of the VRF of veth, or 0 without VRF.
+func (veth *VEth) vrfTable() int {
+	if veth.VRF == nil {
+		return 0
+	}
+	return int(veth.VRF.Table)
+}
+
+// setVRF enslaves given link to the VRF of veth, with creating the VRF if
+// it does not exist, in current namespace.
+func (veth *VEth) setVRF(j *journal, link netlink.Link) error {
+	if veth.VRF == nil {
+		return nil
+	}
+	vrf := veth.VRF
+
+	vrfLink, err := netlink.LinkByName(vrf.Name)
+	if err == nil {
+		existing, ok := vrfLink.(*netlink.Vrf)
+		if !ok {
+			return fmt.Errorf("%s is not vrf but %s",
+				vrf.Name, vrfLink.Type())
+		}
+		if vrf.Table != 0 && vrf.Table != existing.Table {
+			return fmt.Errorf("vrf %s has table %d, not %d",
+				vrf.Name, existing.Table, vrf.Table)
+		}
+		vrf.Table = existing.Table
+	} else {
+		if vrf.Table == 0 {
+			return fmt.Errorf("vrf %s needs table to create", vrf.Name)
+		}
+		logger.Infof("koko: create vrf %s (table %d)", vrf.Name, vrf.Table)
+		vrfLink = &netlink.Vrf{
+			LinkAttrs: netlink.LinkAttrs{Name: vrf.Name},
+			Table:     vrf.Table,
+		}
+		if err = netlink.LinkAdd(vrfLink); err != nil {
+			return fmt.Errorf("failed to create vrf %s: %v", vrf.Name, err)
+		}
+		j.push(fmt.Sprintf("delete vrf %s", vrf.Name), func() error {
+			return netlink.LinkDel(vrfLink)
+		})
+		if err = netlink.LinkSetUp(vrfLink); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", vrf.Name, err)
+		}
+		vrf.Created = true
+	}
+
+	if err = netlink.LinkSetMaster(link, vrfLink); err != nil {
+		return fmt.Errorf("failed to enslave %s to %s: %v",
+			veth.LinkName, vrf.Name, err)
+	}
+	j.push(fmt.Sprintf("release %s from %s", veth.LinkName, vrf.Name),
+		func() error {
+			return netlink.LinkSetNoMaster(link)
+		})
+	return veth.addVRFMember(j)
+}
+
+// vrfKey returns the key of the VRF of veth in VRF members.
+func (veth *VEth) vrfKey() string {
+	return fmt.Sprintf("%s:%s", veth.NsName, veth.VRF.Name)
+}
+
+// updateVRFMembers loads members of the VRFs which koko created (VRF key
+// -> member interfaces) from StateDir under file lock and calls fn with
+// them. If fn returns true, the members are written back.
+func updateVRFMembers(fn func(members map[string][]string) bool) error {
+	if StateDir == "" {
+		return nil
+	}
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	members := map[string][]string{}
+	if err = readStateFile("vrfs.json", &members); err != nil {
+		return err
+	}
+	if !fn(members) {
+		return nil
+	}
+	return writeStateFile("vrfs.json", members)
+}
+
+// addVRFMember records veth as a member of its VRF, if koko created the
+// VRF. It is undone by the journal.
+func (veth *VEth) addVRFMember(j *journal) error {
+	key := veth.vrfKey()
+	err := updateVRFMembers(func(members map[string][]string) bool {
+		if _, ok := members[key]; !ok && !veth.VRF.Created {
+			return false
+		}
+		members[key] = append(members[key], veth.LinkName)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record member of vrf %s: %v",
+			veth.VRF.Name, err)
+	}
+	j.push(fmt.Sprintf("forget %s as member of vrf %s", veth.LinkName,
+		veth.VRF.Name), func() error {
+		_, _, err := veth.delVRFMember()
+		return err
+	})
+	return nil
+}
+
+// delVRFMember removes veth from the members of its VRF, and returns the
+// number of remaining members. tracked is false if the VRF is not in the
+// members (e.g. koko did not create it).
+func (veth *VEth) delVRFMember() (remaining int, tracked bool, err error) {
+	key := veth.vrfKey()
+	err = updateVRFMembers(func(members map[string][]string) bool {
+		names, ok := members[key]
+		if !ok {
+			return false
+		}
+		tracked = true
+		others := []string{}
+		for _, name := range names {
+			if name != veth.LinkName {
+				others = append(others, name)
+			}
+		}
+		remaining = len(others)
+		if remaining == 0 {
+			delete(members, key)
+		} else {
+			members[key] = others
+		}
+		return true
+	})
+	return remaining, tracked, err
+}
+
+// removeVRF removes the VRF of veth when its last member which koko
+// recorded goes (or, without the record, if koko created it), and it has
+// no other interfaces, in current namespace.
+func (veth *VEth) removeVRF() error {
+	if veth.VRF == nil {
+		return nil
+	}
+	remaining, tracked, err := veth.delVRFMember()
+	if err != nil {
+		return fmt.Errorf("failed to forget member of vrf %s: %v",
+			veth.VRF.Name, err)
+	}
+	if remaining != 0 || (!tracked && !veth.VRF.Created) {
+		return nil
+	}
+	vrfLink, err := netlink.LinkByName(veth.VRF.Name)
+	if err != nil {
+		return nil
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if link.Attrs().MasterIndex == vrfLink.Attrs().Index {
+			return nil
+		}
+	}
+	logger.Infof("koko: delete vrf %s", veth.VRF.Name)
+	if err = netlink.LinkDel(vrfLink); err != nil {
+		return fmt.Errorf("failed to delete vrf %s: %v", veth.VRF.Name, err)
+	}
+	return nil
+}
+
+// addRules adds policy routing rules of veth in current namespace.
+func (veth *VEth) addRules(j *journal) error {
+	for _, rule := range veth.Rules {
+		for _, nlRule := range rule.netlinkRules(veth.vrfTable()) {
+			nlRule := nlRule
+			if nlRule.Table == 0 {
+				return fmt.Errorf("rule %s needs table", rule)
+			}
+			if err := netlink.RuleAdd(nlRule); err != nil {
+				return fmt.Errorf("failed to add rule %s: %v", rule, err)
+			}
+			j.push(fmt.Sprintf("delete rule %s", rule), func() error {
+				return netlink.RuleDel(nlRule)
+			})
+		}
+	}
+	return nil
+}
+
+// delRules removes policy routing rules of veth in current namespace.
+// Rules which are already removed are ignored.
+func (veth *VEth) delRules() error {
+	for _, rule := range veth.Rules {
+		for _, nlRule := range rule.netlinkRules(veth.vrfTable()) {
+			err := netlink.RuleDel(nlRule)
+			if err != nil && err != unix.ENOENT {
+				return fmt.Errorf("failed to delete rule %s: %v", rule, err)
+			}
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes Rule with selectors in CIDR notation.
+func (rule Rule) MarshalJSON() ([]byte, error) {
+	type ruleAlias Rule
+	v := struct {
+		ruleAlias
+		Src string `json:",omitempty"`
+		Dst string `json:",omitempty"`
+	}{ruleAlias: ruleAlias(rule)}
+	if rule.Src != nil {
+		v.Src = rule.Src.String()
+	}
+	if rule.Dst != nil {
+		v.Dst = rule.Dst.String()
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes Rule encoded by MarshalJSON.
+func (rule *Rule) UnmarshalJSON(data []byte) (err error) {
+	type ruleAlias Rule
+	v := struct {
+		*ruleAlias
+		Src string
+		Dst string
+	}{ruleAlias: (*ruleAlias)(rule)}
+	if err = json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	rule.Src, rule.Dst = nil, nil
+	if v.Src != "" {
+		if _, rule.Src, err = net.ParseCIDR(v.Src); err != nil {
+			return fmt.Errorf("failed to parse rule from %s: %v", v.Src, err)
+		}
+	}
+	if v.Dst != "" {
+		if _, rule.Dst, err = net.ParseCIDR(v.Dst); err != nil {
+			return fmt.Errorf("failed to parse rule to %s: %v", v.Dst, err)
+		}
+	}
+	return nil
+}
+
+// ParseVRF parses VRF in '<name>[+table=<table>]'.
+func ParseVRF(s string) (*VRF, error) {
+	n := strings.Split(s, "+")
+	if n[0] == "" {
+		return nil, fmt.Errorf("vrf without name")
+	}
+	vrf := &VRF{Name: n[0]}
+	for _, opt := range n[1:] {
+		if !strings.HasPrefix(opt, "table=") {
+			return nil, fmt.Errorf("unknown vrf option %q", opt)
+		}
+		table, err := strconv.ParseUint(opt[len("table="):], 10, 32)
+		if err != nil || table == 0 {
+			return nil, fmt.Errorf("invalid table %q", opt)
+		}
+		vrf.Table = uint32(table)
+	}
+	return vrf, nil
+}
+
+// ParseRule parses rule in
+// '<selector>[+<selector>...][+table=<table>][+pref=<priority>]', where
+// selector is one of 'from=<CIDR>', 'to=<CIDR>', 'fwmark=<mark>' and
+// 'iif=<interface>'.
+func ParseRule(s string) (rule Rule, err error) {
+	var from, to, iif string
+	var mark uint64
+	var table, priority int
+	for _, opt := range strings.Split(s, "+") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return rule, fmt.Errorf("invalid rule option %q", opt)
+		}
+		switch kv[0] {
+		case "from":
+			from = kv[1]
+		case "to":
+			to = kv[1]
+		case "iif":
+			iif = kv[1]
+		case "fwmark":
+			if mark, err = strconv.ParseUint(kv[1], 0, 32); err != nil {
+				return rule, fmt.Errorf("invalid fwmark %q", kv[1])
+			}
+		case "table":
+			if table, err = strconv.Atoi(kv[1]); err != nil {
+				return rule, fmt.Errorf("invalid table %q", kv[1])
+			}
+		case "pref":
+			if priority, err = strconv.Atoi(kv[1]); err != nil {
+				return rule, fmt.Errorf("invalid pref %q", kv[1])
+			}
+		default:
+			return rule, fmt.Errorf("unknown rule option %q", kv[0])
+		}
+	}
+	return NewRule(from, to, iif, uint32(mark), table, priority)
+}
+
+// NewRule creates rule from 'from'/'to' selectors in CIDR, input interface
+// (these can be empty), fwmark, table and priority.
+func NewRule(from, to, iif string, mark uint32, table, priority int) (rule Rule, err error) {
+	if from != "" {
+		if _, rule.Src, err = net.ParseCIDR(from); err != nil {
+			return rule, fmt.Errorf("failed to parse rule from %s: %v",
+				from, err)
+		}
+	}
+	if to != "" {
+		if _, rule.Dst, err = net.ParseCIDR(to); err != nil {
+			return rule, fmt.Errorf("failed to parse rule to %s: %v",
+				to, err)
+		}
+	}
+	if rule.Src != nil && rule.Dst != nil &&
+		(rule.Src.IP.To4() == nil) != (rule.Dst.IP.To4() == nil) {
+		return rule, fmt.Errorf("address family of rule from %s and to %s differ",
+			from, to)
+	}
+	if table < 0 || priority < 0 {
+		return rule, fmt.Errorf("invalid table %d/pref %d", table, priority)
+	}
+	rule.IifName = iif
+	rule.Mark = mark
+	rule.Table = table
+	rule.Priority = priority
+	return rule, nil
+}
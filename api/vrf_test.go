@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseVRF(t *testing.T) {
+	vrf1, err1 := ParseVRF("red+table=10")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if vrf1.Name != "red" || vrf1.Table != 10 || vrf1.Created {
+		t.Fatalf("Parse error: %+v", vrf1)
+	}
+
+	for _, str := range []string{"", "+table=10", "red+table=0", "red+foo=1"} {
+		if _, err2 := ParseVRF(str); err2 == nil {
+			t.Fatalf("Parse should fail with %q", str)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	// test case1: rule with selectors, encoded in JSON
+	rule1, err1 := ParseRule("from=10.0.0.0/8+iif=eth0+fwmark=0x10+table=100+pref=1000")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if rule1.String() != "pref 1000 from 10.0.0.0/8 fwmark 0x10 iif eth0 table 100" {
+		t.Fatalf("Parse error: %v", rule1)
+	}
+	data, err1 := json.Marshal(rule1)
+	if err1 != nil {
+		t.Fatalf("Marshal error: %v", err1)
+	}
+	rule2 := Rule{}
+	if err1 = json.Unmarshal(data, &rule2); err1 != nil {
+		t.Fatalf("Unmarshal error: %v", err1)
+	}
+	if rule2.String() != rule1.String() {
+		t.Fatalf("Marshal error: %s", data)
+	}
+
+	// test case2: table of VRF is used if rule does not have table
+	rule3, err3 := ParseRule("to=2001:db8::/32")
+	if err3 != nil {
+		t.Fatalf("Parse error: %v", err3)
+	}
+	nlRules := rule3.netlinkRules(10)
+	if len(nlRules) != 1 || nlRules[0].Table != 10 || nlRules[0].Priority != -1 ||
+		nlRules[0].Family != netlink.FAMILY_V6 {
+		t.Fatalf("netlinkRules error: %+v", nlRules)
+	}
+
+	// test case2-1: rule without addresses is for both families
+	rule4, err4 := ParseRule("fwmark=1+table=10")
+	if err4 != nil {
+		t.Fatalf("Parse error: %v", err4)
+	}
+	nlRules = rule4.netlinkRules(0)
+	if len(nlRules) != 2 || nlRules[0].Family != netlink.FAMILY_V4 ||
+		nlRules[1].Family != netlink.FAMILY_V6 || nlRules[1].Mark != 1 {
+		t.Fatalf("netlinkRules error: %+v", nlRules)
+	}
+
+	// test case3: invalid rules
+	invalids := []string{
+		"from=10.0.0.0",
+		"fwmark=foo",
+		"from=10.0.0.0/8+to=2001:db8::/32",
+		"oif=eth0",
+	}
+	for _, str := range invalids {
+		if _, err4 := ParseRule(str); err4 == nil {
+			t.Fatalf("Parse should fail with %q", str)
+		}
+	}
+}
+
+func TestVRFMembers(t *testing.T) {
+	StateDir = t.TempDir()
+	defer func() { StateDir = "" }()
+
+	veth1 := VEth{NsName: "/var/run/netns/testns1", LinkName: "link1",
+		VRF: &VRF{Name: "red", Table: 10, Created: true}}
+	veth2 := VEth{NsName: "/var/run/netns/testns1", LinkName: "link2",
+		VRF: &VRF{Name: "red"}}
+	veth3 := VEth{NsName: "/var/run/netns/testns1", LinkName: "link3",
+		VRF: &VRF{Name: "blue"}}
+	for _, veth := range []*VEth{&veth1, &veth2, &veth3} {
+		if err := veth.addVRFMember(newJournal()); err != nil {
+			t.Fatalf("addVRFMember error: %v", err)
+		}
+	}
+
+	// test case1: VRF is kept while the member which did not create it remains
+	if remaining, tracked, err := veth1.delVRFMember(); err != nil ||
+		remaining != 1 || !tracked {
+		t.Fatalf("delVRFMember error: %d, %v, %v", remaining, tracked, err)
+	}
+	// test case2: the last member removes the VRF
+	if remaining, tracked, err := veth2.delVRFMember(); err != nil ||
+		remaining != 0 || !tracked {
+		t.Fatalf("delVRFMember error: %d, %v, %v", remaining, tracked, err)
+	}
+	// test case3: VRF which koko did not create is not tracked
+	if _, tracked, err := veth3.delVRFMember(); err != nil || tracked {
+		t.Fatalf("delVRFMember error: %v, %v", tracked, err)
+	}
+
+	// test case4: rollback forgets the member
+	j := newJournal()
+	if err := veth1.addVRFMember(j); err != nil {
+		t.Fatalf("addVRFMember error: %v", err)
+	}
+	j.rollback()
+	if _, tracked, err := veth1.delVRFMember(); err != nil || tracked {
+		t.Fatalf("member should be forgotten by rollback: %v, %v", tracked, err)
+	}
+}
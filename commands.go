@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"github.com/mattn/go-getopt"
+	"github.com/redhat-nfvpe/koko/api"
+)
+
+// commands are koko subcommands, given as the first argument
+// (e.g. 'koko apply -f topology.yaml').
+var commands = map[string]func() error{
+	"apply":   runApply,
+	"destroy": runDestroy,
+	"list":    runList,
+	"show":    runShow,
+	"delete":  runDelete,
+	"fdb":     runFdb,
+	"neigh":   runNeigh,
+	"hub":     runHub,
+	"ipam":    runIPAM,
+	"impair":  runImpair,
+	"shape":   runShape,
+}
+
+// runCommand runs subcommand given as name. Options of the subcommand
+// are parsed by getopt from os.Args[2].
+func runCommand(name string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command: %s", name)
+	}
+	getopt.OptInd = 2
+	return cmd()
+}
+
+// parseFOption parses '-f <file>' option of subcommand and reads the file.
+// '-' means standard input.
+func parseFOption() (data []byte, err error) {
+	var path string
+
+	for {
+		c := getopt.Getopt("f:")
+		if c == getopt.EOF {
+			break
+		}
+		switch c {
+		case 'f':
+			path = getopt.OptArg
+		default:
+			return nil, fmt.Errorf("unknown option: -%c", getopt.OptOpt)
+		}
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("-f <file> is required")
+	}
+	return readFile(path)
+}
+
+// readFile reads given file. '-' means standard input.
+func readFile(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// runApply creates links described in topology file.
+func runApply() error {
+	data, err := parseFOption()
+	if err != nil {
+		return err
+	}
+	topo, err := api.ParseTopology(data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Apply topology...")
+	if err = topo.Apply(); err != nil {
+		fmt.Printf("\n")
+		return err
+	}
+	fmt.Printf("done\n")
+	return nil
+}
+
+// runDestroy removes links described in topology file.
+func runDestroy() error {
+	data, err := parseFOption()
+	if err != nil {
+		return err
+	}
+	topo, err := api.ParseTopology(data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Destroy topology...")
+	if err = topo.Destroy(); err != nil {
+		fmt.Printf("\n")
+		return err
+	}
+	fmt.Printf("done\n")
+	return nil
+}
+
+// commandArgs returns non-option arguments of subcommand.
+func commandArgs() []string {
+	return os.Args[getopt.OptInd:]
+}
+
+// endpointString returns '<namespace>:<linkname>' of given endpoint.
+func endpointString(veth api.VEth) string {
+	if veth.NsName == "" {
+		return fmt.Sprintf("(current):%s", veth.LinkName)
+	}
+	return fmt.Sprintf("%s:%s", veth.NsName, veth.LinkName)
+}
+
+// runList shows links which koko created.
+func runList() error {
+	links, err := api.ListLinks()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tTYPE\tCREATED\tENDPOINTS\n")
+	for _, link := range links {
+		endpoints := []string{}
+		for _, veth := range link.Endpoints {
+			endpoints = append(endpoints, endpointString(veth))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", link.ID, link.Type,
+			link.Created.Format("2006-01-02 15:04:05"),
+			strings.Join(endpoints, " <-> "))
+	}
+	return w.Flush()
+}
+
+// runShow shows the detail of links given as IDs.
+func runShow() error {
+	ids := commandArgs()
+	if len(ids) == 0 {
+		return fmt.Errorf("show needs link ID")
+	}
+
+	for _, id := range ids {
+		link, err := api.GetLink(id)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(link, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+	}
+	return nil
+}
+
+// runDelete removes links given as IDs.
+func runDelete() error {
+	ids := commandArgs()
+	if len(ids) == 0 {
+		return fmt.Errorf("delete needs link ID")
+	}
+
+	for _, id := range ids {
+		fmt.Printf("Delete link %s\n", id)
+		if err := api.DeleteLink(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseEndpointOption parses the option of subcommand which gives the
+// interface as link creation, i.e. -a, -c, -d, -e, -n and -p (or their
+// upper case).
+func parseEndpointOption(c int, s string) (veth api.VEth, err error) {
+	switch unicode.ToLower(rune(c)) {
+	case 'a':
+		return parseAOption(s)
+	case 'c':
+		return parseCOption(s)
+	case 'd':
+		return parseDOption(s)
+	case 'e':
+		return parseEOption(s)
+	case 'n':
+		return parseNOption(s)
+	case 'p':
+		return parsePOption(s)
+	}
+	return veth, fmt.Errorf("unknown option: -%c", c)
+}
+
+// parseEntryCommand parses arguments of fdb/neigh subcommand:
+// '{add|del} <target interface> [-f <file>] [<entry> ...]', where target
+// interface is given as link creation (e.g. '-n <netns>,<linkname>') and
+// entry is a pair of fields. Entries of arguments and file are returned
+// as lines.
+func parseEntryCommand(name string) (add bool, veth api.VEth, data []byte, err error) {
+	var path string
+	cnt := 0
+
+	if len(os.Args) < 3 {
+		return false, veth, nil, fmt.Errorf("%s needs add or del", name)
+	}
+	switch os.Args[2] {
+	case "add":
+		add = true
+	case "del":
+	default:
+		return false, veth, nil, fmt.Errorf("unknown %s command: %s",
+			name, os.Args[2])
+	}
+
+	getopt.OptInd = 3
+	for {
+		c := getopt.Getopt("a:c:d:e:f:n:p:")
+		if c == getopt.EOF {
+			break
+		}
+		switch c {
+		case 'a', 'c', 'd', 'e', 'n', 'p':
+			if veth, err = parseEndpointOption(c, getopt.OptArg); err != nil {
+				return false, veth, nil, err
+			}
+			cnt++
+		case 'f':
+			path = getopt.OptArg
+		default:
+			return false, veth, nil,
+				fmt.Errorf("unknown option: -%c", getopt.OptOpt)
+		}
+	}
+	if cnt != 1 {
+		return false, veth, nil,
+			fmt.Errorf("%s needs one target interface", name)
+	}
+
+	args := commandArgs()
+	if len(args)%2 != 0 {
+		return false, veth, nil,
+			fmt.Errorf("%s entry should be a pair: %v", name, args)
+	}
+	for i := 0; i < len(args); i += 2 {
+		data = append(data, fmt.Sprintf("%s %s\n", args[i], args[i+1])...)
+	}
+	if path != "" {
+		fileData, err := readFile(path)
+		if err != nil {
+			return false, veth, nil, err
+		}
+		data = append(data, fileData...)
+	}
+	return add, veth, data, nil
+}
+
+// runFdb adds/removes fdb entries, '<MAC addr> <remote IP addr>', of vxlan.
+func runFdb() error {
+	add, veth, data, err := parseEntryCommand("fdb")
+	if err != nil {
+		return err
+	}
+	entries, err := api.ParseFdbEntries(data)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no fdb entry is given")
+	}
+
+	if add {
+		fmt.Printf("Add %d fdb entries to %s\n", len(entries), veth.LinkName)
+		return veth.AddFdbEntries(entries)
+	}
+	fmt.Printf("Delete %d fdb entries from %s\n", len(entries), veth.LinkName)
+	return veth.DelFdbEntries(entries)
+}
+
+// runNeigh adds/removes neighbor entries, '<IP addr> <MAC addr>', of
+// vxlan for ARP/ND proxy.
+func runNeigh() error {
+	add, veth, data, err := parseEntryCommand("neigh")
+	if err != nil {
+		return err
+	}
+	entries, err := api.ParseNeighEntries(data)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no neighbor entry is given")
+	}
+
+	if add {
+		fmt.Printf("Add %d neighbor entries to %s\n", len(entries), veth.LinkName)
+		return veth.AddNeighEntries(entries)
+	}
+	fmt.Printf("Delete %d neighbor entries from %s\n", len(entries), veth.LinkName)
+	return veth.DelNeighEntries(entries)
+}
+
+// parseHubOption parses '{-b|-B} <bridge>[,<netns name>]' option of hub
+// subcommand.
+func parseHubOption(s string) (hub api.Hub, err error) {
+	n := strings.Split(s, ",")
+	if len(n) > 2 || n[0] == "" {
+		return hub, fmt.Errorf("failed to parse %s", s)
+	}
+
+	hub.Name = n[0]
+	if len(n) == 2 {
+		hub.NsName = fmt.Sprintf("/var/run/netns/%s", n[1])
+	}
+	return hub, nil
+}
+
+// runHub creates/removes hub (linux bridge) and adds/removes its members.
+// Members are given as link creation/deletion (e.g. '-n <netns>,<link>'
+// to add, '-N <netns>,<link>' to remove).
+func runHub() error {
+	var hub api.Hub
+	var err error
+	add, remove := []api.VEth{}, []api.VEth{}
+	removeHub := false
+
+	for {
+		c := getopt.Getopt("a:A:b:B:c:C:d:D:e:E:n:N:p:P:")
+		if c == getopt.EOF {
+			break
+		}
+		switch c {
+		case 'b', 'B':
+			if hub, err = parseHubOption(getopt.OptArg); err != nil {
+				return err
+			}
+			removeHub = c == 'B'
+		case 'a', 'c', 'd', 'e', 'n', 'p':
+			veth, err := parseEndpointOption(c, getopt.OptArg)
+			if err != nil {
+				return err
+			}
+			add = append(add, veth)
+		case 'A', 'C', 'D', 'E', 'N', 'P':
+			veth, err := parseEndpointOption(c, getopt.OptArg)
+			if err != nil {
+				return err
+			}
+			remove = append(remove, veth)
+		default:
+			return fmt.Errorf("unknown option: -%c", getopt.OptOpt)
+		}
+	}
+	if hub.Name == "" {
+		return fmt.Errorf("hub needs -b <bridge> or -B <bridge>")
+	}
+
+	for _, veth := range remove {
+		fmt.Printf("Remove %s from hub %s\n", veth.LinkName, hub.Name)
+		if err = hub.RemoveMember(veth); err != nil {
+			return err
+		}
+	}
+	if removeHub {
+		fmt.Printf("Delete hub %s\n", hub.Name)
+		return api.RemoveHub(hub)
+	}
+	if len(remove) == 0 || len(add) != 0 {
+		fmt.Printf("Create hub %s...", hub.Name)
+		if err = api.MakeHub(hub, add); err != nil {
+			fmt.Printf("\n")
+			return err
+		}
+		fmt.Printf("done\n")
+	}
+	return nil
+}
+
+// runIPAM sets IPAM pools given as '-p <CIDR>' options, or shows the pools
+// and allocations without options.
+func runIPAM() error {
+	pools := []string{}
+	for {
+		c := getopt.Getopt("p:")
+		if c == getopt.EOF {
+			break
+		}
+		switch c {
+		case 'p':
+			pools = append(pools, getopt.OptArg)
+		default:
+			return fmt.Errorf("unknown option: -%c", getopt.OptOpt)
+		}
+	}
+
+	if len(pools) != 0 {
+		fmt.Printf("Set IPAM pools %s\n", strings.Join(pools, ", "))
+		return api.SetIPAMPools(pools)
+	}
+
+	state, err := api.GetIPAMState()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("POOLS: %s\n", strings.Join(state.Pools, ", "))
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "SUBNET\tINTERFACE\n")
+	for _, subnet := range state.SortedAllocations() {
+		fmt.Fprintf(w, "%s\t%s\n", subnet, state.Allocations[subnet])
+	}
+	return w.Flush()
+}
+
+// parseTargetOption parses the option of subcommand which gives one
+// existing interface as link creation (e.g. '-n <netns>,<linkname>').
+func parseTargetOption(name string) (veth api.VEth, err error) {
+	cnt := 0
+	for {
+		c := getopt.Getopt("a:c:d:e:n:p:")
+		if c == getopt.EOF {
+			break
+		}
+		switch c {
+		case 'a', 'c', 'd', 'e', 'n', 'p':
+			if veth, err = parseEndpointOption(c, getopt.OptArg); err != nil {
+				return veth, err
+			}
+			cnt++
+		default:
+			return veth, fmt.Errorf("unknown option: -%c", getopt.OptOpt)
+		}
+	}
+	if cnt != 1 {
+		return veth, fmt.Errorf("%s needs one target interface", name)
+	}
+	return veth, nil
+}
+
+// runImpair changes netem settings of existing interface, given as link
+// creation (e.g. '-n <netns>,<linkname>'). Settings are given as
+// arguments (e.g. 'delay=100ms+loss=1' or 'delay=100ms loss=1'), and
+// 'off' removes the netem.
+func runImpair() error {
+	veth, err := parseTargetOption("impair")
+	if err != nil {
+		return err
+	}
+
+	args := commandArgs()
+	if len(args) == 0 {
+		return fmt.Errorf("impair needs netem settings or off")
+	}
+	if len(args) == 1 && args[0] == "off" {
+		fmt.Printf("Remove netem from %s\n", veth.LinkName)
+		return veth.SetNetem(nil)
+	}
+	netem, err := api.ParseNetem(strings.Join(args, "+"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Set netem %s to %s\n", netem.String(), veth.LinkName)
+	return veth.SetNetem(&netem)
+}
+
+// runShape changes shaping settings of existing interface, given as link
+// creation (e.g. '-n <netns>,<linkname>'). Settings are given as
+// arguments (e.g. 'rate=10mbit+ceil=100mbit'), and 'off' removes the
+// shaping. Without arguments, current shaping of the interface is shown.
+func runShape() error {
+	veth, err := parseTargetOption("shape")
+	if err != nil {
+		return err
+	}
+
+	args := commandArgs()
+	if len(args) == 0 {
+		shaping, err := veth.GetShaping()
+		if err != nil {
+			return err
+		}
+		if shaping == nil {
+			fmt.Printf("%s: no shaping\n", veth.LinkName)
+			return nil
+		}
+		fmt.Printf("%s: %s\n", veth.LinkName, shaping)
+		return nil
+	}
+	if len(args) == 1 && args[0] == "off" {
+		fmt.Printf("Remove shaping from %s\n", veth.LinkName)
+		return veth.SetShaping(nil)
+	}
+	shaping, err := api.ParseShaping(strings.Join(args, "+"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Set shaping %s to %s\n", shaping.String(), veth.LinkName)
+	return veth.SetShaping(&shaping)
+}
@@ -23,8 +23,9 @@ var Version = "master"
 var GitHash = "HEAD"
 
 // parseLinkIPOption parses '<linkname>(:<ip>/<prefix>)' syntax and put it in
-// veth object
-func parseLinkIPOption(veth *api.VEth, n []string) (err error) {
+// veth object. key identifies the endpoint (see api.EndpointKey) for
+// "mac=auto" and stable_secret of "addrgenmode=stable-privacy".
+func parseLinkIPOption(veth *api.VEth, key string, n []string) (err error) {
 	veth.LinkName = n[0]
 	numAddr := len(n) - 1
 
@@ -37,20 +38,139 @@ func parseLinkIPOption(veth *api.VEth, n []string) (err error) {
 	for i := 0; i < numAddr; i++ {
 		// check mirror
 		if (len(n[i+1]) > len("mirror:")) && (n[i+1][0:6] == "mirror") {
-			n1 := strings.Split(n[i+1], ":")
-			if len(n1) == 3 {
-				switch n1[1] {
-				case "ingress":
-					veth.MirrorIngress = n1[2]
-				case "egress":
-					veth.MirrorEgress = n1[2]
-				case "both":
-					veth.MirrorEgress = n1[2]
-					veth.MirrorIngress = n1[2]
-				}
-			} else {
+			n1 := strings.SplitN(n[i+1], ":", 4)
+			if len(n1) < 3 {
 				return fmt.Errorf("unknown mirror command: %s", n[i+1])
 			}
+			var matches []api.MirrorMatch
+			if len(n1) == 4 {
+				// match items may follow as next options
+				spec := n1[3]
+				for ; i+2 <= numAddr && api.IsMirrorMatchItem(n[i+2]); i++ {
+					spec += "," + n[i+2]
+				}
+				match, err := api.ParseMirrorMatch(spec)
+				if err != nil {
+					return fmt.Errorf("failed to parse mirror match %s: %v",
+						spec, err)
+				}
+				matches = append(matches, match)
+			}
+			mirrors, err := api.NewMirrors(n1[1], n1[2], matches)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
+			veth.Mirrors = append(veth.Mirrors, mirrors...)
+		} else if strings.HasPrefix(n[i+1], "mac=") {
+			mac := n[i+1][len("mac="):]
+			if mac == "auto" {
+				veth.HardwareAddr = api.GenerateHardwareAddr(
+					key, veth.LinkName)
+			} else if veth.HardwareAddr, err = net.ParseMAC(mac); err != nil {
+				return fmt.Errorf("failed to parse MAC addr %s: %v",
+					mac, err)
+			}
+		} else if strings.HasPrefix(n[i+1], "mtu=") {
+			veth.MTU, err = strconv.Atoi(n[i+1][len("mtu="):])
+			if err != nil || veth.MTU < 68 {
+				return fmt.Errorf("invalid MTU: %s", n[i+1])
+			}
+		} else if strings.HasPrefix(n[i+1], "route=") {
+			route, err := api.ParseRoute(n[i+1][len("route="):])
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
+			veth.Routes = append(veth.Routes, route)
+		} else if strings.HasPrefix(n[i+1], "gw=") {
+			route, err := api.ParseRoute("default+via=" + n[i+1][len("gw="):])
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
+			veth.Routes = append(veth.Routes, route)
+		} else if strings.HasPrefix(n[i+1], "vrf=") {
+			if veth.VRF, err = api.ParseVRF(n[i+1][len("vrf="):]); err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
+		} else if strings.HasPrefix(n[i+1], "rule=") {
+			rule, err := api.ParseRule(n[i+1][len("rule="):])
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
+			veth.Rules = append(veth.Rules, rule)
+		} else if strings.HasPrefix(n[i+1], "addrgenmode=") {
+			ipv6Settings(veth).AddrGenMode = n[i+1][len("addrgenmode="):]
+			if err = veth.IPv6.Validate(); err != nil {
+				return err
+			}
+		} else if strings.HasPrefix(n[i+1], "acceptdad=") {
+			v, err := strconv.Atoi(n[i+1][len("acceptdad="):])
+			if err != nil {
+				return fmt.Errorf("invalid accept_dad: %s", n[i+1])
+			}
+			ipv6Settings(veth).AcceptDAD = &v
+			if err = veth.IPv6.Validate(); err != nil {
+				return err
+			}
+		} else if strings.HasPrefix(n[i+1], "acceptra=") {
+			v, err := strconv.Atoi(n[i+1][len("acceptra="):])
+			if err != nil {
+				return fmt.Errorf("invalid accept_ra: %s", n[i+1])
+			}
+			ipv6Settings(veth).AcceptRA = &v
+			if err = veth.IPv6.Validate(); err != nil {
+				return err
+			}
+		} else if strings.HasPrefix(n[i+1], "waitdad=") {
+			wait, err := parseOnOff(n[i+1][len("waitdad="):])
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
+			ipv6Settings(veth).WaitDAD = wait
+		} else if strings.HasPrefix(n[i+1], "sysctl:") {
+			key, value, err := api.ParseSysctl(n[i+1][len("sysctl:"):])
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
+			if veth.Sysctls == nil {
+				veth.Sysctls = map[string]string{}
+			}
+			veth.Sysctls[key] = value
+		} else if strings.HasPrefix(n[i+1], "netem=") {
+			netem, err := api.ParseNetem(n[i+1][len("netem="):])
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
+			veth.Netem = &netem
+		} else if strings.HasPrefix(n[i+1], "shape=") {
+			shaping, err := api.ParseShaping(n[i+1][len("shape="):])
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
+			veth.Shaping = &shaping
+		} else if n[i+1] == "ip=auto" {
+			veth.AutoAddr = true
+		} else if n[i+1] == "neigh=peer" {
+			veth.PeerNeighbors = true
+		} else if strings.HasPrefix(n[i+1], "neigh=") {
+			kv := strings.SplitN(n[i+1][len("neigh="):], "+", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid neighbor: %s", n[i+1])
+			}
+			entry, err := api.NewNeighEntry(kv[0], kv[1])
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
+			veth.Neighbors = append(veth.Neighbors, entry)
+		} else if strings.HasPrefix(n[i+1], "vlan=") {
+			veth.AccessVlan, err = strconv.Atoi(n[i+1][len("vlan="):])
+			if err != nil || veth.AccessVlan < 1 || veth.AccessVlan > 4094 {
+				return fmt.Errorf("invalid VLAN ID: %s", n[i+1])
+			}
+		} else if strings.HasPrefix(n[i+1], "trunk=") {
+			veth.TrunkVlans, err = parseVlanList(n[i+1][len("trunk="):])
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", n[i+1], err)
+			}
 		} else { // check CIDR (ip/prefixlen)
 			ip, mask, err1 := net.ParseCIDR(n[i+1])
 			if err1 != nil {
@@ -64,13 +184,48 @@ func parseLinkIPOption(veth *api.VEth, n []string) (err error) {
 			veth.IPAddr = append(veth.IPAddr, i)
 		}
 	}
+	if veth.IPv6 != nil && veth.IPv6.AddrGenMode == "stable-privacy" {
+		veth.IPv6.StableSecret = api.GenerateStableSecret(key, veth.LinkName)
+	}
 	return
 }
 
+// ipv6Settings returns IPv6 settings of veth, with creating it if needed.
+func ipv6Settings(veth *api.VEth) *api.IPv6Settings {
+	if veth.IPv6 == nil {
+		veth.IPv6 = &api.IPv6Settings{}
+	}
+	return veth.IPv6
+}
+
+// parseVlanList parses VLAN IDs separated by ':', such as '10:20:100-110'.
+func parseVlanList(s string) (vlans []int, err error) {
+	for _, v := range strings.Split(s, ":") {
+		var low, high int
+		r := strings.SplitN(v, "-", 2)
+		if low, err = strconv.Atoi(r[0]); err != nil {
+			return nil, err
+		}
+		high = low
+		if len(r) == 2 {
+			if high, err = strconv.Atoi(r[1]); err != nil {
+				return nil, err
+			}
+		}
+		if low < 1 || high > 4094 || low > high {
+			return nil, fmt.Errorf("invalid VLAN ID: %s", v)
+		}
+		for vid := low; vid <= high; vid++ {
+			vlans = append(vlans, vid)
+		}
+	}
+	return vlans, nil
+}
+
 // parseAOption parses '-a' option and put this information in veth object.
 func parseAOption(s string) (veth api.VEth, err error) {
 	n := strings.Split(s, ",")
-	if len(n) > 4 || len(n) < 1 {
+	if len(n) < 1 {
 		err = fmt.Errorf("failed to parse %s", s)
 		return
 	}
@@ -81,7 +236,7 @@ func parseAOption(s string) (veth api.VEth, err error) {
 		os.Exit(1)
 	}
 
-	err1 := parseLinkIPOption(&veth, n[1:])
+	err1 := parseLinkIPOption(&veth, api.EndpointKey("path", n[0]), n[1:])
 	if err1 != nil {
 		fmt.Fprintf(os.Stderr, "%v", err1)
 		os.Exit(1)
@@ -93,7 +248,7 @@ func parseAOption(s string) (veth api.VEth, err error) {
 // parseNOption parses '-n' option and put this information in veth object.
 func parseNOption(s string) (veth api.VEth, err error) {
 	n := strings.Split(s, ",")
-	if len(n) > 4 || len(n) < 1 {
+	if len(n) < 1 {
 		err = fmt.Errorf("failed to parse %s", s)
 		return
 	}
@@ -104,7 +259,7 @@ func parseNOption(s string) (veth api.VEth, err error) {
 		os.Exit(1)
 	}
 
-	err1 := parseLinkIPOption(&veth, n[1:])
+	err1 := parseLinkIPOption(&veth, api.EndpointKey("netns", n[0]), n[1:])
 	if err1 != nil {
 		fmt.Fprintf(os.Stderr, "%v", err1)
 		os.Exit(1)
@@ -116,14 +271,14 @@ func parseNOption(s string) (veth api.VEth, err error) {
 // parseCOption Parses '-c' option and put this information in veth object.
 func parseCOption(s string) (veth api.VEth, err error) {
 	n := strings.Split(s, ",")
-	if len(n) > 4 || len(n) < 1 {
+	if len(n) < 1 {
 		err = fmt.Errorf("failed to parse %s", s)
 		return
 	}
 
 	veth.NsName = ""
 
-	err1 := parseLinkIPOption(&veth, n)
+	err1 := parseLinkIPOption(&veth, "", n)
 	if err1 != nil {
 		fmt.Fprintf(os.Stderr, "%v", err1)
 		os.Exit(1)
@@ -135,7 +290,7 @@ func parseCOption(s string) (veth api.VEth, err error) {
 // parseDOption Parses '-d' option and put this information in veth object.
 func parseDOption(s string) (veth api.VEth, err error) {
 	n := strings.Split(s, ",")
-	if len(n) > 4 || len(n) < 1 {
+	if len(n) < 1 {
 		err = fmt.Errorf("failed to parse %s", s)
 		return
 	}
@@ -146,7 +301,7 @@ func parseDOption(s string) (veth api.VEth, err error) {
 		os.Exit(1)
 	}
 
-	err1 := parseLinkIPOption(&veth, n[1:])
+	err1 := parseLinkIPOption(&veth, api.EndpointKey("docker", n[0]), n[1:])
 	if err1 != nil {
 		fmt.Fprintf(os.Stderr, "%v", err1)
 		os.Exit(1)
@@ -158,7 +313,7 @@ func parseDOption(s string) (veth api.VEth, err error) {
 // parseEOption Parses '-e' option and put this information in veth object.
 func parseEOption(s string) (veth api.VEth, err error) {
 	n := strings.Split(s, ",")
-	if len(n) > 4 || len(n) < 1 {
+	if len(n) < 1 {
 		err = fmt.Errorf("failed to parse %s", s)
 		return
 	}
@@ -174,7 +329,7 @@ func parseEOption(s string) (veth api.VEth, err error) {
 		os.Exit(1)
 	}
 
-	err1 := parseLinkIPOption(&veth, n[1:])
+	err1 := parseLinkIPOption(&veth, api.EndpointKey("crio", n[0]), n[1:])
 	if err1 != nil {
 		fmt.Fprintf(os.Stderr, "%v", err1)
 		os.Exit(1)
@@ -186,7 +341,7 @@ func parseEOption(s string) (veth api.VEth, err error) {
 // parsePOption Parses '-p' option and put this information in veth object.
 func parsePOption(s string) (veth api.VEth, err error) {
 	n := strings.Split(s, ",")
-	if len(n) > 4 || len(n) < 1 {
+	if len(n) < 1 {
 		err = fmt.Errorf("failed to parse %s", s)
 		return
 	}
@@ -197,7 +352,7 @@ func parsePOption(s string) (veth api.VEth, err error) {
 		os.Exit(1)
 	}
 
-	err1 := parseLinkIPOption(&veth, n[1:])
+	err1 := parseLinkIPOption(&veth, api.EndpointKey("pid", n[0]), n[1:])
 	if err1 != nil {
 		fmt.Fprintf(os.Stderr, "%v", err1)
 		os.Exit(1)
@@ -233,6 +388,73 @@ func parseMOption(s string) (macvlan api.MacVLan, err error) {
 	return
 }
 
+// parseTOption parses '-T' option and put this information in macvtap
+// object. The format is same as '-M' option.
+func parseTOption(s string) (macvtap api.MacVTap, err error) {
+
+	n := strings.Split(s, ",")
+	if len(n) != 2 {
+		err = fmt.Errorf("failed to parse %s", s)
+		return
+	}
+
+	macvtap.ParentIF = n[0]
+	switch strings.ToLower(n[1]) {
+	case "default":
+		macvtap.Mode = netlink.MACVLAN_MODE_DEFAULT
+	case "private":
+		macvtap.Mode = netlink.MACVLAN_MODE_PRIVATE
+	case "vepa":
+		macvtap.Mode = netlink.MACVLAN_MODE_VEPA
+	case "bridge":
+		macvtap.Mode = netlink.MACVLAN_MODE_BRIDGE
+	case "passthru":
+		macvtap.Mode = netlink.MACVLAN_MODE_PASSTHRU
+	default:
+		err = fmt.Errorf("unknown macvtap mode %s", n[1])
+		return
+	}
+	return
+}
+
+// parseIOption parses '-I' option and put this information in ipvlan object.
+func parseIOption(s string) (ipvlan api.IPVLan, err error) {
+
+	n := strings.Split(s, ",")
+	if len(n) != 2 && len(n) != 3 {
+		err = fmt.Errorf("failed to parse %s", s)
+		return
+	}
+
+	ipvlan.ParentIF = n[0]
+	switch strings.ToLower(n[1]) {
+	case "l2":
+		ipvlan.Mode = netlink.IPVLAN_MODE_L2
+	case "l3":
+		ipvlan.Mode = netlink.IPVLAN_MODE_L3
+	case "l3s":
+		ipvlan.Mode = netlink.IPVLAN_MODE_L3S
+	default:
+		err = fmt.Errorf("unknown ipvlan mode %s", n[1])
+		return
+	}
+
+	if len(n) == 3 {
+		switch strings.ToLower(n[2]) {
+		case "bridge":
+			ipvlan.Flag = netlink.IPVLAN_FLAG_BRIDGE
+		case "private":
+			ipvlan.Flag = netlink.IPVLAN_FLAG_PRIVATE
+		case "vepa":
+			ipvlan.Flag = netlink.IPVLAN_FLAG_VEPA
+		default:
+			err = fmt.Errorf("unknown ipvlan flag %s", n[2])
+			return
+		}
+	}
+	return
+}
+
 // parseVOption parses '-v' option and put this information in veth object.
 func parseVOption(s string) (vlan api.VLan, err error) {
 	var err2 error // if we encounter an error, it's marked here.
@@ -253,39 +475,235 @@ func parseVOption(s string) (vlan api.VLan, err error) {
 	return
 }
 
-// parseXOption parses '-x' option and put this information in veth object.
+// parseXOption parses '-x' option and put this information in vxlan object.
 func parseXOption(s string) (vxlan api.VxLan, err error) {
 	var err2 error // if we encounter an error, it's marked here.
 
 	n := strings.Split(s, ",")
-	if len(n) != 3 && len(n) != 4 && len(n) != 5 {
+	if len(n) < 3 {
 		err = fmt.Errorf("failed to parse %s", s)
 		return
 	}
 
 	vxlan.ParentIF = n[0]
-	vxlan.IPAddr = net.ParseIP(n[1])
+	if n[1] != "" {
+		ip := net.ParseIP(n[1])
+		switch {
+		case ip == nil:
+			err = fmt.Errorf("failed to parse remote IP addr %s", n[1])
+			return
+		case ip.IsMulticast():
+			vxlan.Group = ip
+		default:
+			vxlan.IPAddr = ip
+		}
+	}
 	vxlan.ID, err2 = strconv.Atoi(n[2])
 	if err2 != nil {
 		err = fmt.Errorf("failed to parse VXID %s: %v", n[2], err2)
 		return
 	}
-	if len(n) > 3 {
-		//XXX
-		for _, v := range n[3:] {
-			s := strings.Split(v, "=")
-			switch s[0] {
-			case "port":
-				vxlan.UDPPort, err2 = strconv.Atoi(s[1])
-				err2 = fmt.Errorf("failed to parse port %s: %v", s[1], err2)
-			case "mtu":
-				vxlan.MTU, err2 = strconv.Atoi(s[1])
-				err2 = fmt.Errorf("failed to parse MTU %s: %v", s[1], err2)
+
+	for _, v := range n[3:] {
+		var b bool
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("failed to parse %s", v)
+			return
+		}
+		switch kv[0] {
+		case "port":
+			vxlan.UDPPort, err2 = strconv.Atoi(kv[1])
+		case "mtu":
+			vxlan.MTU, err2 = strconv.Atoi(kv[1])
+		case "local":
+			if vxlan.Local = net.ParseIP(kv[1]); vxlan.Local == nil {
+				err2 = fmt.Errorf("invalid IP addr")
+			}
+		case "group":
+			if vxlan.Group = net.ParseIP(kv[1]); vxlan.Group == nil {
+				err2 = fmt.Errorf("invalid IP addr")
+			}
+		case "ttl":
+			vxlan.TTL, err2 = strconv.Atoi(kv[1])
+		case "tos":
+			vxlan.TOS, err2 = strconv.Atoi(kv[1])
+		case "srcport":
+			ports := strings.SplitN(kv[1], "-", 2)
+			if len(ports) != 2 {
+				err2 = fmt.Errorf("should be <low>-<high>")
+				break
 			}
+			if vxlan.PortLow, err2 = strconv.Atoi(ports[0]); err2 == nil {
+				vxlan.PortHigh, err2 = strconv.Atoi(ports[1])
+			}
+		case "udpcsum":
+			vxlan.UDPCsum, err2 = parseOnOff(kv[1])
+		case "udp6zerocsumtx":
+			vxlan.UDP6ZeroCsumTx, err2 = parseOnOff(kv[1])
+		case "udp6zerocsumrx":
+			vxlan.UDP6ZeroCsumRx, err2 = parseOnOff(kv[1])
+		case "learning":
+			b, err2 = parseOnOff(kv[1])
+			vxlan.Learning = &b
+		case "l2miss":
+			b, err2 = parseOnOff(kv[1])
+			vxlan.L2miss = &b
+		case "l3miss":
+			b, err2 = parseOnOff(kv[1])
+			vxlan.L3miss = &b
+		case "proxy":
+			vxlan.Proxy, err2 = parseOnOff(kv[1])
+		default:
+			err2 = fmt.Errorf("unknown option")
+		}
+		if err2 != nil {
+			err = fmt.Errorf("failed to parse %s: %v", v, err2)
+			return
 		}
+	}
+
+	return
+}
+
+// parseOnOff parses boolean value of 'key=value' option.
+func parseOnOff(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "on", "true", "yes", "1":
+		return true, nil
+	case "off", "false", "no", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid value %s (should be on or off)", s)
+}
+
+// parseGOption parses '-g' option and put this information in geneve object.
+func parseGOption(s string) (geneve api.Geneve, err error) {
+	var err2 error // if we encounter an error, it's marked here.
+
+	n := strings.Split(s, ",")
+	if len(n) < 2 {
+		err = fmt.Errorf("failed to parse %s", s)
+		return
+	}
+
+	if geneve.IPAddr = net.ParseIP(n[0]); geneve.IPAddr == nil {
+		err = fmt.Errorf("failed to parse remote IP addr %s", n[0])
+		return
+	}
+	geneve.ID, err2 = strconv.Atoi(n[1])
+	if err2 != nil {
+		err = fmt.Errorf("failed to parse VNI %s: %v", n[1], err2)
+		return
+	}
+
+	for _, v := range n[2:] {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("failed to parse %s", v)
+			return
+		}
+		switch kv[0] {
+		case "port":
+			geneve.UDPPort, err2 = strconv.Atoi(kv[1])
+		case "mtu":
+			geneve.MTU, err2 = strconv.Atoi(kv[1])
+		case "ttl":
+			geneve.TTL, err2 = strconv.Atoi(kv[1])
+		case "tos":
+			geneve.TOS, err2 = strconv.Atoi(kv[1])
+		case "udpcsum":
+			geneve.UDPCsum, err2 = parseOnOff(kv[1])
+		case "udp6zerocsumtx":
+			geneve.UDP6ZeroCsumTx, err2 = parseOnOff(kv[1])
+		case "udp6zerocsumrx":
+			geneve.UDP6ZeroCsumRx, err2 = parseOnOff(kv[1])
+		default:
+			err2 = fmt.Errorf("unknown option")
+		}
+		if err2 != nil {
+			err = fmt.Errorf("failed to parse %s: %v", v, err2)
+			return
+		}
+	}
+
+	return
+}
+
+// parseGreOption parses '-G' option and put this information in gre object.
+func parseGreOption(s string) (gre api.Gre, err error) {
+	var err2 error // if we encounter an error, it's marked here.
+
+	n := strings.Split(s, ",")
+	if len(n) < 2 {
+		err = fmt.Errorf("failed to parse %s", s)
+		return
+	}
+
+	switch n[0] {
+	case "gre", "gretap", "ip6gre", "ip6gretap", "erspan", "ip6erspan":
+		gre.Mode = n[0]
+	default:
+		err = fmt.Errorf("unknown gre mode %s", n[0])
+		return
+	}
+	if gre.Remote = net.ParseIP(n[1]); gre.Remote == nil {
+		err = fmt.Errorf("failed to parse remote IP addr %s", n[1])
 		return
 	}
 
+	erspan := api.Erspan{}
+	for _, v := range n[2:] {
+		var key uint64
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("failed to parse %s", v)
+			return
+		}
+		switch kv[0] {
+		case "local":
+			if gre.Local = net.ParseIP(kv[1]); gre.Local == nil {
+				err2 = fmt.Errorf("invalid IP addr")
+			}
+		case "key":
+			key, err2 = strconv.ParseUint(kv[1], 0, 32)
+			gre.Key = uint32(key)
+		case "ttl":
+			gre.TTL, err2 = strconv.Atoi(kv[1])
+		case "parent":
+			gre.ParentIF = kv[1]
+		case "mtu":
+			gre.MTU, err2 = strconv.Atoi(kv[1])
+		case "ver":
+			erspan.Version, err2 = strconv.Atoi(kv[1])
+			gre.Erspan = &erspan
+		case "index":
+			key, err2 = strconv.ParseUint(kv[1], 0, 32)
+			erspan.Index = uint32(key)
+			gre.Erspan = &erspan
+		case "dir":
+			erspan.Dir = kv[1]
+			gre.Erspan = &erspan
+		case "hwid":
+			key, err2 = strconv.ParseUint(kv[1], 0, 16)
+			erspan.HwID = uint16(key)
+			gre.Erspan = &erspan
+		default:
+			err2 = fmt.Errorf("unknown option")
+		}
+		if err2 != nil {
+			err = fmt.Errorf("failed to parse %s: %v", v, err2)
+			return
+		}
+	}
+	if gre.Erspan != nil {
+		if gre.Mode != "erspan" && gre.Mode != "ip6erspan" {
+			err = fmt.Errorf("erspan options need erspan mode")
+			return
+		}
+		err = gre.Erspan.Validate()
+	}
+
 	return
 }
 
@@ -298,6 +716,22 @@ func usage() {
 		./koko -d centos1,link1 -d centos2,link2  #without IP addr
 		./koko -d centos1,link1 -c link2
 		./koko -n /var/run/netns/test1,link1,192.168.1.1/24 <other>
+		./koko -d centos1,link1,192.168.1.1/24 -g 10.1.1.1,10 #geneve
+		./koko -d centos1,link1,192.168.1.1/24 -G gretap,10.1.1.1 #gre
+		./koko -d centos1,link1,192.168.1.1/24 -I eth0,l2,bridge #ipvlan
+		./koko -d centos1,link1 -T eth0,bridge #macvtap
+		./koko apply -f topology.yaml   #create links in topology file
+		./koko destroy -f topology.yaml #remove links in topology file
+		./koko list                     #show links which koko created
+		./koko show <id>                #show the detail of the link
+		./koko delete <id>              #remove the link
+		./koko hub -b br0 -n ns1,link1 -n ns2,link1 -n ns3,link1 #connect to bridge
+		./koko hub -B br0               #remove the members and the bridge koko created
+		./koko ipam -p 10.255.0.0/16   #set IPAM pool for 'ip=auto'
+		./koko impair -n ns1,link1 delay=100ms+loss=1 #change netem of the link
+		./koko shape -n ns1,link1 rate=10mbit #change shaping of the link
+		./koko fdb add -n ns1,vxlan10 <MAC> <remote IP>  #add vxlan fdb entry
+		./koko neigh add -n ns1,vxlan10 <IP> <MAC>       #add vxlan proxy neighbor
 
 			See https://github.com/redhat-nfvpe/koko/wiki/Examples for the detail.
 	`)
@@ -319,6 +753,62 @@ Usage:
 * case5: connect docker/linux ns container to vxlan interface
 ./koko -d centos1:link1:192.168.1.1/24 -x eth1:1.1.1.1:10
 
+* case5-1: connect docker/linux ns container to geneve interface
+./koko -d centos1:link1:192.168.1.1/24 -g 1.1.1.1,10
+
+* case5-2: connect docker/linux ns container to gre interface
+./koko -d centos1:link1:192.168.1.1/24 -G gretap,1.1.1.1,key=10
+
+* case5-3: connect docker/linux ns container to ipvlan interface
+./koko -d centos1:link1:192.168.1.1/24 -I eth1,l2,bridge
+
+* case5-4: connect docker/linux ns container to macvtap interface
+./koko -d centos1:link1 -T eth1,bridge
+
+* case5-5: connect with given/generated MAC address
+./koko -n test1,link1,mac=02:00:00:00:00:01 -n test2,link2,mac=auto
+
+* case5-6: connect with jumbo frame MTU
+./koko -n test1,link1,mtu=9000 -n test2,link2
+
+* case5-7: connect with static routes/default gateway in the namespace
+./koko -n test1,link1,192.168.1.1/24,gw=192.168.1.254,route=10.0.0.0/8+via=192.168.1.253 <other>
+
+* case5-8: connect with putting the link in VRF, with policy routing rule
+./koko -n test1,link1,192.168.1.1/24,vrf=red+table=10,rule=fwmark=1+table=10 <other>
+
+* case5-9: connect with static neighbor entries (of the peer)
+./koko -n test1,link1,192.168.1.1/24,neigh=peer -n test2,link2,192.168.1.2/24,neigh=192.168.1.1+02:00:00:00:00:01
+
+* case5-10: connect with point-to-point addresses allocated from IPAM pools
+./koko ipam -p 10.255.0.0/16 -p fd00:255::/64
+./koko -n test1,link1,ip=auto -n test2,link2
+
+* case5-11: connect with IPv6 settings, waiting for DAD
+./koko -n test1,link1,2001:db8::1/64,addrgenmode=none,waitdad=on -n test2,link2,2001:db8::2/64,acceptdad=0
+
+* case5-12: connect with sysctl settings of the interface ({link}) and the namespace
+./koko -n test1,link1,sysctl:net.ipv4.conf.{link}.rp_filter=0,sysctl:net.ipv4.ip_forward=1 <other>
+
+* case5-13: connect with impairment (delay, jitter, loss, reorder and duplication) by netem, then change it
+./koko -n test1,link1,netem=delay=100ms+jitter=10ms+loss=1 <other>
+./koko impair -n test1,link1 delay=50ms+reorder=25
+./koko impair -n test1,link1 off
+
+* case5-14: connect with bandwidth shaping (egress) and policing (ingress), then change/show it
+./koko -n test1,link1,shape=rate=10mbit+burst=32kb+latency=50ms+ingress-rate=10mbit <other>
+./koko shape -n test1,link1 rate=10mbit+ceil=100mbit
+./koko shape -n test1,link1
+
+* case5-15: connect with mirroring only HTTPS and DNS packets from eth0
+./koko -n test1,link1,mirror:ingress:eth0:tcp,dport=443,mirror:ingress:eth0:udp+dport=53 <other>
+
+* case5-16: mirror ingress of eth0 to remote collector by ERSPAN (session 10, version 2)
+./koko -n test1,link1,mirror:ingress:eth0 -G erspan,10.1.1.1,key=10,ver=2,dir=ingress
+
+* case5-17: connect with mirroring of several interfaces (eth0 ingress, eth1 both directions)
+./koko -n test1,link1,mirror:ingress:eth0,mirror:both:eth1 <other>
+
 * case6: delete docker interface
 ./koko -D centos1:link1
 * case7: delete linux ns interface
@@ -336,6 +826,25 @@ Usage:
 * case11: connect container of netns path (inode)
 ./koko -a /foo/bar:link1:192.168.1.1/24
 
+* case12: create/remove links described in topology file
+./koko apply -f topology.yaml
+./koko destroy -f topology.yaml
+
+* case13: show/remove links which koko created
+./koko list
+./koko show <id>
+./koko delete <id>
+
+* case14: add/remove static fdb/neighbor entries of vxlan
+./koko fdb add -n test1,vxlan10 00:00:00:00:00:00 10.1.1.2
+./koko fdb del -n test1,vxlan10 -f fdb.txt
+./koko neigh add -n test1,vxlan10 192.168.1.2 02:00:00:00:00:02
+
+* case15: connect containers to one segment (linux bridge)
+./koko hub -b br0 -n test1,link1,192.168.1.1/24 -n test2,link1,192.168.1.2/24
+./koko hub -b br0 -N test2,link1
+./koko hub -B br0
+
 */
 func main() {
 	var c int     // command line parameters.
@@ -346,11 +855,28 @@ func main() {
 		ModeAddVlan
 		ModeAddVxlan
 		ModeAddMacVlan
+		ModeAddIPVlan
+		ModeAddMacVtap
+		ModeAddGeneve
+		ModeAddGre
 		ModeDeleteLink
 	)
 
 	// koko command only shows error and above.
 	err = api.SetLogLevel("Error")
+	// koko command records links which it creates.
+	api.StateDir = api.DefaultStateDir
+
+	// subcommand, e.g. 'koko apply -f topology.yaml'
+	if len(os.Args) > 1 && os.Args[1] != "" && os.Args[1][0] != '-' {
+		if err = runCommand(os.Args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	cnt := 0 // Count of command line parameters.
 	// Any errors with peeling apart the command line options.
 	getopt.OptErr = 0
@@ -361,11 +887,15 @@ func main() {
 	vxlan := api.VxLan{}
 	vlan := api.VLan{}
 	macvlan := api.MacVLan{}
+	ipvlan := api.IPVLan{}
+	macvtap := api.MacVTap{}
+	geneve := api.Geneve{}
+	gre := api.Gre{}
 	mode := ModeUnspec
 
 	// Parse options and and exit if they don't meet our criteria.
 	for {
-		if c = getopt.Getopt("a:A:c:C:D:d:E:e:hM:N:n:p:P:vV:x:"); c == getopt.EOF {
+		if c = getopt.Getopt("a:A:c:C:D:d:E:e:g:G:hI:M:N:n:p:P:T:vV:x:"); c == getopt.EOF {
 			break
 		}
 		switch c {
@@ -565,6 +1095,50 @@ func main() {
 				os.Exit(1)
 			}
 
+		case 'T': // MACVTAP
+			macvtap, err = parseTOption(getopt.OptArg)
+			mode = ModeAddMacVtap
+			if err != nil {
+				fmt.Fprintf(os.Stderr,
+					"Parse failed %s!:%v",
+					getopt.OptArg, err)
+				usage()
+				os.Exit(1)
+			}
+
+		case 'I': // IPVLAN
+			ipvlan, err = parseIOption(getopt.OptArg)
+			mode = ModeAddIPVlan
+			if err != nil {
+				fmt.Fprintf(os.Stderr,
+					"Parse failed %s!:%v",
+					getopt.OptArg, err)
+				usage()
+				os.Exit(1)
+			}
+
+		case 'g': // GENEVE
+			geneve, err = parseGOption(getopt.OptArg)
+			mode = ModeAddGeneve
+			if err != nil {
+				fmt.Fprintf(os.Stderr,
+					"Parse failed %s!:%v",
+					getopt.OptArg, err)
+				usage()
+				os.Exit(1)
+			}
+
+		case 'G': // GRE
+			gre, err = parseGreOption(getopt.OptArg)
+			mode = ModeAddGre
+			if err != nil {
+				fmt.Fprintf(os.Stderr,
+					"Parse failed %s!:%v",
+					getopt.OptArg, err)
+				usage()
+				os.Exit(1)
+			}
+
 		case 'V': // VLAN
 			vlan, err = parseVOption(getopt.OptArg)
 			mode = ModeAddVlan
@@ -605,6 +1179,20 @@ func main() {
 		// case 2: one endpoint with vxlan
 		fmt.Printf("Create vxlan %s\n", veth1.LinkName)
 		api.MakeVxLan(veth1, vxlan)
+	} else if mode == ModeAddGeneve && cnt == 1 {
+		// case 2-1: one endpoint with geneve
+		fmt.Printf("Create geneve %s\n", veth1.LinkName)
+		if err := api.MakeGeneve(veth1, geneve); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	} else if mode == ModeAddGre && cnt == 1 {
+		// case 2-2: one endpoint with gre
+		fmt.Printf("Create %s %s\n", gre.Mode, veth1.LinkName)
+		if err := api.MakeGre(veth1, gre); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
 	} else if mode == ModeAddVlan && cnt == 1 {
 		// case 3: one endpoint with vlan
 		fmt.Printf("Create vlan %s\n", veth1.LinkName)
@@ -613,6 +1201,23 @@ func main() {
 		// case 4: one endpoint with vlan
 		fmt.Printf("Create macvlan %s\n", veth1.LinkName)
 		api.MakeMacVLan(veth1, macvlan)
+	} else if mode == ModeAddIPVlan && cnt == 1 {
+		// case 4-1: one endpoint with ipvlan
+		fmt.Printf("Create ipvlan %s\n", veth1.LinkName)
+		if err := api.MakeIPVLan(veth1, ipvlan); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	} else if mode == ModeAddMacVtap && cnt == 1 {
+		// case 4-2: one endpoint with macvtap
+		fmt.Printf("Create macvtap %s\n", veth1.LinkName)
+		tap, err := api.MakeMacVTap(veth1, macvtap)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("tap device: /dev/tap%d (char %d:%d)\n",
+			tap.Index, tap.Major, tap.Minor)
 	} else if mode == ModeDeleteLink && cnt == 1 {
 		fmt.Printf("Delete link %s\n", veth1.LinkName)
 		if err := veth1.RemoveVethLink(); err != nil {
@@ -5,8 +5,10 @@ import (
 	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/redhat-nfvpe/koko/api"
+	"github.com/vishvananda/netlink"
 )
 
 func TestParseLinkIPOption(t *testing.T) {
@@ -15,7 +17,7 @@ func TestParseLinkIPOption(t *testing.T) {
 	linkName1 := "testlink"
 	veth1 := api.VEth{}
 
-	err1 := parseLinkIPOption(&veth1, strings.Split(str1, ","))
+	err1 := parseLinkIPOption(&veth1, "", strings.Split(str1, ","))
 	if err1 != nil {
 		t.Fatalf("Parse error: %v", err1)
 	}
@@ -31,7 +33,7 @@ func TestParseLinkIPOption(t *testing.T) {
 	linkIP4Prefix2 := net.CIDRMask(24, 32)
 	veth2 := api.VEth{}
 
-	err2 := parseLinkIPOption(&veth2, strings.Split(str2, ","))
+	err2 := parseLinkIPOption(&veth2, "", strings.Split(str2, ","))
 	if err2 != nil {
 		t.Fatalf("Parse error: %v", err2)
 	}
@@ -57,7 +59,7 @@ func TestParseLinkIPOption(t *testing.T) {
 	linkIP6Prefix3 := net.CIDRMask(64, 128)
 	veth3 := api.VEth{}
 
-	err3 := parseLinkIPOption(&veth3, strings.Split(str3, ","))
+	err3 := parseLinkIPOption(&veth3, "", strings.Split(str3, ","))
 	if err3 != nil {
 		t.Fatalf("Parse error: %v", err3)
 	}
@@ -89,7 +91,7 @@ func TestParseLinkIPOption(t *testing.T) {
 	linkIP6Prefix4 := net.CIDRMask(64, 128)
 	veth4 := api.VEth{}
 
-	err4 := parseLinkIPOption(&veth4, strings.Split(str4, ","))
+	err4 := parseLinkIPOption(&veth4, "", strings.Split(str4, ","))
 	if err4 != nil {
 		t.Fatalf("Parse error: %v", err4)
 	}
@@ -111,7 +113,7 @@ func TestParseLinkIPOption(t *testing.T) {
 	linkName5 := "testlink"
 	veth5 := api.VEth{}
 
-	err5 := parseLinkIPOption(&veth5, strings.Split(str5, ","))
+	err5 := parseLinkIPOption(&veth5, "", strings.Split(str5, ","))
 	if err5 != nil {
 		t.Fatalf("Parse error: %v", err5)
 	}
@@ -119,9 +121,538 @@ func TestParseLinkIPOption(t *testing.T) {
 		t.Fatalf("nsName Parse error %s should be %s",
 			veth5.NsName, linkName5)
 	}
-	if veth5.MirrorIngress != "eth0" {
-		t.Fatalf("MirrorIngress Parse error %s should be %s",
-			veth5.MirrorIngress, "eth0")
+	if len(veth5.Mirrors) != 1 || veth5.Mirrors[0].Source != "eth0" ||
+		veth5.Mirrors[0].Direction != "ingress" {
+		t.Fatalf("Mirrors Parse error %+v should be ingress from %s",
+			veth5.Mirrors, "eth0")
 	}
 
 }
+
+func TestParseGOption(t *testing.T) {
+	// test case1: parse "-g 10.1.1.1,100"
+	geneve1, err1 := parseGOption("10.1.1.1,100")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if !geneve1.IPAddr.Equal(net.ParseIP("10.1.1.1")) || geneve1.ID != 100 {
+		t.Fatalf("Parse error %v should be 10.1.1.1,100", geneve1)
+	}
+
+	// test case2: parse "-g 2001:db8::1,10,port=7000,udp6zerocsumtx=on"
+	geneve2, err2 := parseGOption("2001:db8::1,10,port=7000,udp6zerocsumtx=on")
+	if err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+	if geneve2.UDPPort != 7000 || !geneve2.UDP6ZeroCsumTx || geneve2.UDPCsum {
+		t.Fatalf("Parse error %v", geneve2)
+	}
+
+	// test case3: invalid option
+	if _, err3 := parseGOption("10.1.1.1,100,udpcsum=maybe"); err3 == nil {
+		t.Fatalf("Parse should fail with udpcsum=maybe")
+	}
+}
+
+func TestParseGreOption(t *testing.T) {
+	// test case1: parse "-G gretap,10.1.1.1,key=10,parent=eth0"
+	gre1, err1 := parseGreOption("gretap,10.1.1.1,key=10,parent=eth0")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if gre1.Mode != "gretap" || !gre1.Remote.Equal(net.ParseIP("10.1.1.1")) ||
+		gre1.Key != 10 || gre1.ParentIF != "eth0" {
+		t.Fatalf("Parse error %+v", gre1)
+	}
+
+	// test case2: parse "-G ip6gre,2001:db8::2,local=2001:db8::1,ttl=64"
+	gre2, err2 := parseGreOption("ip6gre,2001:db8::2,local=2001:db8::1,ttl=64")
+	if err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+	if !gre2.Local.Equal(net.ParseIP("2001:db8::1")) || gre2.TTL != 64 {
+		t.Fatalf("Parse error %+v", gre2)
+	}
+
+	// test case3: unknown mode
+	if _, err3 := parseGreOption("vti,10.1.1.1"); err3 == nil {
+		t.Fatalf("Parse should fail with unknown mode")
+	}
+
+	// test case4: parse "-G erspan,10.1.1.1,key=10,ver=2,dir=egress,hwid=7"
+	gre4, err4 := parseGreOption("erspan,10.1.1.1,key=10,ver=2,dir=egress,hwid=7")
+	if err4 != nil {
+		t.Fatalf("Parse error: %v", err4)
+	}
+	if gre4.Mode != "erspan" || gre4.Key != 10 || gre4.Erspan == nil ||
+		gre4.Erspan.Version != 2 || gre4.Erspan.Dir != "egress" ||
+		gre4.Erspan.HwID != 7 {
+		t.Fatalf("Parse error %+v", gre4)
+	}
+
+	// test case5: erspan options need erspan mode and valid values
+	invalids := []string{
+		"gretap,10.1.1.1,ver=1",
+		"erspan,10.1.1.1,ver=3",
+		"erspan,10.1.1.1,ver=1,dir=ingress",
+		"ip6erspan,2001:db8::2,ver=2,dir=both",
+	}
+	for _, str := range invalids {
+		if _, err5 := parseGreOption(str); err5 == nil {
+			t.Fatalf("Parse should fail with %s", str)
+		}
+	}
+}
+
+func TestParseIOption(t *testing.T) {
+	// test case1: parse "-I eth0,l3s,private"
+	ipvlan1, err1 := parseIOption("eth0,l3s,private")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if ipvlan1.ParentIF != "eth0" || ipvlan1.Mode != netlink.IPVLAN_MODE_L3S ||
+		ipvlan1.Flag != netlink.IPVLAN_FLAG_PRIVATE {
+		t.Fatalf("Parse error %+v", ipvlan1)
+	}
+
+	// test case2: unknown mode and flag are rejected
+	if _, err2 := parseIOption("eth0,l4"); err2 == nil {
+		t.Fatalf("Parse should fail with unknown mode")
+	}
+	if _, err2 := parseIOption("eth0,l2,passthru"); err2 == nil {
+		t.Fatalf("Parse should fail with unknown flag")
+	}
+}
+
+func TestParseTOption(t *testing.T) {
+	// test case1: valid modes, case insensitive
+	modes := map[string]netlink.MacvlanMode{
+		"default":  netlink.MACVLAN_MODE_DEFAULT,
+		"private":  netlink.MACVLAN_MODE_PRIVATE,
+		"vepa":     netlink.MACVLAN_MODE_VEPA,
+		"Bridge":   netlink.MACVLAN_MODE_BRIDGE,
+		"passthru": netlink.MACVLAN_MODE_PASSTHRU,
+	}
+	for str, mode := range modes {
+		macvtap1, err1 := parseTOption("eth0," + str)
+		if err1 != nil {
+			t.Fatalf("Parse error: %v", err1)
+		}
+		if macvtap1.ParentIF != "eth0" || macvtap1.Mode != mode {
+			t.Fatalf("Parse error %+v", macvtap1)
+		}
+	}
+
+	// test case2: unknown mode and wrong format are rejected
+	invalids := []string{
+		"eth0,source",
+		"eth0,",
+		"eth0",
+		"eth0,bridge,private",
+	}
+	for _, str := range invalids {
+		if _, err2 := parseTOption(str); err2 == nil {
+			t.Fatalf("Parse should fail with %s", str)
+		}
+	}
+}
+
+func TestParseXOption(t *testing.T) {
+	// test case1: parse "-x eth0,10.1.1.1,10,port=8472,mtu=1400"
+	vxlan1, err1 := parseXOption("eth0,10.1.1.1,10,port=8472,mtu=1400")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if vxlan1.ParentIF != "eth0" || !vxlan1.IPAddr.Equal(net.ParseIP("10.1.1.1")) ||
+		vxlan1.ID != 10 || vxlan1.UDPPort != 8472 || vxlan1.MTU != 1400 {
+		t.Fatalf("Parse error %+v", vxlan1)
+	}
+
+	// test case2: multicast group over IPv6 with options
+	vxlan2, err2 := parseXOption(
+		"eth0,ff05::100,20,local=2001:db8::1,srcport=4000-5000,learning=off")
+	if err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+	if vxlan2.IPAddr != nil || !vxlan2.Group.Equal(net.ParseIP("ff05::100")) ||
+		!vxlan2.Local.Equal(net.ParseIP("2001:db8::1")) ||
+		vxlan2.PortLow != 4000 || vxlan2.PortHigh != 5000 {
+		t.Fatalf("Parse error %+v", vxlan2)
+	}
+	if vxlan2.Learning == nil || *vxlan2.Learning || vxlan2.L2miss != nil {
+		t.Fatalf("Parse error learning %v l2miss %v",
+			vxlan2.Learning, vxlan2.L2miss)
+	}
+
+	// test case3: invalid options
+	invalids := []string{
+		"eth0,10.1.1.1,10,port=foo",
+		"eth0,10.1.1.1,10,srcport=4000",
+		"eth0,10.1.1.1,10,foo=bar",
+		"eth0,10.1.1,10",
+	}
+	for _, str := range invalids {
+		if _, err3 := parseXOption(str); err3 == nil {
+			t.Fatalf("Parse should fail with %s", str)
+		}
+	}
+}
+
+func TestParseHubOption(t *testing.T) {
+	hub1, err1 := parseHubOption("br0,testns")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if hub1.Name != "br0" || hub1.NsName != "/var/run/netns/testns" {
+		t.Fatalf("Parse error %+v", hub1)
+	}
+
+	if _, err2 := parseHubOption(",testns"); err2 == nil {
+		t.Fatalf("Parse should fail without bridge name")
+	}
+}
+
+func TestParseVlanOption(t *testing.T) {
+	// test case1: parse "testlink,vlan=10,trunk=20:100-102"
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "",
+		strings.Split("testlink,vlan=10,trunk=20:100-102", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if veth1.AccessVlan != 10 {
+		t.Fatalf("AccessVlan Parse error %d should be 10", veth1.AccessVlan)
+	}
+	if len(veth1.TrunkVlans) != 4 || veth1.TrunkVlans[0] != 20 ||
+		veth1.TrunkVlans[3] != 102 {
+		t.Fatalf("TrunkVlans Parse error %v", veth1.TrunkVlans)
+	}
+
+	// test case2: invalid VLAN IDs
+	for _, str := range []string{"0", "4095", "10-5", "10:foo"} {
+		if _, err2 := parseVlanList(str); err2 == nil {
+			t.Fatalf("Parse should fail with %s", str)
+		}
+	}
+}
+
+func TestParseMACOption(t *testing.T) {
+	// test case1: parse "testlink,mac=02:00:00:00:00:01"
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "",
+		strings.Split("testlink,mac=02:00:00:00:00:01", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if veth1.HardwareAddr.String() != "02:00:00:00:00:01" {
+		t.Fatalf("HardwareAddr Parse error %s", veth1.HardwareAddr)
+	}
+
+	// test case2: "mac=auto" is deterministic and locally administered
+	veth2 := api.VEth{NsName: "/var/run/netns/testns"}
+	err2 := parseLinkIPOption(&veth2, api.EndpointKey("netns", "testns"),
+		strings.Split("testlink,mac=auto", ","))
+	if err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+	mac2 := api.GenerateHardwareAddr("netns:testns", "testlink")
+	if !bytes.Equal(veth2.HardwareAddr, mac2) {
+		t.Fatalf("HardwareAddr Parse error %s should be %s",
+			veth2.HardwareAddr, mac2)
+	}
+	if mac2[0]&0x03 != 0x02 {
+		t.Fatalf("%s is not locally administered unicast", mac2)
+	}
+	if bytes.Equal(mac2, api.GenerateHardwareAddr("netns:testns",
+		"testlink2")) {
+		t.Fatalf("MAC address should differ between links")
+	}
+
+	// test case2-1: docker container keeps MAC address across restart,
+	// though its namespace path (/proc/<pid>/ns/net) changes
+	key := api.EndpointKey("docker", "web")
+	veth2a := api.VEth{NsName: "/proc/100/ns/net"}
+	veth2b := api.VEth{NsName: "/proc/200/ns/net"}
+	if err2 = parseLinkIPOption(&veth2a, key, strings.Split("testlink,mac=auto", ",")); err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+	if err2 = parseLinkIPOption(&veth2b, key, strings.Split("testlink,mac=auto", ",")); err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+	if !bytes.Equal(veth2a.HardwareAddr, veth2b.HardwareAddr) ||
+		!bytes.Equal(veth2a.HardwareAddr, api.GenerateHardwareAddr("docker:web", "testlink")) {
+		t.Fatalf("MAC address should not depend on namespace path: %s, %s",
+			veth2a.HardwareAddr, veth2b.HardwareAddr)
+	}
+	if bytes.Equal(veth2a.HardwareAddr, api.GenerateHardwareAddr(
+		api.EndpointKey("pid", "100"), "testlink")) {
+		t.Fatalf("MAC address should differ between endpoints")
+	}
+
+	// test case3: invalid MAC address
+	veth3 := api.VEth{}
+	if err3 := parseLinkIPOption(&veth3, "",
+		strings.Split("testlink,mac=02:00:00", ",")); err3 == nil {
+		t.Fatalf("Parse should fail with invalid MAC address")
+	}
+}
+
+func TestParseMTUOption(t *testing.T) {
+	// test case1: parse "testlink,192.168.1.1/24,mtu=9000"
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "",
+		strings.Split("testlink,192.168.1.1/24,mtu=9000", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if veth1.MTU != 9000 || len(veth1.IPAddr) != 1 {
+		t.Fatalf("MTU Parse error %d should be 9000", veth1.MTU)
+	}
+
+	// test case2: invalid MTU
+	for _, str := range []string{"testlink,mtu=foo", "testlink,mtu=10"} {
+		veth2 := api.VEth{}
+		if err2 := parseLinkIPOption(&veth2, "", strings.Split(str, ",")); err2 == nil {
+			t.Fatalf("Parse should fail with %s", str)
+		}
+	}
+}
+
+func TestTunnelMTU(t *testing.T) {
+	// test case1: parse tunnel MTU of "-g" and "-G"
+	geneve1, err1 := parseGOption("10.1.1.1,100,mtu=1400")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	gre1, err1 := parseGreOption("gretap,10.1.1.1,mtu=1400")
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if geneve1.MTU != 1400 || gre1.MTU != 1400 {
+		t.Fatalf("MTU Parse error %d/%d should be 1400", geneve1.MTU, gre1.MTU)
+	}
+
+	// test case2: endpoint mtu= which differs from tunnel MTU
+	veth2 := api.VEth{}
+	err2 := parseLinkIPOption(&veth2, "", strings.Split("testlink,mtu=9000", ","))
+	if err2 != nil {
+		t.Fatalf("Parse error: %v", err2)
+	}
+	if err2 = api.MakeGeneve(veth2, geneve1); err2 == nil ||
+		!strings.Contains(err2.Error(), "differ") {
+		t.Fatalf("MakeGeneve should fail with different MTU: %v", err2)
+	}
+	if err2 = api.MakeGre(veth2, gre1); err2 == nil ||
+		!strings.Contains(err2.Error(), "differ") {
+		t.Fatalf("MakeGre should fail with different MTU: %v", err2)
+	}
+}
+
+func TestParseRouteOption(t *testing.T) {
+	// test case1: parse "testlink,192.168.1.1/24,gw=192.168.1.254,route=10.0.0.0/8+via=192.168.1.253"
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "", strings.Split(
+		"testlink,192.168.1.1/24,gw=192.168.1.254,route=10.0.0.0/8+via=192.168.1.253", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if len(veth1.Routes) != 2 || veth1.Routes[0].Dst != nil ||
+		veth1.Routes[1].Dst.String() != "10.0.0.0/8" {
+		t.Fatalf("Routes Parse error %v", veth1.Routes)
+	}
+
+	// test case2: invalid gateway
+	veth2 := api.VEth{}
+	if err2 := parseLinkIPOption(&veth2, "",
+		strings.Split("testlink,gw=foo", ",")); err2 == nil {
+		t.Fatalf("Parse should fail with invalid gateway")
+	}
+}
+
+func TestParseVRFOption(t *testing.T) {
+	// test case1: parse "testlink,vrf=red+table=10,rule=from=10.0.0.0/8"
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "",
+		strings.Split("testlink,vrf=red+table=10,rule=from=10.0.0.0/8", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if veth1.VRF == nil || veth1.VRF.Name != "red" || veth1.VRF.Table != 10 {
+		t.Fatalf("VRF Parse error %+v", veth1.VRF)
+	}
+	if len(veth1.Rules) != 1 || veth1.Rules[0].Src.String() != "10.0.0.0/8" {
+		t.Fatalf("Rules Parse error %v", veth1.Rules)
+	}
+
+	// test case2: invalid rule
+	veth2 := api.VEth{}
+	if err2 := parseLinkIPOption(&veth2, "",
+		strings.Split("testlink,rule=from", ",")); err2 == nil {
+		t.Fatalf("Parse should fail with invalid rule")
+	}
+}
+
+func TestParseNeighOption(t *testing.T) {
+	// test case1: parse "testlink,neigh=2001:db8::2+02:00:00:00:00:02,neigh=peer"
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "", strings.Split(
+		"testlink,neigh=2001:db8::2+02:00:00:00:00:02,neigh=peer", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if len(veth1.Neighbors) != 1 || !veth1.PeerNeighbors ||
+		!veth1.Neighbors[0].IP.Equal(net.ParseIP("2001:db8::2")) {
+		t.Fatalf("Neighbors Parse error %v", veth1.Neighbors)
+	}
+
+	// test case2: invalid neighbors
+	for _, str := range []string{"testlink,neigh=10.1.1.1", "testlink,neigh=10.1.1.1+foo"} {
+		veth2 := api.VEth{}
+		if err2 := parseLinkIPOption(&veth2, "", strings.Split(str, ",")); err2 == nil {
+			t.Fatalf("Parse should fail with %s", str)
+		}
+	}
+}
+
+func TestParseAutoAddrOption(t *testing.T) {
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "", strings.Split("testlink,ip=auto", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if !veth1.AutoAddr || len(veth1.IPAddr) != 0 {
+		t.Fatalf("AutoAddr Parse error %+v", veth1)
+	}
+}
+
+func TestParseIPv6Option(t *testing.T) {
+	// test case1: parse "testlink,2001:db8::1/64,addrgenmode=none,acceptdad=0,waitdad=on"
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "", strings.Split(
+		"testlink,2001:db8::1/64,addrgenmode=none,acceptdad=0,waitdad=on", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if veth1.IPv6 == nil || veth1.IPv6.AddrGenMode != "none" ||
+		veth1.IPv6.AcceptDAD == nil || *veth1.IPv6.AcceptDAD != 0 ||
+		veth1.IPv6.AcceptRA != nil || !veth1.IPv6.WaitDAD {
+		t.Fatalf("IPv6 Parse error %+v", veth1.IPv6)
+	}
+
+	// test case1-1: stable_secret of docker container does not depend on
+	// its namespace path (/proc/<pid>/ns/net), which changes on restart
+	key := api.EndpointKey("docker", "web")
+	secret := api.GenerateStableSecret(key, "testlink")
+	for _, nsName := range []string{"/proc/100/ns/net", "/proc/200/ns/net"} {
+		veth := api.VEth{NsName: nsName}
+		err := parseLinkIPOption(&veth, key,
+			strings.Split("testlink,addrgenmode=stable-privacy", ","))
+		if err != nil {
+			t.Fatalf("Parse error: %v", err)
+		}
+		if veth.IPv6 == nil || veth.IPv6.StableSecret != secret {
+			t.Fatalf("IPv6 Parse error %+v, stable_secret should be %s",
+				veth.IPv6, secret)
+		}
+	}
+	if secret == api.GenerateStableSecret(api.EndpointKey("pid", "100"), "testlink") {
+		t.Fatalf("stable_secret should differ between endpoints")
+	}
+
+	// test case2: invalid settings
+	invalids := []string{
+		"testlink,addrgenmode=eui48",
+		"testlink,acceptra=3",
+		"testlink,waitdad=maybe",
+	}
+	for _, str := range invalids {
+		veth2 := api.VEth{}
+		if err2 := parseLinkIPOption(&veth2, "", strings.Split(str, ",")); err2 == nil {
+			t.Fatalf("Parse should fail with %s", str)
+		}
+	}
+}
+
+func TestParseSysctlOption(t *testing.T) {
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "", strings.Split(
+		"testlink,sysctl:net.ipv4.conf.{link}.rp_filter=0,sysctl:net.ipv4.ip_forward=1", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if len(veth1.Sysctls) != 2 ||
+		veth1.Sysctls["net.ipv4.conf.{link}.rp_filter"] != "0" ||
+		veth1.Sysctls["net.ipv4.ip_forward"] != "1" {
+		t.Fatalf("Sysctl Parse error %+v", veth1.Sysctls)
+	}
+
+	veth2 := api.VEth{}
+	if err2 := parseLinkIPOption(&veth2, "", strings.Split("testlink,sysctl:ip_forward", ",")); err2 == nil {
+		t.Fatalf("Parse should fail without value")
+	}
+}
+
+func TestParseNetemOption(t *testing.T) {
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "", strings.Split(
+		"testlink,192.168.1.1/24,netem=delay=100ms+loss=1", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if veth1.Netem == nil || veth1.Netem.Delay != 100*time.Millisecond ||
+		veth1.Netem.Loss != 1 || len(veth1.IPAddr) != 1 {
+		t.Fatalf("Netem Parse error %+v", veth1.Netem)
+	}
+}
+
+func TestParseShapeOption(t *testing.T) {
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "", strings.Split(
+		"testlink,shape=rate=10mbit+ceil=20mbit,netem=delay=10ms", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if veth1.Shaping == nil || veth1.Shaping.Rate != 10000000 ||
+		veth1.Shaping.Ceil != 20000000 || veth1.Netem == nil {
+		t.Fatalf("Shaping Parse error %+v", veth1.Shaping)
+	}
+}
+
+func TestParseMirrorMatchOption(t *testing.T) {
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "", strings.Split(
+		"testlink,mirror:ingress:eth0:tcp,dport=443,mirror:both:eth0:src=2001:db8::/64,192.168.1.1/24", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	// ingress from eth0 (tcp), ingress and egress from eth0 (src)
+	mirrors := veth1.Mirrors
+	if len(mirrors) != 3 || mirrors[1].Direction != "ingress" ||
+		mirrors[2].Direction != "egress" || mirrors[2].Source != "eth0" ||
+		len(mirrors[0].Match) != 1 || mirrors[0].Match[0].DstPort != 443 ||
+		mirrors[2].Match[0].Src.String() != "2001:db8::/64" ||
+		len(veth1.IPAddr) != 1 {
+		t.Fatalf("Mirror match Parse error %+v", veth1)
+	}
+
+	veth2 := api.VEth{}
+	if err2 := parseLinkIPOption(&veth2, "", strings.Split("testlink,mirror:ingress:eth0:dport=443", ",")); err2 == nil {
+		t.Fatalf("Parse should fail with port without protocol")
+	}
+	if err2 := parseLinkIPOption(&veth2, "", strings.Split("testlink,mirror:inbound:eth0", ",")); err2 == nil {
+		t.Fatalf("Parse should fail with unknown direction")
+	}
+}
+
+func TestParseMirrorsOption(t *testing.T) {
+	veth1 := api.VEth{}
+	err1 := parseLinkIPOption(&veth1, "", strings.Split(
+		"testlink,mirror:ingress:eth0,mirror:egress:eth1,mirror:both:eth2", ","))
+	if err1 != nil {
+		t.Fatalf("Parse error: %v", err1)
+	}
+	if len(veth1.Mirrors) != 4 || veth1.Mirrors[1].Source != "eth1" ||
+		veth1.Mirrors[1].Direction != "egress" || veth1.Mirrors[3].Source != "eth2" {
+		t.Fatalf("Mirrors Parse error %+v", veth1.Mirrors)
+	}
+}